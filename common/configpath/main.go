@@ -0,0 +1,30 @@
+// Directories searched for the configuration file.
+
+package configpath
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Directories searched, after --configPath, for the configuration file.  Order is important.  First defined; first used.
+// The home directory is from os.UserHomeDir(), so it is found on Windows, where $HOME is usually not set.
+// The "system-specific" directory is /etc/go-proxy-tee, or %ProgramData%\go-proxy-tee on Windows.
+func Paths() []string {
+	result := []string{"."}
+	if home, err := os.UserHomeDir(); err == nil {
+		result = append(result,
+			filepath.Join(home, "go", "src", "github.com", "docktermj", "go-proxy-tee"),
+			filepath.Join(home, ".go-proxy-tee"),
+		)
+	}
+	if runtime.GOOS == "windows" {
+		if programData := os.Getenv("ProgramData"); programData != "" {
+			result = append(result, filepath.Join(programData, "go-proxy-tee"))
+		}
+	} else {
+		result = append(result, "/etc/go-proxy-tee/")
+	}
+	return result
+}
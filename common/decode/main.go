@@ -0,0 +1,159 @@
+// Decode binaryXML with a time limit, so a pathological frame cannot stall the caller.
+
+package decode
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/BixData/binaryxml"
+	"github.com/BixData/binaryxml/messages"
+)
+
+const (
+	DEFAULT_TIMEOUT = time.Second
+)
+
+var ErrTimeout = errors.New("decode timed out")
+
+// A panic recovered while decoding malformed input.
+type PanicError struct {
+	Value interface{}
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("decode panicked: %v", err.Value)
+}
+
+// Run 'decode', returning a panic as a *PanicError.
+func recovered(decode func() error) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			err = &PanicError{Value: value}
+		}
+	}()
+	return decode()
+}
+
+// Run 'decode' in a goroutine, waiting no longer than 'timeout'.
+// After a timeout the goroutine may still be running; its results are discarded.
+// A 'timeout' of 0 or less means no limit.
+func withTimeout(ctx context.Context, timeout time.Duration, decode func() error) error {
+	if timeout <= 0 {
+		return recovered(decode)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- recovered(decode)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ErrTimeout
+	}
+}
+
+// messages.ReadMessage() with a time limit.
+// After a timeout, 'reader' must not be used again.
+func ReadMessage(ctx context.Context, timeout time.Duration, reader *bytes.Reader, param *uint8, xmlBuffer *[]byte) error {
+	var resultParam uint8
+	resultBuffer := make([]byte, len(*xmlBuffer))
+	err := withTimeout(ctx, timeout, func() error {
+		return messages.ReadMessage(reader, &resultParam, &resultBuffer)
+	})
+	if err != nil {
+		return err
+	}
+	*param = resultParam
+	*xmlBuffer = resultBuffer
+	return err
+}
+
+// binaryxml.ToXML() with a time limit.
+func ToXML(ctx context.Context, timeout time.Duration, xmlBuffer []byte) (string, error) {
+	var result string
+	err := withTimeout(ctx, timeout, func() error {
+		var err error
+		result, err = binaryxml.ToXML(xmlBuffer)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// Pretty-print XML, or with 'isCompact' write it on one line.
+func Format(data []byte, isCompact bool) ([]byte, error) {
+	if isCompact {
+		return Compact(data)
+	}
+	return Indent(data)
+}
+
+// Write XML on one line, without indentation.  Whitespace between elements is removed;
+// newlines within text are written as character references.
+func Compact(data []byte) ([]byte, error) {
+	b := &bytes.Buffer{}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	encoder := xml.NewEncoder(b)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			encoder.Flush()
+			return b.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if text, ok := token.(xml.CharData); ok {
+			if len(bytes.TrimSpace(text)) == 0 {
+				continue
+			}
+
+			// EncodeToken() writes newlines in text as they are.  xml.EscapeText() escapes them.
+
+			if err := encoder.Flush(); err != nil {
+				return nil, err
+			}
+			if err := xml.EscapeText(b, text); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = encoder.EncodeToken(token)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Pretty-print XML.
+func Indent(data []byte) ([]byte, error) {
+	b := &bytes.Buffer{}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	encoder := xml.NewEncoder(b)
+	encoder.Indent("", "   ")
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			encoder.Flush()
+			return b.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = encoder.EncodeToken(token)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
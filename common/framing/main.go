@@ -0,0 +1,69 @@
+// Find binaryXML frames in a byte stream.
+
+package framing
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+const (
+
+	// Lengths in XML.
+
+	BINARY_XML_LENGTH_BEGIN_TOKEN = 1
+	BINARY_XML_LENGTH_LENGTH      = 4
+	BINARY_XML_LENGTH_PARAM       = 1
+	BINARY_XML_LENGTH_END_TOKEN   = 1
+	BINARY_XML_LENGTH_CRC         = 4
+
+	BINARY_XML_LENGTHS = BINARY_XML_LENGTH_BEGIN_TOKEN +
+		BINARY_XML_LENGTH_LENGTH +
+		BINARY_XML_LENGTH_PARAM +
+		BINARY_XML_LENGTH_END_TOKEN +
+		BINARY_XML_LENGTH_CRC
+
+	// Largest frame that will be buffered.  Larger lengths are treated as corruption.
+
+	BINARY_XML_MAX_FRAME_LENGTH = 1024 * 1024 * 16
+
+	// Sentinals in XML.
+
+	BINARY_XML_START uint8 = 121
+)
+
+// Return the frame at the reader's position, as delimited by its length, or nil if there is none.
+// A frame that fits in the reader's buffer is peeked, not consumed, and 'isPeeked' is true; the caller Discards it
+// once it is used.  A larger frame is consumed.  A larger frame cut short by the end of the input is returned
+// as far as it was read, so its bytes are not lost.
+func Peek(reader *bufio.Reader) (frame []byte, isPeeked bool) {
+	header, err := reader.Peek(BINARY_XML_LENGTH_BEGIN_TOKEN + BINARY_XML_LENGTH_LENGTH)
+	if err != nil {
+		return nil, false
+	}
+	messageLength := binary.BigEndian.Uint32(header[BINARY_XML_LENGTH_BEGIN_TOKEN:])
+	if messageLength > BINARY_XML_MAX_FRAME_LENGTH {
+		return nil, false
+	}
+	frameLength := int(messageLength) + BINARY_XML_LENGTHS
+
+	// Small frames are peeked so a bad frame can be rescanned byte-by-byte.
+	// Frames larger than the read buffer have to be consumed to be seen.
+
+	if frameLength <= reader.Size() {
+		peeked, err := reader.Peek(frameLength)
+		if err != nil {
+			return nil, false
+		}
+		frame = make([]byte, frameLength)
+		copy(frame, peeked)
+		return frame, true
+	}
+	frame = make([]byte, frameLength)
+	length, err := io.ReadFull(reader, frame)
+	if err != nil && length == 0 {
+		return nil, false
+	}
+	return frame[:length], false
+}
@@ -0,0 +1,70 @@
+// Read and write replay scripts: one line per message, "<direction> <delay> <hex payload>".
+// For example:
+//
+//	# go-proxy-tee script
+//	request 0s 7900000004013c612f3e7b00000000
+//	response 1.52ms 7900000004013c622f3e7b00000000
+//
+// 'delay' is the time since the previous message, as a Go duration.  Blank lines and lines beginning with "#" are ignored.
+
+package script
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	DIRECTION_REQUEST  = "request"  // Sent by the client.
+	DIRECTION_RESPONSE = "response" // Sent by the server.
+
+	HEADER = "# go-proxy-tee script: <direction> <delay> <hex payload>"
+)
+
+// One message of a script.
+type Line struct {
+	Delay     time.Duration // Since the previous message.
+	Direction string
+	Payload   []byte
+}
+
+// Format a line of a script.
+func (line Line) String() string {
+	return fmt.Sprintf("%s %s %s", line.Direction, line.Delay, hex.EncodeToString(line.Payload))
+}
+
+// Read the lines of a script.  Errors name the line number.
+func Read(reader io.Reader) ([]Line, error) {
+	result := []Line{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 1024*64), 1024*1024*64)
+	number := 0
+	for scanner.Scan() {
+		number++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected '<direction> <delay> <hex payload>', got %d fields", number, len(fields))
+		}
+		if fields[0] != DIRECTION_REQUEST && fields[0] != DIRECTION_RESPONSE {
+			return nil, fmt.Errorf("line %d: direction '%s' is not '%s' or '%s'", number, fields[0], DIRECTION_REQUEST, DIRECTION_RESPONSE)
+		}
+		delay, err := time.ParseDuration(fields[1])
+		if err != nil || delay < 0 {
+			return nil, fmt.Errorf("line %d: bad delay '%s'", number, fields[1])
+		}
+		payload, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad hex payload. Err: %v", number, err)
+		}
+		result = append(result, Line{Delay: delay, Direction: fields[0], Payload: payload})
+	}
+	return result, scanner.Err()
+}
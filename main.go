@@ -5,8 +5,19 @@ import (
 	"log"
 
 	"github.com/docktermj/go-proxy-tee/common/runner"
+	"github.com/docktermj/go-proxy-tee/subcommand/bench"
 	"github.com/docktermj/go-proxy-tee/subcommand/binaryfile"
+	"github.com/docktermj/go-proxy-tee/subcommand/decoder"
+	"github.com/docktermj/go-proxy-tee/subcommand/exportscript"
+	"github.com/docktermj/go-proxy-tee/subcommand/extract"
+	"github.com/docktermj/go-proxy-tee/subcommand/formats"
+	"github.com/docktermj/go-proxy-tee/subcommand/initconfig"
 	"github.com/docktermj/go-proxy-tee/subcommand/net"
+	"github.com/docktermj/go-proxy-tee/subcommand/replay"
+	"github.com/docktermj/go-proxy-tee/subcommand/selftest"
+	"github.com/docktermj/go-proxy-tee/subcommand/split"
+	"github.com/docktermj/go-proxy-tee/subcommand/verify"
+	"github.com/docktermj/go-proxy-tee/subcommand/view"
 	"github.com/docopt/docopt-go"
 )
 
@@ -28,7 +39,18 @@ Options:
 
 The commands are:
     net         Relay through different types of networks
+    bench       Measure the proxy's throughput and added latency
     binaryfile  Transform 'go-proxy-tee net --format=binaryfile' output to XML
+    decode      Decode binaryXML given in hex, interactively with --repl
+    export-script  Write one connection of a 'json' capture as a script for 'replay --script'
+    extract     Decode the frames of one region of a 'binaryfile' capture
+    formats     List the values accepted by '--format'
+    init        Write an example go-proxy-tee.json
+    replay      Send a 'binaryfile' capture to a server, optionally corrupting its frames
+    selftest    Proxy a known payload through loopback servers and verify the output
+    split       Write each binaryXML message of a 'binaryfile' capture to its own file
+    verify      Check that every frame of a 'binaryfile' capture decodes
+    view        Page through a capture a block at a time, with search
 
 See 'go-proxy-tee <command> --help' for more information on a specific command.
 `
@@ -36,6 +58,7 @@ See 'go-proxy-tee <command> --help' for more information on a specific command.
 
 	commandVersion := fmt.Sprintf("%s %s-%s", programName, buildVersion, buildIteration)
 	args, _ := docopt.Parse(usage, nil, true, commandVersion, true)
+	net.Version = commandVersion
 
 	// Configure output log.
 
@@ -50,8 +73,19 @@ See 'go-proxy-tee <command> --help' for more information on a specific command.
 	// Reference: http://stackoverflow.com/questions/6769020/go-map-of-functions
 
 	functions := map[string]interface{}{
-		"binaryfile": binaryfile.Command,
-		"net":        net.Command,
+		"bench":         bench.Command,
+		"binaryfile":    binaryfile.Command,
+		"decode":        decoder.Command,
+		"export-script": exportscript.Command,
+		"extract":       extract.Command,
+		"formats":       formats.Command,
+		"init":          initconfig.Command,
+		"net":           net.Command,
+		"replay":        replay.Command,
+		"selftest":      selftest.Command,
+		"split":         split.Command,
+		"verify":        verify.Command,
+		"view":          view.Command,
 	}
 
 	runner.Run(argv, functions, usage)
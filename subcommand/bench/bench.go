@@ -0,0 +1,286 @@
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	proxy "github.com/docktermj/go-proxy-tee/subcommand/net"
+	"github.com/docopt/docopt-go"
+)
+
+// Longest time to wait for the proxy to start, and for one round trip.
+const BENCH_TIMEOUT = time.Second * 5
+
+// Round trips timed over one run of the clients.
+type Result struct {
+	bytes     int64
+	elapsed   time.Duration
+	latencies []time.Duration // Sorted.
+}
+
+// Function for the "command pattern".
+func Command(argv []string) {
+
+	usage := `
+Usage:
+    go-proxy-tee bench [options]
+
+Options:
+   -h, --help
+   --size=<bytes>         Bytes in each message. [default: 1024]
+   --connections=<count>  Client connections sending at once. [default: 4]
+   --duration=<duration>  How long to send, e.g. "10s", directly and then through the proxy. [default: 10s]
+   --format=<format>      Format of the proxy's output files. [default: hex]
+   --config=<file>        A JSON file of more "net" settings, e.g. {"output": {"buffered": true}}.
+   --keep                 Keep the temporary directory of configuration and output files.
+
+Measures the proxy: runs it in-process, with an in-process echo server as its outbound server,
+and has each connection send a message and read it back, repeatedly, for --duration.
+The same clients first run for --duration against the echo server directly.
+Prints throughput, in messages and megabytes per second of messages sent, the latency of round trips,
+and the latency the proxy adds: the difference of the medians (p50) and of the 99th percentiles (p99).
+`
+
+	// DocOpt processing.
+
+	args, _ := docopt.Parse(usage, nil, true, "", false)
+	size, err := strconv.Atoi(args["--size"].(string))
+	if err != nil || size <= 0 {
+		log.Fatalf("Bad --size '%s'. Err: %+v\n", args["--size"].(string), err)
+	}
+	connections, err := strconv.Atoi(args["--connections"].(string))
+	if err != nil || connections <= 0 {
+		log.Fatalf("Bad --connections '%s'. Err: %+v\n", args["--connections"].(string), err)
+	}
+	duration, err := time.ParseDuration(args["--duration"].(string))
+	if err != nil || duration <= 0 {
+		log.Fatalf("Bad --duration '%s'. Err: %+v\n", args["--duration"].(string), err)
+	}
+	settings := map[string]interface{}{}
+	if fileName, ok := args["--config"].(string); ok {
+		contents, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			log.Fatalf("Reading --config %s failed. Err: %+v\n", fileName, err)
+		}
+		if err := json.Unmarshal(contents, &settings); err != nil {
+			log.Fatalf("--config %s is not a JSON object. Err: %+v\n", fileName, err)
+		}
+	}
+
+	directory, err := ioutil.TempDir("", "go-proxy-tee-bench")
+	if err != nil {
+		log.Fatalf("ioutil.TempDir() failed. Err: %+v\n", err)
+	}
+	if args["--keep"].(bool) {
+		fmt.Printf("Files in %s\n", directory)
+	} else {
+		defer os.RemoveAll(directory)
+	}
+
+	server := echoServer()
+	defer server.Close()
+	message := make([]byte, size)
+	for index := range message {
+		message[index] = byte(index)
+	}
+
+	fmt.Printf("Sending %d byte messages on %d connections for %s, directly and through the proxy.\n", size, connections, duration)
+	direct, err := runClients(server.Addr().String(), connections, duration, message)
+	if err != nil {
+		log.Fatalf("Sending to the echo server failed. Err: %+v\n", err)
+	}
+	proxied, err := runProxied(directory, args["--format"].(string), settings, server.Addr().String(), connections, duration, message)
+	if err != nil {
+		if !args["--keep"].(bool) {
+			os.RemoveAll(directory)
+		}
+		log.Fatalf("Sending through the proxy failed. Err: %+v\n", err)
+	}
+
+	fmt.Printf("%-8s %12s %10s %12s %12s\n", "", "messages/s", "MB/s", "p50", "p99")
+	for _, row := range []struct {
+		name   string
+		result Result
+	}{{"direct", direct}, {"proxied", proxied}} {
+		fmt.Printf("%-8s %12.0f %10.2f %12s %12s\n", row.name, row.result.messagesPerSecond(), row.result.megabytesPerSecond(), row.result.percentile(50), row.result.percentile(99))
+	}
+	fmt.Printf("Added latency: p50 %s, p99 %s\n", proxied.percentile(50)-direct.percentile(50), proxied.percentile(99)-direct.percentile(99))
+}
+
+// Run the real proxy loop in-process, in front of 'serverAddress', and time the clients through it.
+// 'settings' are merged over the generated configuration.
+func runProxied(directory string, format string, settings map[string]interface{}, serverAddress string, connections int, duration time.Duration, message []byte) (Result, error) {
+	inboundAddress := freeAddress()
+	config := map[string]interface{}{
+		"format":   format,
+		"inbound":  map[string]interface{}{"network": "tcp", "address": inboundAddress, "output": filepath.Join(directory, "client.txt")},
+		"outbound": map[string]interface{}{"network": "tcp", "address": serverAddress, "output": filepath.Join(directory, "server.txt")},
+	}
+	merge(config, settings)
+	contents, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return Result{}, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(directory, "go-proxy-tee.json"), contents, 0644); err != nil {
+		return Result{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		proxy.Run(ctx, []string{"net", "--configPath=" + directory, "--quiet"})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	connection, err := dial(inboundAddress)
+	if err != nil {
+		return Result{}, fmt.Errorf("connecting to the proxy at %s failed. Err: %+v", inboundAddress, err)
+	}
+	connection.Close()
+	return runClients(inboundAddress, connections, duration, message)
+}
+
+// Set the values of 'overrides' in 'config', merging the maps within them.
+func merge(config map[string]interface{}, overrides map[string]interface{}) {
+	for key, value := range overrides {
+		nested, isMap := value.(map[string]interface{})
+		existing, isExistingMap := config[key].(map[string]interface{})
+		if isMap && isExistingMap {
+			merge(existing, nested)
+			continue
+		}
+		config[key] = value
+	}
+}
+
+// Have 'connections' clients send 'message' to 'address' and read it back, repeatedly, for 'duration'.
+func runClients(address string, connections int, duration time.Duration, message []byte) (Result, error) {
+	var lock sync.Mutex
+	var waitGroup sync.WaitGroup
+	result := Result{}
+	errs := make(chan error, connections)
+	start := time.Now()
+	deadline := start.Add(duration)
+	for index := 0; index < connections; index++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			latencies, err := roundTrips(address, deadline, message)
+			if err != nil {
+				errs <- err
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			result.latencies = append(result.latencies, latencies...)
+		}()
+	}
+	waitGroup.Wait()
+	result.elapsed = time.Since(start)
+	close(errs)
+	if err := <-errs; err != nil {
+		return result, err
+	}
+	result.bytes = int64(len(result.latencies)) * int64(len(message))
+	sort.Slice(result.latencies, func(i, j int) bool { return result.latencies[i] < result.latencies[j] })
+	return result, nil
+}
+
+// Send 'message' and read it back until 'deadline'.  Returns the time of each round trip.
+func roundTrips(address string, deadline time.Time, message []byte) ([]time.Duration, error) {
+	connection, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+	received := make([]byte, len(message))
+	latencies := []time.Duration{}
+	for time.Now().Before(deadline) {
+		sent := time.Now()
+		connection.SetDeadline(sent.Add(BENCH_TIMEOUT))
+		if _, err := connection.Write(message); err != nil {
+			return latencies, err
+		}
+		if _, err := io.ReadFull(connection, received); err != nil {
+			return latencies, err
+		}
+		latencies = append(latencies, time.Since(sent))
+	}
+	return latencies, nil
+}
+
+func (result Result) messagesPerSecond() float64 {
+	return float64(len(result.latencies)) / result.elapsed.Seconds()
+}
+
+func (result Result) megabytesPerSecond() float64 {
+	return float64(result.bytes) / (1024 * 1024) / result.elapsed.Seconds()
+}
+
+// The round-trip time that 'percent' percent of round trips took at most.
+func (result Result) percentile(percent int) time.Duration {
+	if len(result.latencies) == 0 {
+		return 0
+	}
+	index := (len(result.latencies)*percent+99)/100 - 1
+	if index < 0 {
+		index = 0
+	}
+	return result.latencies[index].Round(time.Microsecond)
+}
+
+// A loopback server that returns what it receives.
+func echoServer() net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Echo server net.Listen() failed. Err: %+v\n", err)
+	}
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer connection.Close()
+				io.Copy(connection, connection)
+			}()
+		}
+	}()
+	return listener
+}
+
+// A loopback address that is not in use.
+func freeAddress() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("net.Listen() failed. Err: %+v\n", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// Connect to the proxy, waiting for it to start listening.
+func dial(address string) (net.Conn, error) {
+	deadline := time.Now().Add(BENCH_TIMEOUT)
+	for {
+		connection, err := net.Dial("tcp", address)
+		if err == nil || time.Now().After(deadline) {
+			return connection, err
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
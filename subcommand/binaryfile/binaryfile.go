@@ -1,7 +1,9 @@
 package binaryfile
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/xml"
 	"fmt"
@@ -9,23 +11,61 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-
-	"github.com/BixData/binaryxml"
-	"github.com/BixData/binaryxml/messages"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docktermj/go-proxy-tee/common/configpath"
+	"github.com/docktermj/go-proxy-tee/common/decode"
+	"github.com/docktermj/go-proxy-tee/common/framing"
 	"github.com/docopt/docopt-go"
 	"github.com/spf13/viper"
 )
 
 const (
-	BINARY_XML_START uint8 = 121
+	BINARY_XML_START = framing.BINARY_XML_START
+
+	BUFFER_LENGTH = 1024 * 64
 )
 
+// Values of --on-error: how far to advance after a frame fails to decode.
+const (
+	ON_ERROR_ABORT      = "abort"      // Stop converting the file.
+	ON_ERROR_SKIP_BYTE  = "skip-byte"  // Write the frame's first byte as hex, and look for a frame after it.
+	ON_ERROR_SKIP_FRAME = "skip-frame" // Write the bytes up to the next BINARY_XML_START as hex.
+)
+
+// How decode errors are recovered from.
+type Recovery struct {
+	MaxErrors int // Stop converting a file after more decode errors than this.  0 means no limit.
+	OnError   string
+}
+
+// Count a decode error of the frame at 'offset'.  Returns an error if converting the file stops.
+func (recovery Recovery) fail(summary *Summary, offset int, err error) error {
+	summary.DecodeErrors++
+	if recovery.OnError == ON_ERROR_ABORT {
+		return fmt.Errorf("frame at offset %d does not decode: %v", offset, err)
+	}
+	if recovery.MaxErrors > 0 && summary.DecodeErrors > recovery.MaxErrors {
+		return fmt.Errorf("more than %d frames do not decode", recovery.MaxErrors)
+	}
+	return nil
+}
+
 // Load configuration file.
 func loadConfig(args map[string]interface{}) {
 
 	// Set configuration file path.
 
-	viper.SetConfigName("go-proxy-tee") // name of config file (without extension)
+	configName := "go-proxy-tee" // name of config file (without extension)
+	if configNameParameter := args["--configName"]; configNameParameter != nil {
+		configName = configNameParameter.(string)
+	}
+	viper.SetConfigName(configName)
 
 	// Add paths of where the configuration file may be found. Order is important.  First defined; first used.
 
@@ -38,10 +78,9 @@ func loadConfig(args map[string]interface{}) {
 
 	// Other paths in precedence order.  Order is important.
 
-	viper.AddConfigPath(".")
-	viper.AddConfigPath("$HOME/go/src/github.com/docktermj/go-proxy-tee/")
-	viper.AddConfigPath("$HOME/.go-proxy-tee") // call multiple times to add many search paths
-	viper.AddConfigPath("/etc/go-proxy-tee/")  // path to look for the config file in
+	for _, path := range configpath.Paths() {
+		viper.AddConfigPath(path)
+	}
 
 	// Load configuration contents.
 
@@ -56,53 +95,116 @@ func loadConfig(args map[string]interface{}) {
 	if debugParameter.(bool) {
 		viper.Set("debug", true)
 	}
+
+	if args["--compact"].(bool) {
+		viper.Set("xml.compact", true)
+	}
+
+	// Quiet suppresses informational output, including debugging messages.
+
+	quietParameter := args["--quiet"]
+	if quietParameter.(bool) {
+		viper.Set("quiet", true)
+		viper.Set("debug", false)
+	}
 }
 
-// Pretty-print XML.
-func formatXml(data []byte) ([]byte, error) {
-	b := &bytes.Buffer{}
-	decoder := xml.NewDecoder(bytes.NewReader(data))
-	encoder := xml.NewEncoder(b)
-	encoder.Indent("", "   ")
-	for {
-		token, err := decoder.Token()
-		if err == io.EOF {
-			encoder.Flush()
-			return b.Bytes(), nil
+// Time limit for decoding one binaryXML frame, from "decode.timeout".
+func decodeTimeout() time.Duration {
+	value := viper.GetString("decode.timeout")
+	if value == "" {
+		return decode.DEFAULT_TIMEOUT
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Bad decode.timeout '%s'. Using %s. Err: %+v\n", value, decode.DEFAULT_TIMEOUT, err)
+		return decode.DEFAULT_TIMEOUT
+	}
+	return timeout
+}
+
+// Output file names of the tees, in configuration order.
+// "tee" may be a list of objects or a map keyed by tee name.
+func teeOutputs() []string {
+	result := []string{}
+	switch stanzas := viper.Get("tee").(type) {
+	case []interface{}:
+		for _, value := range stanzas {
+			if stanza, ok := value.(map[string]interface{}); ok {
+				if output, ok := stanza["output"].(string); ok {
+					result = append(result, output)
+				}
+			}
 		}
-		if err != nil {
-			return nil, err
+	case map[string]interface{}:
+		keys := make([]string, 0, len(stanzas))
+		for key := range stanzas {
+			keys = append(keys, key)
 		}
-		err = encoder.EncodeToken(token)
-		if err != nil {
-			return nil, err
+		sort.Strings(keys)
+		for _, key := range keys {
+			if stanza, ok := stanzas[key].(map[string]interface{}); ok {
+				if output, ok := stanza["output"].(string); ok {
+					result = append(result, output)
+				}
+			}
 		}
 	}
+	return result
+}
+
+// After a panic in the decoder, log the offending frame in hex.
+func logPanicFrame(frame []byte, err error) {
+	if _, isPanic := err.(*decode.PanicError); isPanic {
+		log.Printf("Frame:\n%s", hex.Dump(frame))
+	}
 }
 
 // Read binaryXML and transform to pretty-printed XML.
-func readXml(reader *bytes.Reader, outputFile *os.File) error {
+// On a bad frame, recover as 'recovery' says.
+func readXml(reader *bufio.Reader, outputFile io.Writer, summary *Summary, recovery Recovery) (int, error) {
 
 	// Read a "message".
 
+	frame, peeked := framing.Peek(reader)
+	if frame == nil {
+		return readHex(reader, outputFile, summary)
+	}
+
+	ctx := context.Background()
+	timeout := decodeTimeout()
 	var param uint8
 	xmlBuffer := make([]byte, 4096)
-	err := messages.ReadMessage(reader, &param, &xmlBuffer)
+	err := decode.ReadMessage(ctx, timeout, bytes.NewReader(frame), &param, &xmlBuffer)
 	if err != nil {
-		fmt.Printf("binaryxml.ReadMessage() failed. Err: %+v\n", err)
+		log.Printf("binaryxml.ReadMessage() failed at offset %d. Err: %+v\n", summary.TotalBytes, err)
+		return recoverFrame(reader, outputFile, summary, recovery, frame, peeked, err)
 	}
 
 	// Transform binary XML to XML.
 
-	xmlString, err := binaryxml.ToXML(xmlBuffer)
+	// A frame whose XML does not decode is a decode error, not a decoded frame.
+
+	xmlString, err := decode.ToXML(ctx, timeout, xmlBuffer)
 	if err != nil {
-		fmt.Printf("binaryxml.ToXML() failed. Err: %+v\n", err)
+		log.Printf("binaryxml.ToXML() failed at offset %d. Err: %+v\n", summary.TotalBytes, err)
+		if _, isPanic := err.(*decode.PanicError); isPanic || err == decode.ErrTimeout {
+			if _, err := fmt.Fprintf(outputFile, "<!-- %s -->\n\n", err); err != nil {
+				return 0, err
+			}
+		}
+		return recoverFrame(reader, outputFile, summary, recovery, frame, peeked, err)
+	}
+	if peeked {
+		reader.Discard(len(frame))
 	}
+	summary.addFrame(xmlString)
 
-	// "Pretty print" the XML and write to file.
+	// "Pretty print" the XML and write to file.  With "xml.compact", each message is one line.
 
 	if len(xmlString) > 0 {
-		formattedXml, err := formatXml([]byte(xmlString))
+		isCompact := viper.GetBool("xml.compact")
+		formattedXml, err := decode.Format([]byte(xmlString), isCompact)
 		if err != nil {
 			// no reason to panic, just write unformatted output
 			_, err = outputFile.Write([]byte(xmlString))
@@ -110,95 +212,225 @@ func readXml(reader *bytes.Reader, outputFile *os.File) error {
 			_, err = outputFile.Write(formattedXml)
 		}
 		if err != nil {
-			panic(err)
+			return len(frame), err
+		}
+		separator := "\n\n"
+		if isCompact {
+			separator = "\n"
 		}
-		_, err = outputFile.WriteString("\n\n")
+		_, err = io.WriteString(outputFile, separator)
 		if err != nil {
-			panic(err)
+			return len(frame), err
 		}
 	}
-	return nil
+	return len(frame), nil
+}
+
+// After 'frame', at the reader's position, fails to decode with 'err', advance as 'recovery' says.
+// A frame too large to peek has already been consumed, so it is written whole in hex.
+func recoverFrame(reader *bufio.Reader, outputFile io.Writer, summary *Summary, recovery Recovery, frame []byte, peeked bool, err error) (int, error) {
+	logPanicFrame(frame, err)
+	consumed := 0
+	if !peeked {
+		consumed = len(frame)
+	}
+	if err := recovery.fail(summary, summary.TotalBytes, err); err != nil {
+		return consumed, err
+	}
+	if !peeked {
+		summary.BadRegions++
+		_, err = io.WriteString(outputFile, hex.Dump(frame)+"\n")
+		return consumed, err
+	}
+	if recovery.OnError == ON_ERROR_SKIP_BYTE {
+		reader.Discard(1)
+		summary.BadRegions++
+		_, err = io.WriteString(outputFile, hex.Dump(frame[:1])+"\n")
+		return 1, err
+	}
+	return readHex(reader, outputFile, summary)
 }
 
 // Read binary and transform to "hexdump -C ..." format.
-func readHex(reader *bytes.Reader, outputFile *os.File) error {
-	result := new(bytes.Buffer)
+// Bytes are streamed through the hex dumper until the next BINARY_XML_START is found.
+// At least one byte is always consumed.
+func readHex(reader *bufio.Reader, outputFile io.Writer, summary *Summary) (int, error) {
+	count := 0
+	dumper := hex.Dumper(outputFile)
 
 	// Loop through reader until BINARY_XML_START is found.
 
-	binaryXmlStart := []byte{BINARY_XML_START}
-	aByte := make([]byte, 1)
-	_, err := reader.Read(aByte)
-	for bytes.Compare(aByte, binaryXmlStart) != 0 {
-		result.WriteByte(aByte[0])
-		_, err := reader.Read(aByte)
-		if err != nil {
+	aByte, err := reader.ReadByte()
+	for err == nil {
+		count++
+		if _, err := dumper.Write([]byte{aByte}); err != nil {
+			return count, err
+		}
+		next, err := reader.Peek(1)
+		if err != nil || next[0] == BINARY_XML_START {
 			break
 		}
+		aByte, err = reader.ReadByte()
+	}
+	if count > 0 {
+		summary.BadRegions++
 	}
-
-	// Back the reader up by 1 byte.
-
-	reader.Seek(-1, 1) //  1 means from current position. https://socketloop.com/references/golang-bytes-reader-seek-function-example
 
 	// Write in "hexdump -C ..." format.
 
-	_, err = outputFile.Write([]byte(hex.Dump(result.Bytes())))
+	err = dumper.Close()
 	if err != nil {
-		panic(err)
+		return count, err
 	}
-	_, err = outputFile.WriteString("\n")
-	if err != nil {
-		panic(err)
+	_, err = io.WriteString(outputFile, "\n")
+	return count, err
+}
+
+// Statistics gathered while decoding a file.
+type Summary struct {
+	BadRegions   int
+	DecodeErrors int
+	Frames       int
+	RootElements map[string]int
+	TotalBytes   int
+}
+
+func newSummary() *Summary {
+	return &Summary{
+		RootElements: map[string]int{},
 	}
+}
 
-	return nil
+// Record a decoded frame and the name of its root element.
+func (summary *Summary) addFrame(xmlString string) {
+	summary.Frames++
+	rootElement := "(empty)"
+	decoder := xml.NewDecoder(strings.NewReader(xmlString))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		if startElement, ok := token.(xml.StartElement); ok {
+			rootElement = startElement.Name.Local
+			break
+		}
+	}
+	summary.RootElements[rootElement]++
+}
+
+// Print statistics in a human-readable form.
+func (summary *Summary) print(writer io.Writer, fileName string) {
+	fmt.Fprintf(writer, "File: %s\n", fileName)
+	fmt.Fprintf(writer, "   Total bytes:   %d\n", summary.TotalBytes)
+	fmt.Fprintf(writer, "   Frames:        %d\n", summary.Frames)
+	fmt.Fprintf(writer, "   Bad regions:   %d\n", summary.BadRegions)
+	fmt.Fprintf(writer, "   Decode errors: %d\n", summary.DecodeErrors)
+	fmt.Fprintf(writer, "   Root elements:\n")
+	names := make([]string, 0, len(summary.RootElements))
+	for name := range summary.RootElements {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(writer, "      %-30s %d\n", name, summary.RootElements[name])
+	}
+	fmt.Fprintln(writer)
 }
 
-func formatBinaryXml(inputFileName string) {
+// Decode a file.  Write XML to "<inputFileName>.xml" or, if 'isSummary', only gather statistics.
+func formatBinaryXml(inputFileName string, isSummary bool, recovery Recovery) (*Summary, error) {
 	isDebug := viper.GetBool("debug")
+	summary := newSummary()
 
 	// Open input file.
 
 	inputFile, err := os.Open(inputFileName)
 	if err != nil {
-		panic(err)
+		return summary, err
 	}
 	defer inputFile.Close()
 
-	// Read input file contents.
+	// Read input file contents incrementally.
 
-	inputFileBytes, err := ioutil.ReadAll(inputFile)
-	if err != nil {
-		panic(err)
-	}
-	reader := bytes.NewReader(inputFileBytes)
+	reader := bufio.NewReaderSize(inputFile, BUFFER_LENGTH)
 
 	// Create output file.
 
 	outputFileName := fmt.Sprintf("%s.xml", inputFileName)
-	outputFile, err := os.OpenFile(outputFileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		panic(err)
+	var output io.Writer = ioutil.Discard
+	if !isSummary {
+		outputFile, err := os.OpenFile(outputFileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return summary, err
+		}
+		defer outputFile.Close()
+		output = outputFile
 	}
-	defer outputFile.Close()
 
 	// Process input file.
 
-	maxReaderLength := reader.Len()
-	for reader.Len() > 0 {
-		currentOffset := maxReaderLength - reader.Len()
-		switch inputFileBytes[currentOffset] {
+	for {
+		token, err := reader.Peek(1)
+		if err != nil {
+			break
+		}
+		var count int
+		switch token[0] {
 		case BINARY_XML_START:
-			readXml(reader, outputFile)
+			count, err = readXml(reader, output, summary, recovery)
 		default:
-			readHex(reader, outputFile)
+			count, err = readHex(reader, output, summary)
 		}
+		summary.TotalBytes += count
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	if isDebug && !isSummary {
+		log.Printf("Processed %d bytes for '%s'\n", summary.TotalBytes, outputFileName)
 	}
+	return summary, nil
+}
+
+// Result of converting a single file.
+type conversion struct {
+	err      error
+	fileName string
+	summary  *Summary
+}
 
-	if isDebug {
-		log.Printf("Processed %d bytes for '%s'\n", maxReaderLength, outputFileName)
+// Convert files using a bounded pool of 'concurrency' workers.
+// Results are returned in the same order as 'fileNames'.
+func formatBinaryXmlFiles(fileNames []string, isSummary bool, concurrency int, recovery Recovery) []conversion {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]conversion, len(fileNames))
+	jobs := make(chan int)
+	var waitGroup sync.WaitGroup
+
+	for worker := 0; worker < concurrency; worker++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for index := range jobs {
+				summary, err := formatBinaryXml(fileNames[index], isSummary, recovery)
+				results[index] = conversion{
+					err:      err,
+					fileName: fileNames[index],
+					summary:  summary,
+				}
+			}
+		}()
+	}
+	for index := range fileNames {
+		jobs <- index
 	}
+	close(jobs)
+	waitGroup.Wait()
+	return results
 }
 
 // Function for the "command pattern".
@@ -210,16 +442,50 @@ Usage:
 
 Options:
    -h, --help
+   --compact                           Write each message's XML on one line, without indentation
+   --concurrency=<count>               Number of files converted at the same time
+   --configName=<name>                 Configuration file name without extension. Default: 'go-proxy-tee'
    --configPath=<configuration_path>   Directory of go-proxy-tee.json configuration file
    --debug                             Log debugging messages
+   --max-errors=<count>                Stop converting a file after more than <count> frames fail to decode; 0 for no limit [default: 0]
+   --on-error=<action>                 After a frame fails to decode: 'skip-frame', 'skip-byte', or 'abort' [default: skip-frame]
+   --quiet                             Suppress informational output; errors are still logged
+   --summary                           Print decode statistics instead of writing XML
 
 Where:
+   count                Default: number of CPUs
    configuration_path   Example: '/path/to/configuration'
+   action               skip-frame   Write the bytes up to the next frame start byte as hex; a frame may begin inside the bad one.
+                        skip-byte    Write the bad frame's first byte as hex, and look for a frame from the next byte.
+                        abort        Stop converting the file.
 `
 
 	// DocOpt processing.
 
 	args, _ := docopt.Parse(usage, nil, true, "", false)
+	isSummary := args["--summary"].(bool)
+
+	concurrency := runtime.NumCPU()
+	concurrencyParameter := args["--concurrency"]
+	if concurrencyParameter != nil {
+		value, err := strconv.Atoi(concurrencyParameter.(string))
+		if err != nil {
+			log.Fatalf("Bad --concurrency value '%s'. Err: %+v\n", concurrencyParameter, err)
+		}
+		concurrency = value
+	}
+
+	recovery := Recovery{OnError: args["--on-error"].(string)}
+	switch recovery.OnError {
+	case ON_ERROR_ABORT, ON_ERROR_SKIP_BYTE, ON_ERROR_SKIP_FRAME:
+	default:
+		log.Fatalf("Bad --on-error value '%s'. It must be '%s', '%s', or '%s'.\n", recovery.OnError, ON_ERROR_SKIP_FRAME, ON_ERROR_SKIP_BYTE, ON_ERROR_ABORT)
+	}
+	maxErrors, err := strconv.Atoi(args["--max-errors"].(string))
+	if err != nil || maxErrors < 0 {
+		log.Fatalf("Bad --max-errors value '%s'. Err: %+v\n", args["--max-errors"], err)
+	}
+	recovery.MaxErrors = maxErrors
 
 	// Get configuration.
 
@@ -227,16 +493,27 @@ Where:
 
 	// Transform input, output, and tee files.
 
-	inboundOutput := viper.GetString("inbound.output")
-	formatBinaryXml(inboundOutput)
+	fileNames := []string{
+		viper.GetString("inbound.output"),
+		viper.GetString("outbound.output"),
+	}
+	fileNames = append(fileNames, teeOutputs()...)
+
+	results := formatBinaryXmlFiles(fileNames, isSummary, concurrency, recovery)
 
-	outboundOutput := viper.GetString("outbound.output")
-	formatBinaryXml(outboundOutput)
+	// Report summaries and errors after all files are done.
 
-	teeDefinitions := viper.GetStringMap("tee")
-	for key, _ := range teeDefinitions {
-		teeDefinition := teeDefinitions[key].(map[string]interface{})
-		teeOutput := teeDefinition["output"].(string)
-		formatBinaryXml(teeOutput)
+	failures := 0
+	for _, result := range results {
+		if isSummary && result.err == nil {
+			result.summary.print(os.Stdout, result.fileName)
+		}
+		if result.err != nil {
+			failures++
+			log.Printf("Converting '%s' failed. Err: %+v\n", result.fileName, result.err)
+		}
+	}
+	if failures > 0 {
+		log.Fatalf("%d of %d files failed to convert.\n", failures, len(results))
 	}
 }
@@ -0,0 +1,44 @@
+package binaryfile
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Two frames that do not decode: their end token is 0 instead of '{', followed by two bytes that are not a frame.
+func corruptedInput() []byte {
+	badFrame := []byte{BINARY_XML_START, 0, 0, 0, 2, 0, 'A', 'B', 0, 0, 0, 0, 0}
+	return append(append(append([]byte{}, badFrame...), badFrame...), 'z', 'z')
+}
+
+func TestOnErrorModes(test *testing.T) {
+	fileName := filepath.Join(test.TempDir(), "corrupted.bin")
+	if err := ioutil.WriteFile(fileName, corruptedInput(), 0600); err != nil {
+		test.Fatal(err)
+	}
+	testCases := []struct {
+		recovery     Recovery
+		isFailed     bool
+		badRegions   int
+		decodeErrors int
+		totalBytes   int
+	}{
+		// Each bad frame is one region, up to the next frame start byte.
+		{recovery: Recovery{OnError: ON_ERROR_SKIP_FRAME}, badRegions: 2, decodeErrors: 2, totalBytes: 28},
+		// Each bad frame's start byte is a region, and the bytes after it another.
+		{recovery: Recovery{OnError: ON_ERROR_SKIP_BYTE}, badRegions: 4, decodeErrors: 2, totalBytes: 28},
+		{recovery: Recovery{OnError: ON_ERROR_ABORT}, isFailed: true, decodeErrors: 1},
+		{recovery: Recovery{OnError: ON_ERROR_SKIP_FRAME, MaxErrors: 1}, isFailed: true, badRegions: 1, decodeErrors: 2, totalBytes: 13},
+	}
+	for _, testCase := range testCases {
+		summary, err := formatBinaryXml(fileName, true, testCase.recovery)
+		if (err != nil) != testCase.isFailed {
+			test.Errorf("%+v: err %v", testCase.recovery, err)
+		}
+		if summary.BadRegions != testCase.badRegions || summary.DecodeErrors != testCase.decodeErrors || summary.TotalBytes != testCase.totalBytes {
+			test.Errorf("%+v: %d bad regions, %d decode errors, %d bytes; want %d, %d, %d", testCase.recovery,
+				summary.BadRegions, summary.DecodeErrors, summary.TotalBytes, testCase.badRegions, testCase.decodeErrors, testCase.totalBytes)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package decoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docktermj/go-proxy-tee/common/decode"
+	"github.com/docktermj/go-proxy-tee/common/framing"
+	"github.com/docopt/docopt-go"
+)
+
+const (
+	BUFFER_LENGTH = 1024 * 64
+	PROMPT        = "decode> "
+)
+
+// Function for the "command pattern".
+func Command(argv []string) {
+
+	usage := `
+Usage:
+    go-proxy-tee decode --repl
+    go-proxy-tee decode <hex>
+
+Options:
+   -h, --help
+   --repl      Decode each line of standard input until end-of-file
+
+Where:
+   hex   binaryXML bytes in hex, e.g. from a 'hex' capture.  Spaces are ignored.
+
+A line that is not hex is decoded as its raw bytes.
+Input beginning with a binaryXML frame start byte (0x79) is read as a frame; otherwise as a binaryXML message.
+In --repl mode, input that does not decode prints an error and the loop continues.
+`
+
+	// DocOpt processing.
+
+	args, _ := docopt.Parse(usage, nil, true, "", false)
+
+	if !args["--repl"].(bool) {
+		xml, err := decodeLine(args["<hex>"].(string))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %+v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(xml)
+		return
+	}
+	repl(os.Stdin, os.Stdout, os.Stderr)
+}
+
+// Decode lines from 'input' until end-of-file.  XML goes to 'output'; prompts and errors go to 'errors'.
+func repl(input io.Reader, output io.Writer, errors io.Writer) {
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, BUFFER_LENGTH), framing.BINARY_XML_MAX_FRAME_LENGTH*2)
+	fmt.Fprint(errors, PROMPT)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			xml, err := decodeLine(line)
+			if err != nil {
+				fmt.Fprintf(errors, "error: %+v\n", err)
+			} else {
+				fmt.Fprintln(output, xml)
+			}
+		}
+		fmt.Fprint(errors, PROMPT)
+	}
+	fmt.Fprintln(errors)
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(errors, "error: reading input failed: %+v\n", err)
+	}
+}
+
+// Decode a line of hex, or of raw bytes if it is not hex, to indented XML.
+func decodeLine(line string) (string, error) {
+	message, err := hex.DecodeString(strings.Join(strings.Fields(line), ""))
+	if err != nil {
+		message = []byte(line)
+	}
+	ctx := context.Background()
+	xmlBuffer := message
+	if len(message) > 0 && message[0] == framing.BINARY_XML_START {
+		var param uint8
+		xmlBuffer = make([]byte, 4096)
+		if err := decode.ReadMessage(ctx, decode.DEFAULT_TIMEOUT, bytes.NewReader(message), &param, &xmlBuffer); err != nil {
+			return "", fmt.Errorf("binaryxml.ReadMessage() failed: %v", err)
+		}
+	}
+	xmlString, err := decode.ToXML(ctx, decode.DEFAULT_TIMEOUT, xmlBuffer)
+	if err != nil {
+		return "", fmt.Errorf("binaryxml.ToXML() failed: %v", err)
+	}
+	formattedXml, err := decode.Indent([]byte(xmlString))
+	if err != nil {
+		return xmlString, nil
+	}
+	return string(formattedXml), nil
+}
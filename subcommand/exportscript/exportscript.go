@@ -0,0 +1,169 @@
+package exportscript
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docktermj/go-proxy-tee/common/script"
+	proxy "github.com/docktermj/go-proxy-tee/subcommand/net"
+	"github.com/docopt/docopt-go"
+)
+
+// A message of the capture, with its parsed time.
+type Record struct {
+	record proxy.JsonRecord
+	when   time.Time
+}
+
+// Function for the "command pattern".
+func Command(argv []string) {
+
+	usage := `
+Usage:
+    go-proxy-tee export-script [options] <file>...
+
+Options:
+   -h, --help
+   --connection=<id>  Connection to export. Default: the first in the capture.
+   --tee=<id>         Tee whose responses are exported. [default: outbound]
+   --out=<file>       File to write the script to. Default: standard output.
+
+Where:
+   file      'go-proxy-tee net --format=json' output, e.g. the outbound file, which has both directions.
+
+Writes the requests and responses of one connection as a script for 'go-proxy-tee replay --script':
+one line per message, "<request|response> <delay> <hex payload>", where 'delay' is the time since the
+previous message.  Messages of the files are ordered by time; a message in more than one file is exported once.  Injected preambles and greetings are not exported,
+as the proxy injects them again.  Payloads are as captured: after redaction, if it was configured.
+`
+
+	// DocOpt processing.
+
+	args, _ := docopt.Parse(usage, nil, true, "", false)
+	teeId := args["--tee"].(string)
+	connectionId := uint64(0)
+	isConnectionGiven := false
+	if value, ok := args["--connection"].(string); ok {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			log.Fatalf("Bad --connection '%s'. Err: %+v\n", value, err)
+		}
+		connectionId = parsed
+		isConnectionGiven = true
+	}
+
+	records := []Record{}
+	for _, inputFileName := range args["<file>"].([]string) {
+		fileRecords, err := readRecords(inputFileName)
+		if err != nil {
+			log.Fatalf("Reading %s failed. Err: %+v\n", inputFileName, err)
+		}
+		records = append(records, fileRecords...)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].when.Before(records[j].when) })
+	if !isConnectionGiven && len(records) > 0 {
+		connectionId = records[0].record.ConnectionId
+	}
+
+	writer := io.Writer(os.Stdout)
+	if outputFileName, ok := args["--out"].(string); ok {
+		outputFile, err := os.Create(outputFileName)
+		if err != nil {
+			log.Fatalf("Creating %s failed. Err: %+v\n", outputFileName, err)
+		}
+		defer outputFile.Close()
+		writer = outputFile
+	}
+	buffered := bufio.NewWriter(writer)
+	defer buffered.Flush()
+
+	lines, skipped := export(records, connectionId, teeId)
+	if len(lines) == 0 {
+		log.Fatalf("No messages of connection %d, tee '%s', were found.\n", connectionId, teeId)
+	}
+	fmt.Fprintf(buffered, "%s\n# connection %d, responses of tee '%s'\n", script.HEADER, connectionId, teeId)
+	for _, line := range lines {
+		fmt.Fprintln(buffered, line)
+	}
+	if len(skipped) > 0 {
+		log.Printf("Exported connection %d. Skipped connections: %s\n", connectionId, strings.Join(skipped, ", "))
+	}
+}
+
+// Read the messages of a "json" capture.  Lines that are not messages, such as markers, are kept and skipped by export().
+func readRecords(inputFileName string) ([]Record, error) {
+	inputFile, err := os.Open(inputFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer inputFile.Close()
+	result := []Record{}
+	scanner := bufio.NewScanner(inputFile)
+	scanner.Buffer(make([]byte, 1024*64), 1024*1024*64)
+	number := 0
+	for scanner.Scan() {
+		number++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		record := proxy.JsonRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d is not a 'json' format record: %v", number, err)
+		}
+		when, err := time.Parse(time.RFC3339Nano, record.Time)
+		if err != nil {
+			return nil, fmt.Errorf("line %d has a bad time '%s': %v", number, record.Time, err)
+		}
+		result = append(result, Record{record: record, when: when})
+	}
+	return result, scanner.Err()
+}
+
+// The script lines of connection 'connectionId': its requests, and the responses of tee 'teeId', in time order.
+// Also returns the ids of the other connections, which are not exported.
+func export(records []Record, connectionId uint64, teeId string) ([]script.Line, []string) {
+	lines := []script.Line{}
+	skipped := []string{}
+	isSkipped := map[uint64]bool{}
+	isExported := map[string]bool{}
+	var previous time.Time
+	for _, record := range records {
+		if record.record.ConnectionId != connectionId {
+			if !isSkipped[record.record.ConnectionId] {
+				isSkipped[record.record.ConnectionId] = true
+				skipped = append(skipped, strconv.FormatUint(record.record.ConnectionId, 10))
+			}
+			continue
+		}
+		if strings.HasPrefix(record.record.Title, "Injected") {
+			continue
+		}
+		direction := record.record.Direction
+		switch {
+		case direction == script.DIRECTION_REQUEST:
+		case direction == script.DIRECTION_RESPONSE && record.record.Tee == teeId:
+		default:
+			continue
+		}
+		key := fmt.Sprintf("%s %s %d %s %x", direction, record.record.Tee, record.record.CorrId, record.record.Time, record.record.Data)
+		if isExported[key] {
+			continue
+		}
+		isExported[key] = true
+		delay := time.Duration(0)
+		if !previous.IsZero() && record.when.After(previous) {
+			delay = record.when.Sub(previous)
+		}
+		previous = record.when
+		lines = append(lines, script.Line{Delay: delay, Direction: direction, Payload: record.record.Data})
+	}
+	return lines, skipped
+}
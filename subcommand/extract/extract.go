@@ -0,0 +1,220 @@
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/docktermj/go-proxy-tee/common/decode"
+	"github.com/docktermj/go-proxy-tee/common/framing"
+	"github.com/docopt/docopt-go"
+)
+
+const (
+	BUFFER_LENGTH = 1024 * 64
+)
+
+// Function for the "command pattern".
+func Command(argv []string) {
+
+	usage := `
+Usage:
+    go-proxy-tee extract [options] <file>
+
+Options:
+   -h, --help
+   --offset=<offset>   Byte offset of the region, decimal or hex (e.g. 0x4A00). [default: 0]
+   --length=<length>   Bytes in the region. [default: 4096]
+   --window=<bytes>    How far before --offset to look for the frame containing it. [default: 65536]
+   --compact           Write each frame's XML on one line, without indentation
+   --quiet             Suppress informational output; errors are still logged
+
+Where:
+   file   A 'go-proxy-tee net --format=binaryfile' capture.
+
+Decodes the binaryXML frames of one region of <file>, without decoding the rest.
+--offset may fall inside a frame, so the region is first resynchronized to a frame boundary:
+the start of the frame containing --offset, or else of the first frame after it.
+The boundary chosen is logged.  Each frame that starts in the region is printed as XML,
+and bytes between frames as hex.
+`
+
+	// DocOpt processing.
+
+	args, _ := docopt.Parse(usage, nil, true, "", false)
+	inputFileName := args["<file>"].(string)
+	offset, err := strconv.ParseInt(args["--offset"].(string), 0, 64)
+	if err != nil || offset < 0 {
+		log.Fatalf("Bad --offset '%s'. Err: %+v\n", args["--offset"].(string), err)
+	}
+	length, err := strconv.ParseInt(args["--length"].(string), 0, 64)
+	if err != nil || length <= 0 {
+		log.Fatalf("Bad --length '%s'. Err: %+v\n", args["--length"].(string), err)
+	}
+	window, err := strconv.ParseInt(args["--window"].(string), 0, 64)
+	if err != nil || window < 0 {
+		log.Fatalf("Bad --window '%s'. Err: %+v\n", args["--window"].(string), err)
+	}
+
+	if err := extract(inputFileName, offset, length, window, os.Stdout, args["--compact"].(bool), args["--quiet"].(bool)); err != nil {
+		log.Fatalf("Extracting from %s failed. Err: %+v\n", inputFileName, err)
+	}
+}
+
+// Print the frames of 'length' bytes of 'inputFileName' from 'offset', after resynchronizing to a frame boundary.
+// With 'isCompact', each frame's XML is one line.
+func extract(inputFileName string, offset int64, length int64, window int64, outputFile io.Writer, isCompact bool, isQuiet bool) error {
+	inputFile, err := os.Open(inputFileName)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+	info, err := inputFile.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if offset >= size {
+		return fmt.Errorf("offset %d is past the end of the file, %d bytes", offset, size)
+	}
+	end := offset + length
+	if end > size {
+		end = size
+	}
+
+	boundary, ok := resync(inputFile, size, offset, end, window)
+	if !ok {
+		log.Printf("No frame found from offset %d (0x%x) to %d (0x%x). Writing the region as hex.\n", offset, offset, end, end)
+		region := make([]byte, end-offset)
+		if _, err := inputFile.ReadAt(region, offset); err != nil && err != io.EOF {
+			return err
+		}
+		_, err := io.WriteString(outputFile, hex.Dump(region))
+		return err
+	}
+	if !isQuiet {
+		switch {
+		case boundary == offset:
+			log.Printf("Offset %d (0x%x) is a frame boundary.\n", offset, offset)
+		case boundary < offset:
+			log.Printf("Resynchronized offset %d (0x%x) to the frame containing it, at offset %d (0x%x), %d bytes before.\n", offset, offset, boundary, boundary, offset-boundary)
+		default:
+			log.Printf("Resynchronized offset %d (0x%x) to the next frame, at offset %d (0x%x), %d bytes after.\n", offset, offset, boundary, boundary, boundary-offset)
+		}
+	}
+
+	// Print frames until one starts past the region.  Bytes that are not in a frame are gathered and printed as hex.
+
+	position := boundary
+	unframed := []byte{}
+	unframedOffset := position
+	writeUnframed := func() error {
+		if len(unframed) == 0 {
+			return nil
+		}
+		_, err := fmt.Fprintf(outputFile, "# %d bytes outside frames at offset %d (0x%x)\n%s\n", len(unframed), unframedOffset, unframedOffset, hex.Dump(unframed))
+		unframed = []byte{}
+		return err
+	}
+	for position < end {
+		frame := frameAt(inputFile, size, position)
+		if frame == nil {
+			if len(unframed) == 0 {
+				unframedOffset = position
+			}
+			token := make([]byte, 1)
+			if _, err := inputFile.ReadAt(token, position); err != nil {
+				return err
+			}
+			unframed = append(unframed, token[0])
+			position++
+			continue
+		}
+		if err := writeUnframed(); err != nil {
+			return err
+		}
+		if err := writeFrame(outputFile, position, frame, isCompact); err != nil {
+			return err
+		}
+		position += int64(len(frame))
+	}
+	return writeUnframed()
+}
+
+// Find the frame boundary for 'offset': the start of the frame containing it, or else of the first frame
+// that starts before 'end'.  Frames are looked for from 'window' bytes before 'offset'.
+// Once a frame is found, the frames following it are walked by their lengths, so that bytes inside a frame
+// are not mistaken for the start of one.
+func resync(inputFile *os.File, size int64, offset int64, end int64, window int64) (int64, bool) {
+	start := offset - window
+	if start < 0 {
+		start = 0
+	}
+	region := make([]byte, end-start)
+	if _, err := inputFile.ReadAt(region, start); err != nil && err != io.EOF {
+		return 0, false
+	}
+	position := start
+	for position < end {
+		if region[position-start] != framing.BINARY_XML_START {
+			position++
+			continue
+		}
+		frame := frameAt(inputFile, size, position)
+		if frame == nil {
+			position++
+			continue
+		}
+		if position+int64(len(frame)) > offset {
+			return position, true
+		}
+		position += int64(len(frame))
+	}
+	return 0, false
+}
+
+// The frame starting at 'offset', or nil if there is none.  Its framing must read as a binaryXML message.
+func frameAt(inputFile *os.File, size int64, offset int64) []byte {
+	reader := bufio.NewReaderSize(io.NewSectionReader(inputFile, offset, size-offset), BUFFER_LENGTH)
+	token, err := reader.Peek(1)
+	if err != nil || token[0] != framing.BINARY_XML_START {
+		return nil
+	}
+	frame, _ := framing.Peek(reader)
+	if frame == nil {
+		return nil
+	}
+	var param uint8
+	xmlBuffer := make([]byte, 4096)
+	if err := decode.ReadMessage(context.Background(), decode.DEFAULT_TIMEOUT, bytes.NewReader(frame), &param, &xmlBuffer); err != nil {
+		return nil
+	}
+	return frame
+}
+
+// Print a frame's XML.  A frame whose XML does not decode is printed as hex.
+func writeFrame(outputFile io.Writer, offset int64, frame []byte, isCompact bool) error {
+	ctx := context.Background()
+	var param uint8
+	xmlBuffer := make([]byte, 4096)
+	if err := decode.ReadMessage(ctx, decode.DEFAULT_TIMEOUT, bytes.NewReader(frame), &param, &xmlBuffer); err != nil {
+		return err
+	}
+	xmlString, err := decode.ToXML(ctx, decode.DEFAULT_TIMEOUT, xmlBuffer)
+	if err != nil {
+		_, err = fmt.Fprintf(outputFile, "# %d byte frame at offset %d (0x%x) does not decode: %s\n%s\n", len(frame), offset, offset, err, hex.Dump(frame))
+		return err
+	}
+	formattedXml, err := decode.Format([]byte(xmlString), isCompact)
+	if err != nil {
+		formattedXml = []byte(xmlString)
+	}
+	_, err = fmt.Fprintf(outputFile, "# %d byte frame at offset %d (0x%x)\n%s\n\n", len(frame), offset, offset, formattedXml)
+	return err
+}
@@ -0,0 +1,32 @@
+package formats
+
+import (
+	"fmt"
+
+	"github.com/docktermj/go-proxy-tee/subcommand/net"
+	"github.com/docopt/docopt-go"
+)
+
+// Function for the "command pattern".
+func Command(argv []string) {
+
+	usage := `
+Usage:
+    go-proxy-tee formats [options]
+
+Options:
+   -h, --help
+
+Prints the values accepted by 'go-proxy-tee net --format', one per line.
+`
+
+	// DocOpt processing.
+
+	docopt.Parse(usage, nil, true, "", false)
+
+	// List formats.
+
+	for _, format := range net.Formats {
+		fmt.Println(format)
+	}
+}
@@ -0,0 +1,81 @@
+package initconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/docopt/docopt-go"
+)
+
+// Name of the file that "go-proxy-tee net" looks for.
+const CONFIG_FILE_NAME = "go-proxy-tee.json"
+
+// Starter configuration.  JSON has no comments, so "_comment" keys explain the settings; they are ignored.
+const STARTER_CONFIG = `{
+	"_comment": "Starter configuration for 'go-proxy-tee net'. See README.md for all keys.",
+	"format": "string",
+	"_comment_format": "One of the values listed by 'go-proxy-tee formats'.",
+	"inbound": {
+		"_comment": "Clients connect here.",
+		"network": "tcp",
+		"address": "127.0.0.1:11112",
+		"output": "/tmp/go-proxy-tee-client.txt"
+	},
+	"outbound": {
+		"_comment": "The primary server. Its responses are returned to the client.",
+		"network": "tcp",
+		"address": "127.0.0.1:11113",
+		"output": "/tmp/go-proxy-tee-server-1.txt"
+	},
+	"tee": [
+		{
+			"_comment": "An additional server. It receives a copy of client requests; its responses are only logged.",
+			"name": "server-2",
+			"network": "tcp",
+			"address": "127.0.0.1:11114",
+			"output": "/tmp/go-proxy-tee-server-2.txt"
+		}
+	]
+}
+`
+
+// Function for the "command pattern".
+func Command(argv []string) {
+
+	usage := `
+Usage:
+    go-proxy-tee init [options]
+
+Options:
+   -h, --help
+   --out=<path>   File or directory to write. [default: .]
+   --force        Overwrite an existing file.
+
+Writes an example go-proxy-tee.json for 'go-proxy-tee net'.
+`
+
+	// DocOpt processing.
+
+	args, _ := docopt.Parse(usage, nil, true, "", false)
+
+	// A directory gets the default file name.
+
+	fileName := args["--out"].(string)
+	if info, err := os.Stat(fileName); err == nil && info.IsDir() {
+		fileName = filepath.Join(fileName, CONFIG_FILE_NAME)
+	}
+
+	// Refuse to overwrite unless forced.
+
+	if _, err := os.Stat(fileName); err == nil && !args["--force"].(bool) {
+		log.Fatalf("%s already exists. Use --force to overwrite it.\n", fileName)
+	}
+
+	if err := ioutil.WriteFile(fileName, []byte(STARTER_CONFIG), 0644); err != nil {
+		log.Fatalf("Writing %s failed. Err: %+v\n", fileName, err)
+	}
+	fmt.Printf("Wrote %s\n", fileName)
+}
@@ -0,0 +1,55 @@
+package net
+
+import (
+	"context"
+	"log"
+
+	"github.com/spf13/viper"
+)
+
+// Smallest fraction of printable bytes for "auto" format to choose "string".
+const AUTO_PRINTABLE_RATIO = 0.9
+
+// Choose "string" or "hexparsed" for the first bytes of a connection.
+// Text is mostly printable ASCII.  BinaryXML frames are not, because of their length fields.
+func detectFormat(message []byte) string {
+	if len(message) == 0 {
+		return FORMAT_STRING
+	}
+	printable := 0
+	for _, value := range message {
+		if (value >= 0x20 && value < 0x7f) || value == '\t' || value == '\n' || value == '\r' {
+			printable++
+		}
+	}
+	if float64(printable) < AUTO_PRINTABLE_RATIO*float64(len(message)) {
+		return FORMAT_HEX_PARSED
+	}
+	return FORMAT_STRING
+}
+
+// Format for logging a message read in 'direction'.
+// For "auto" format, the first message read in either direction fixes the format for the rest of the connection.
+func connectionFormat(ctx context.Context, direction string, message []byte) string {
+	format := directionFormat(direction)
+	if format != FORMAT_AUTO {
+		return format
+	}
+	return getSession(ctx).autoFormat(message)
+}
+
+// The connection's detected format, detecting it from 'message' if this is the first message.
+func (session *Session) autoFormat(message []byte) string {
+	if session == nil {
+		return detectFormat(message)
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.format == "" {
+		session.format = detectFormat(message)
+		if !viper.GetBool("quiet") {
+			log.Printf("Detected format '%s' for connection\n", session.format)
+		}
+	}
+	return session.format
+}
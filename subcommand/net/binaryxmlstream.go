@@ -0,0 +1,61 @@
+package net
+
+import (
+	"log"
+
+	"github.com/spf13/viper"
+)
+
+const (
+
+	// Default of "framing.maxbuffer".
+
+	BINARY_XML_MAX_BUFFERED_DEFAULT = 1024 * 1024 * 16
+)
+
+// Largest incomplete binaryXML frame buffered by the "binaryxml" format, per direction of a connection,
+// from "framing.maxbuffer".  A frame whose length prefix claims more is not buffered.
+func binaryxmlMaxBuffer() int {
+	if !viper.IsSet("framing.maxbuffer") {
+		return BINARY_XML_MAX_BUFFERED_DEFAULT
+	}
+	value := viper.GetInt("framing.maxbuffer")
+	if value <= 0 {
+		log.Printf("Bad framing.maxbuffer '%s'. Using %d.\n", viper.GetString("framing.maxbuffer"), BINARY_XML_MAX_BUFFERED_DEFAULT)
+		return BINARY_XML_MAX_BUFFERED_DEFAULT
+	}
+	return value
+}
+
+// Length of the frame starting at 'data', as claimed by its length prefix.  Returns false if 'data' is too short to hold the prefix.
+func binaryxmlFrameLength(data []byte) (int, bool) {
+	if len(data) < BINARY_XML_LENGTH_BEGIN_TOKEN+BINARY_XML_LENGTH_LENGTH {
+		return 0, false
+	}
+	byteOrder, _ := binaryXmlByteOrder() // Validated by Command().
+	messageLength := byteOrder.Uint32(data[BINARY_XML_LENGTH_BEGIN_TOKEN:])
+	return int(messageLength) + BINARY_XML_LENGTHS, true
+}
+
+// Remove and return the start of a frame that the stream expected at 'offset' in 'direction' from 'teeId' completes.
+func (session *Session) takeBinaryxmlPending(direction string, teeId string, offset int) []byte {
+	if session == nil {
+		return nil
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	key := streamKey{direction: direction, offset: offset, teeId: teeId}
+	pending := session.binaryxml[key]
+	delete(session.binaryxml, key)
+	return pending
+}
+
+// Record the start of a frame, expected to continue at 'offset' in 'direction' from 'teeId'.
+func (session *Session) putBinaryxmlPending(direction string, teeId string, offset int, pending []byte) {
+	if session == nil {
+		return
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.binaryxml[streamKey{direction: direction, offset: offset, teeId: teeId}] = pending
+}
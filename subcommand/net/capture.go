@@ -0,0 +1,172 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Most bytes of output held for a connection whose traffic has not matched "capture.trigger".
+// Beyond this, the earliest held writes are dropped.
+const CAPTURE_HOLD_MAXIMUM = 1024 * 1024 * 16
+
+// Connections recorded only once their traffic matches "capture.trigger".
+// After "capture.stopafter" connections match, no more are accepted.
+type Capture struct {
+	lock      sync.Mutex
+	match     func(message []byte) bool
+	matched   int
+	stop      func()
+	stopAfter int
+}
+
+// Capture built from "capture.trigger".  If nil, every connection is recorded.
+var capture *Capture
+
+// Read "capture.trigger.contains" or "capture.trigger.regex", and "capture.stopafter".
+// 'stop' closes the listener.  Returns nil if there is no trigger.
+func loadCapture(stop func()) (*Capture, error) {
+	contains := viper.GetString("capture.trigger.contains")
+	pattern := viper.GetString("capture.trigger.regex")
+	stopAfter := viper.GetInt("capture.stopafter")
+	if contains == "" && pattern == "" {
+		if stopAfter != 0 {
+			return nil, fmt.Errorf("capture.stopafter requires capture.trigger")
+		}
+		return nil, nil
+	}
+	if contains != "" && pattern != "" {
+		return nil, fmt.Errorf("capture.trigger may have 'contains' or 'regex', not both")
+	}
+	if stopAfter < 0 {
+		return nil, fmt.Errorf("capture.stopafter %d is negative", stopAfter)
+	}
+	if stopAfter == 0 {
+		stopAfter = 1
+	}
+	result := &Capture{
+		stop:      stop,
+		stopAfter: stopAfter,
+	}
+	if contains != "" {
+		literal := []byte(contains)
+		result.match = func(message []byte) bool {
+			return bytes.Contains(message, literal)
+		}
+	} else {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("capture.trigger.regex '%s' failed. Err: %+v", pattern, err)
+		}
+		result.match = compiled.Match
+	}
+	return result, nil
+}
+
+// Count a matching connection, and stop accepting once "capture.stopafter" have matched.
+func (capture *Capture) add() {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	capture.matched++
+	if !viper.GetBool("quiet") {
+		log.Printf("capture.trigger matched connection %d of %d.\n", capture.matched, capture.stopAfter)
+	}
+	if capture.matched == capture.stopAfter {
+		log.Printf("capture.stopafter reached: no longer accepting connections.\n")
+		capture.stop()
+	}
+}
+
+// Whether "capture.stopafter" connections have matched.
+func (capture *Capture) isStopped() bool {
+	if capture == nil {
+		return false
+	}
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	return capture.matched >= capture.stopAfter
+}
+
+// The writes of one connection, held until its traffic matches "capture.trigger".
+// If the connection ends first, they are discarded.
+type Trigger struct {
+	capture   *Capture
+	held      []heldWrite
+	heldBytes int
+	isMatched bool
+	lock      sync.Mutex
+}
+
+type heldWrite struct {
+	data []byte
+	file *OutputFile
+}
+
+type triggerKey struct{}
+
+// A Trigger for a new connection, or nil if every connection is recorded.
+func (capture *Capture) newTrigger() *Trigger {
+	if capture == nil {
+		return nil
+	}
+	return &Trigger{capture: capture}
+}
+
+// Attach a Trigger to a "per-connection" context.  Files opened with the context are held by it.
+func withTrigger(ctx context.Context, trigger *Trigger) context.Context {
+	if trigger == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, triggerKey{}, trigger)
+}
+
+// The Trigger of a "per-connection" context, or nil.
+func getTrigger(ctx context.Context) *Trigger {
+	trigger, _ := ctx.Value(triggerKey{}).(*Trigger)
+	return trigger
+}
+
+// Check a message, in either direction, against "capture.trigger".
+// On the first match, the held writes are written, in order, and later writes go straight to the files.
+func (trigger *Trigger) check(message []byte) {
+	if trigger == nil {
+		return
+	}
+	trigger.lock.Lock()
+	defer trigger.lock.Unlock()
+	if trigger.isMatched || !trigger.capture.match(message) {
+		return
+	}
+	trigger.isMatched = true
+	for _, held := range trigger.held {
+		if _, err := held.file.write(held.data); err != nil {
+			log.Printf("Writing held output to %s failed. Err: %+v\n", held.file.Name(), err)
+		}
+	}
+	trigger.held = nil
+	trigger.capture.add()
+}
+
+// Hold a write to 'file' if the connection has not matched.  Returns false if the write should be made.
+func (trigger *Trigger) hold(file *OutputFile, data []byte) bool {
+	if trigger == nil {
+		return false
+	}
+	trigger.lock.Lock()
+	defer trigger.lock.Unlock()
+	if trigger.isMatched {
+		return false
+	}
+	trigger.held = append(trigger.held, heldWrite{data: append([]byte{}, data...), file: file})
+	trigger.heldBytes += len(data)
+	for trigger.heldBytes > CAPTURE_HOLD_MAXIMUM && len(trigger.held) > 1 {
+		trigger.heldBytes -= len(trigger.held[0].data)
+		trigger.held = trigger.held[1:]
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Blocks waiting to be written to the combined log.  When full, senders wait.
+const COMBINED_QUEUE_LENGTH = 1024
+
+// A single log of every block, from all directions and tees, in the order they were logged.
+// Each block is prefixed by a sequence number and the id of the tee (or "inbound") that logged it.
+type Combined struct {
+	done     chan struct{}
+	file     *OutputFile
+	lock     sync.Mutex
+	records  chan string
+	sequence uint64
+	stopping chan struct{}
+}
+
+// Combined log built from "capture.combined".  If nil, no combined log is written.
+var combined *Combined
+
+// Open "capture.combined" and start writing blocks to it.
+func startCombined(ctx context.Context) *Combined {
+	fileName := viper.GetString("capture.combined")
+	if fileName == "" {
+		return nil
+	}
+	result := &Combined{
+		done:     make(chan struct{}),
+		file:     openFile(ctx, fileName),
+		records:  make(chan string, COMBINED_QUEUE_LENGTH),
+		stopping: make(chan struct{}),
+	}
+	writeBanner(ctx, result.file)
+	go result.run()
+	return result
+}
+
+// Queue a block.  The sequence number is assigned under the lock,
+// so blocks are queued, and written, in sequence order.
+func (combined *Combined) send(tee string, outline string) {
+	if combined == nil {
+		return
+	}
+	combined.lock.Lock()
+	defer combined.lock.Unlock()
+	combined.sequence++
+	select {
+	case combined.records <- fmt.Sprintf("%d %s %s", combined.sequence, tee, outline):
+	case <-combined.done:
+	}
+}
+
+// Write queued blocks until stopped, then write what remains in the queue.
+func (combined *Combined) run() {
+	defer close(combined.done)
+	for {
+		select {
+		case record := <-combined.records:
+			_, _ = combined.file.WriteString(record)
+		case <-combined.stopping:
+			for {
+				select {
+				case record := <-combined.records:
+					_, _ = combined.file.WriteString(record)
+				default:
+					combined.file.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Write the remaining blocks and close the file.  Later blocks are dropped.
+func (combined *Combined) stop() {
+	if combined == nil {
+		return
+	}
+	close(combined.stopping)
+	<-combined.done
+}
@@ -0,0 +1,224 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	COMPARE_MODE_BYTES = "bytes" // Compare the response streams byte by byte.
+	COMPARE_MODE_XML   = "xml"   // Compare the decoded XML of each binaryXML frame.
+
+	// Most bytes of each response shown for a byte difference.
+
+	COMPARE_DUMP_LENGTH = 256
+
+	// Most bytes held for one side while the other has not sent as much.  Beyond it, the sides are reset.
+
+	COMPARE_MAX_BUFFERED = 1024 * 1024 * 16
+)
+
+// Comparison of the primary server's responses with those of one tee, for a connection.
+// Responses are held until both servers have sent them, then compared.  Only the primary's are returned to the client.
+type Comparison struct {
+	compared [2]int // Bytes, or frames in COMPARE_MODE_XML, compared so far.
+	ended    [2]bool
+	file     *OutputFile
+	lock     sync.Mutex
+	mode     string
+	pending  [2][]byte
+	teeId    string
+}
+
+// Sides of a Comparison.
+const (
+	COMPARE_PRIMARY = 0
+	COMPARE_TEE     = 1
+)
+
+// Read "compare.tee", "compare.output", and "compare.mode".  Returns "" for the tee if responses are not compared.
+func loadCompare() (string, string, error) {
+	teeId := viper.GetString("compare.tee")
+	if teeId == "" {
+		return "", "", nil
+	}
+	if teeId == "outbound" {
+		return "", "", fmt.Errorf("compare.tee must name a tee other than the primary server")
+	}
+	if viper.GetString("compare.output") == "" {
+		return "", "", fmt.Errorf("compare.tee requires compare.output")
+	}
+	mode := strings.ToLower(viper.GetString("compare.mode"))
+	switch mode {
+	case "":
+		mode = COMPARE_MODE_BYTES
+	case COMPARE_MODE_BYTES, COMPARE_MODE_XML:
+	default:
+		return "", "", fmt.Errorf("compare.mode '%s' is not '%s' or '%s'", mode, COMPARE_MODE_BYTES, COMPARE_MODE_XML)
+	}
+	return teeId, mode, nil
+}
+
+// Start comparing the responses of the primary server and tee 'teeId' for a connection.
+func newComparison(ctx context.Context, teeId string, mode string) *Comparison {
+	return &Comparison{
+		file:  openFile(ctx, viper.GetString("compare.output")),
+		mode:  mode,
+		teeId: teeId,
+	}
+}
+
+// Side of the comparison 'tee' is on.
+func compareSide(tee Tee) int {
+	if tee.Id == "outbound" {
+		return COMPARE_PRIMARY
+	}
+	return COMPARE_TEE
+}
+
+// Add a response read from one side and compare what both sides have sent.
+func (comparison *Comparison) add(ctx context.Context, side int, message []byte) {
+	if comparison == nil {
+		return
+	}
+	comparison.lock.Lock()
+	defer comparison.lock.Unlock()
+	comparison.pending[side] = append(comparison.pending[side], message...)
+	if comparison.mode == COMPARE_MODE_XML {
+		comparison.compareFrames(ctx)
+	} else {
+		comparison.compareBytes()
+	}
+	comparison.limit()
+}
+
+// Drop what both sides hold if either holds more than COMPARE_MAX_BUFFERED bytes,
+// e.g. when one server is stalled or has stopped answering.  Must be called with 'comparison.lock' held.
+func (comparison *Comparison) limit() {
+	primary, tee := len(comparison.pending[COMPARE_PRIMARY]), len(comparison.pending[COMPARE_TEE])
+	if primary <= COMPARE_MAX_BUFFERED && tee <= COMPARE_MAX_BUFFERED {
+		return
+	}
+	comparison.write(fmt.Sprintf("Sides diverged: %d bytes unmatched, 'outbound' sent %d and '%s' sent %d. Comparing anew", primary+tee, primary, comparison.teeId, tee), "", "")
+	if comparison.mode == COMPARE_MODE_BYTES {
+		comparison.compared[COMPARE_PRIMARY] += primary
+		comparison.compared[COMPARE_TEE] += tee
+	}
+	comparison.pending[COMPARE_PRIMARY] = nil
+	comparison.pending[COMPARE_TEE] = nil
+}
+
+// Note that one side's responses have ended.  Once both have, anything left over is a difference.
+func (comparison *Comparison) end(side int) {
+	if comparison == nil {
+		return
+	}
+	comparison.lock.Lock()
+	defer comparison.lock.Unlock()
+	comparison.ended[side] = true
+	if !comparison.ended[COMPARE_PRIMARY] || !comparison.ended[COMPARE_TEE] {
+		return
+	}
+	primary, tee := len(comparison.pending[COMPARE_PRIMARY]), len(comparison.pending[COMPARE_TEE])
+	if primary != tee {
+		comparison.write(fmt.Sprintf("Lengths differ: 'outbound' sent %d more bytes, '%s' sent %d more bytes", primary, comparison.teeId, tee), "", "")
+	}
+}
+
+// Compare the bytes both sides have sent, then drop them.  Must be called with 'comparison.lock' held.
+func (comparison *Comparison) compareBytes() {
+	primary, tee := comparison.pending[COMPARE_PRIMARY], comparison.pending[COMPARE_TEE]
+	length := len(primary)
+	if len(tee) < length {
+		length = len(tee)
+	}
+	for index := 0; index < length; index++ {
+		if primary[index] != tee[index] {
+			end := length
+			if end > index+COMPARE_DUMP_LENGTH {
+				end = index + COMPARE_DUMP_LENGTH
+			}
+			offset := comparison.compared[COMPARE_PRIMARY] + index
+			comparison.write(fmt.Sprintf("Bytes differ at offset %d", offset),
+				hexDump(primary[index:end], hexWidth(), offset),
+				hexDump(tee[index:end], hexWidth(), offset))
+			break
+		}
+	}
+	comparison.compared[COMPARE_PRIMARY] += length
+	comparison.compared[COMPARE_TEE] += length
+	comparison.pending[COMPARE_PRIMARY] = primary[length:]
+	comparison.pending[COMPARE_TEE] = tee[length:]
+}
+
+// Compare the decoded XML of the complete frames both sides have sent, pairing frames in order.
+// Must be called with 'comparison.lock' held.
+func (comparison *Comparison) compareFrames(ctx context.Context) {
+	for {
+		primaryFrame := completeFrame(comparison.pending[COMPARE_PRIMARY])
+		teeFrame := completeFrame(comparison.pending[COMPARE_TEE])
+		if primaryFrame == nil || teeFrame == nil {
+			return
+		}
+		comparison.pending[COMPARE_PRIMARY] = comparison.pending[COMPARE_PRIMARY][len(primaryFrame):]
+		comparison.pending[COMPARE_TEE] = comparison.pending[COMPARE_TEE][len(teeFrame):]
+		frameNumber := comparison.compared[COMPARE_PRIMARY] + 1
+		comparison.compared[COMPARE_PRIMARY]++
+		comparison.compared[COMPARE_TEE]++
+		primaryXml := frameXml(ctx, primaryFrame)
+		teeXml := frameXml(ctx, teeFrame)
+		if primaryXml != teeXml {
+			comparison.write(fmt.Sprintf("XML of frame %d differs", frameNumber), primaryXml, teeXml)
+		}
+	}
+}
+
+// The complete binaryXML frame at the start of 'data', or nil if more bytes are needed.
+// Bytes before a frame start are returned alone, so they are compared as a frame that does not decode.
+func completeFrame(data []byte) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	start := bytes.IndexByte(data, BINARY_XML_START)
+	if start != 0 {
+		if start < 0 {
+			return data
+		}
+		return data[:start]
+	}
+	if len(data) < BINARY_XML_LENGTH_BEGIN_TOKEN+BINARY_XML_LENGTH_LENGTH {
+		return nil
+	}
+	frame := hexParseSplit(data)
+	byteOrder, _ := binaryXmlByteOrder() // Validated by Run().
+	messageLength := byteOrder.Uint32(data[BINARY_XML_LENGTH_BEGIN_TOKEN:])
+	if uint64(len(frame)) < uint64(messageLength)+BINARY_XML_LENGTHS {
+		return nil
+	}
+	return frame
+}
+
+// Indented XML of a frame, or a description of why it does not decode.
+func frameXml(ctx context.Context, frame []byte) string {
+	frames, isOk := decodeFrames(ctx, frame)
+	if !isOk || len(frames) == 0 {
+		return fmt.Sprintf("[does not decode]\n%s", hexDump(frame, hexWidth(), 0))
+	}
+	return frames[0].Xml
+}
+
+// Write a difference to the compare.output file and log it.
+func (comparison *Comparison) write(description string, primary string, tee string) {
+	log.Printf("Responses of 'outbound' and '%s' differ: %s\n", comparison.teeId, description)
+	block := horizontalRule(description)
+	if primary != "" || tee != "" {
+		block += fmt.Sprintf("\n--- outbound\n%s\n+++ %s\n%s", strings.TrimRight(primary, "\n"), comparison.teeId, strings.TrimRight(tee, "\n"))
+	}
+	_, _ = comparison.file.WriteString(block + blockSeparator())
+}
@@ -0,0 +1,174 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Values of "disk.policy": what to do when "disk.maxtotalbytes" is reached.
+const (
+	DISK_POLICY_STOP   = "stop"   // Stop logging.  Traffic is still proxied.
+	DISK_POLICY_DELETE = "delete" // Delete the oldest output files that are no longer written.  See measureDisk().
+)
+
+const (
+	DISK_INTERVAL_DEFAULT = time.Second * 5
+
+	// With "delete", files are deleted until the total is below this fraction of "disk.maxtotalbytes".
+	// Once stopped, logging resumes when the total is below it.
+
+	DISK_LOW_WATER = 0.9
+)
+
+// A cap on the total size of the output files.  Guarded by the lock of its FileCache.
+type DiskLimit struct {
+	isFull  bool
+	maximum int64
+	policy  string
+	total   int64 // Size of the output files at the last check, plus bytes written since.
+}
+
+// Read "disk.maxtotalbytes", "disk.policy", and "disk.interval", and start checking the output files' sizes.
+func startDiskLimit(ctx context.Context, cache *FileCache) error {
+	maximum := viper.GetInt64("disk.maxtotalbytes")
+	if maximum == 0 {
+		return nil
+	}
+	if maximum < 0 {
+		return fmt.Errorf("disk.maxtotalbytes %d is negative", maximum)
+	}
+	policy := strings.ToLower(viper.GetString("disk.policy"))
+	switch policy {
+	case "":
+		policy = DISK_POLICY_STOP
+	case DISK_POLICY_STOP, DISK_POLICY_DELETE:
+	default:
+		return fmt.Errorf("disk.policy '%s' is not '%s' or '%s'", policy, DISK_POLICY_STOP, DISK_POLICY_DELETE)
+	}
+	interval := DISK_INTERVAL_DEFAULT
+	if value := viper.GetString("disk.interval"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("bad disk.interval '%s'. Err: %+v", value, err)
+		}
+		interval = parsed
+	}
+	disk := &DiskLimit{
+		maximum: maximum,
+		policy:  policy,
+	}
+	cache.lock.Lock()
+	cache.disk = disk
+	cache.lock.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cache.checkDisk()
+			}
+		}
+	}()
+	return nil
+}
+
+// Whether 'length' more bytes may be written to the output files.  Must be called with 'cache.lock' held.
+// With "delete", files are deleted to make room.  Otherwise, or if no file can be deleted,
+// logging stops until a check finds room.
+func (cache *FileCache) allowWrite(length int) bool {
+	disk := cache.disk
+	if disk == nil {
+		return true
+	}
+	if !disk.isFull && disk.total+int64(length) <= disk.maximum {
+		disk.total += int64(length)
+		return true
+	}
+	if disk.isFull {
+		return false
+	}
+	if disk.policy == DISK_POLICY_DELETE {
+		cache.measureDisk(int64(length))
+		if disk.total+int64(length) <= disk.maximum {
+			disk.total += int64(length)
+			return true
+		}
+	}
+	disk.isFull = true
+	log.Printf("WARNING: Output files have reached disk.maxtotalbytes %d. Logging has stopped; traffic is still proxied.\n", disk.maximum)
+	return false
+}
+
+// Check the output files' sizes.  Logging resumes when they are below DISK_LOW_WATER of the cap,
+// e.g. after files are deleted, so it does not stop and start with each block.
+func (cache *FileCache) checkDisk() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	disk := cache.disk
+	cache.measureDisk(0)
+	if disk.isFull && disk.total < int64(float64(disk.maximum)*DISK_LOW_WATER) {
+		disk.isFull = false
+		log.Printf("Output files are below disk.maxtotalbytes %d. Logging has resumed.\n", disk.maximum)
+	}
+}
+
+// Sum the sizes of the output files.  With "delete", if 'needed' more bytes would pass the cap, delete the oldest files
+// no longer written: earlier time buckets, and the files of closed connections.
+// A file whose handle was closed, by "output.maxopenfiles" or SIGHUP, is still written if it is the current file
+// of an open OutputFile, so it is kept.  Must be called with 'cache.lock' held.
+func (cache *FileCache) measureDisk(needed int64) {
+	disk := cache.disk
+	type sizedFile struct {
+		modified time.Time
+		name     string
+		size     int64
+	}
+	files := []sizedFile{}
+	total := int64(0)
+	for name := range cache.files {
+		info, err := os.Stat(name)
+		if err != nil {
+			if _, isOpen := cache.elements[name]; !isOpen {
+				delete(cache.files, name) // Removed by another program.
+			}
+			continue
+		}
+		total += info.Size()
+		files = append(files, sizedFile{modified: info.ModTime(), name: name, size: info.Size()})
+	}
+	if disk.policy == DISK_POLICY_DELETE && total+needed > disk.maximum {
+		now := time.Now()
+		written := map[string]bool{}
+		for name := range cache.users {
+			written[cache.bucketName(name, now)] = true
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].modified.Before(files[j].modified) })
+		lowWater := int64(float64(disk.maximum) * DISK_LOW_WATER)
+		for _, file := range files {
+			if total+needed < lowWater {
+				break
+			}
+			if _, isOpen := cache.elements[file.name]; isOpen || written[file.name] {
+				continue
+			}
+			if err := os.Remove(file.name); err != nil {
+				log.Printf("os.Remove(%s) failed. Err: %+v\n", file.name, err)
+				continue
+			}
+			delete(cache.files, file.name)
+			total -= file.size
+			log.Printf("WARNING: Deleted %s, %d bytes, to stay within disk.maxtotalbytes %d.\n", file.name, file.size, disk.maximum)
+		}
+	}
+	disk.total = total
+}
@@ -0,0 +1,76 @@
+package net
+
+import (
+	"context"
+	"fmt"
+)
+
+// Formats messages for output files.
+// 'direction' is DIRECTION_REQUEST or DIRECTION_RESPONSE.  'teeId' is the id of the tee that sent a response,
+// or "inbound" for a client request.  'streamOffset' is the position of the message's first byte in that stream,
+// for formats that show offsets.
+type Encoder interface {
+	Encode(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error)
+}
+
+// A function used as an Encoder.
+type EncoderFunc func(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error)
+
+func (encoderFunc EncoderFunc) Encode(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error) {
+	return encoderFunc(ctx, direction, teeId, message, streamOffset)
+}
+
+// Encoders by format name.
+var encoders = map[string]Encoder{}
+
+// Acceptable output file formats, in the order they were registered.
+// The single list used for validation and by the "formats" command.
+var Formats = []string{}
+
+// Make 'encoder' available as format 'name'.  Registering a name twice panics.
+func RegisterEncoder(name string, encoder Encoder) {
+	if _, ok := encoders[name]; ok {
+		panic(fmt.Sprintf("format '%s' is already registered", name))
+	}
+	encoders[name] = encoder
+	Formats = append(Formats, name)
+}
+
+func isFormat(format string) bool {
+	_, ok := encoders[format]
+	return ok
+}
+
+// Built-in formats.
+func init() {
+	RegisterEncoder(FORMAT_BINARY_FILE, EncoderFunc(func(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error) {
+		return nil, nil // The raw bytes are written instead.
+	}))
+	RegisterEncoder(FORMAT_BINARY_XML, EncoderFunc(func(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error) {
+		return []byte(binaryxmlParse(ctx, direction, teeId, message, streamOffset)), nil
+	}))
+	RegisterEncoder(FORMAT_HEX, EncoderFunc(func(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error) {
+		return []byte(hexDumpMessage(message, hexBaseOffset(streamOffset))), nil
+	}))
+	RegisterEncoder(FORMAT_HEX_PARSED, EncoderFunc(func(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error) {
+		return []byte(hexParse(message, streamOffset)), nil
+	}))
+	RegisterEncoder(FORMAT_JSON, EncoderFunc(func(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error) {
+		return message, nil // Written by jsonLine().
+	}))
+	RegisterEncoder(FORMAT_STRING, EncoderFunc(func(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error) {
+		return message, nil
+	}))
+	RegisterEncoder(FORMAT_HTTP, EncoderFunc(func(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error) {
+		return []byte(httpParse(ctx, direction, teeId, message, streamOffset)), nil
+	}))
+	RegisterEncoder(FORMAT_WEBSOCKET, EncoderFunc(func(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error) {
+		return []byte(websocketParse(ctx, direction, teeId, message, streamOffset)), nil
+	}))
+	RegisterEncoder(FORMAT_PROTOBUF_WIRE, EncoderFunc(func(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error) {
+		return []byte(protobufParse(ctx, direction, teeId, message, streamOffset)), nil
+	}))
+	RegisterEncoder(FORMAT_AUTO, EncoderFunc(func(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error) {
+		return encoders[detectFormat(message)].Encode(ctx, direction, teeId, message, streamOffset)
+	}))
+}
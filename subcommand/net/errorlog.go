@@ -0,0 +1,48 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// A file with a line per connection error, from "errors.output", apart from the general log and the captures.
+type ErrorLog struct {
+	file *OutputFile
+}
+
+// Error log opened from "errors.output".  If nil, errors are only logged.
+var errorLog *ErrorLog
+
+// Open "errors.output" for appending.
+func startErrorLog(ctx context.Context) *ErrorLog {
+	fileName := viper.GetString("errors.output")
+	if fileName == "" {
+		return nil
+	}
+	return &ErrorLog{
+		file: openFile(ctx, fileName),
+	}
+}
+
+// Log a read, write, connect, or accept error, and add it to the error log.
+// 'tee' is the tee id of the connection that failed: "inbound" for the client.
+func logError(ctx context.Context, tee string, format string, values ...interface{}) {
+	log.Printf(format, values...)
+	errorLog.add(ctx, tee, fmt.Sprintf(format, values...))
+}
+
+// Add a line: the time, the connection id of the session of 'ctx' (0 before a connection has one), the tee id, and 'text'.
+func (errorLog *ErrorLog) add(ctx context.Context, tee string, text string) {
+	if errorLog == nil {
+		return
+	}
+	line := fmt.Sprintf("%s connection=%d tee=%s %s\n", timestamp(time.Now()).Format(time.RFC3339Nano), getSession(ctx).id(), tee, strings.TrimSpace(text))
+	if _, err := errorLog.file.WriteString(line); err != nil {
+		log.Printf("Writing errors.output failed. Err: %+v\n", err)
+	}
+}
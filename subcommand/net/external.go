@@ -0,0 +1,40 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Decode a message with the external command in "decode.command".
+// The message is written to the command's standard input; its standard output is returned.
+// The command is split on spaces and run without a shell, limited by "decode.timeout".
+func externalDecode(ctx context.Context, command string, message []byte) (string, error) {
+	fields := strings.Fields(command)
+	if timeout := decodeTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, fields[0], fields[1:]...)
+	cmd.Stdin = bytes.NewReader(message)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if stderr.Len() > 0 {
+			log.Printf("decode.command stderr: %s\n", strings.TrimSpace(stderr.String()))
+		}
+		return "", err
+	}
+	return string(output), nil
+}
+
+// The "decode.command" configuration value, or "" for none.
+func decodeCommand() string {
+	return strings.TrimSpace(viper.GetString("decode.command"))
+}
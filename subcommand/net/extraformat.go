@@ -0,0 +1,135 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Formats after the first of a "format" list.  Each capture file has a file alongside it for each.
+var extraFormats = []string{}
+
+// A file written in one of 'extraFormats'.
+type ExtraFile struct {
+	file   *OutputFile
+	format string
+}
+
+// Read "format" as a list, e.g. ["hexparsed", "binaryfile"] or "hexparsed,binaryfile".
+// The first format is used for the output files, as "format" is.  The others are set in 'extraFormats'.
+// A single format keeps its former behavior: an unknown name is logged as "string".
+func loadFormats() error {
+	names := []string{}
+	switch value := viper.Get(FORMAT).(type) {
+	case []interface{}:
+		for _, name := range value {
+			names = append(names, fmt.Sprint(name))
+		}
+	case []string:
+		names = value
+	case string:
+		names = strings.Split(value, ",")
+	}
+	if len(names) < 2 {
+		return nil
+	}
+	formats := []string{}
+	isListed := map[string]bool{}
+	for _, name := range names {
+		format := strings.ToLower(strings.TrimSpace(name))
+		if !isFormat(format) {
+			return fmt.Errorf("format '%s' is not one of: %s", format, strings.Join(Formats, ", "))
+		}
+		if !isListed[format] {
+			isListed[format] = true
+			formats = append(formats, format)
+		}
+	}
+	viper.Set(FORMAT, formats[0])
+	extraFormats = formats[1:]
+	return nil
+}
+
+// Whether 'format' is one of 'extraFormats'.
+func isExtraFormat(format string) bool {
+	for _, extraFormat := range extraFormats {
+		if extraFormat == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Name of the file for 'format' alongside output file 'name': its extension is replaced,
+// e.g. "capture.txt" becomes "capture.hexparsed", or "capture.bin" for "binaryfile".
+func extraFileName(name string, format string) string {
+	extension := "." + format
+	if format == FORMAT_BINARY_FILE {
+		extension = ".bin"
+	}
+	result := strings.TrimSuffix(name, filepath.Ext(name)) + extension
+	if result == name {
+		return name + extension
+	}
+	return result
+}
+
+// Open the files of 'extraFormats' alongside a capture file.  Banners are suppressed as for the primary format.
+func openExtraFiles(ctx context.Context, file *OutputFile) {
+	for _, format := range extraFormats {
+		extra := openFile(ctx, extraFileName(file.Name(), format))
+		extra.isBinary = format == FORMAT_BINARY_FILE
+		if viper.GetBool("banner") && format != FORMAT_BINARY_FILE && format != FORMAT_JSON {
+			extra.cache.setBanner(extra.name, banner())
+			_, _ = extra.WriteString("") // Begins a new file with the banner.
+		}
+		file.extras = append(file.extras, ExtraFile{file: extra, format: format})
+	}
+}
+
+// Format a message in each of 'extraFormats', keyed by format.  "binaryfile" gets the message's bytes.
+// 'title' is the horizontal rule of a block; 'prefix', 'tee', and 'corrId' are used by "json".
+func extraOutlines(ctx context.Context, title string, prefix string, tee string, direction string, corrId uint64, readTime time.Time, message []byte, streamOffset int) map[string]string {
+	if len(extraFormats) == 0 {
+		return nil
+	}
+	result := map[string]string{}
+	for _, format := range extraFormats {
+		switch format {
+		case FORMAT_BINARY_FILE:
+			result[format] = string(message)
+		case FORMAT_JSON:
+			result[format] = jsonLine(ctx, readTime, prefix, tee, direction, corrId, message)
+		default:
+			encoding := format
+			if encoding == FORMAT_AUTO {
+				encoding = detectFormat(message)
+			}
+			outString := formatMessage(ctx, encoding, direction, tee, message, streamOffset)
+			if len(outString) > 0 {
+				result[format] = fmt.Sprintf("%s\n%s%s", title, outString, blockSeparator())
+			}
+		}
+	}
+	return result
+}
+
+// Write 'outlines' to the file's extra files: those of "binaryfile" if 'isBinary', otherwise the others.
+// As with the primary format, a direction's bytes go to the file recording it, and blocks of both directions to a tee's file.
+func (outputFile *OutputFile) writeExtras(outlines map[string]string, isBinary bool) {
+	if outputFile == nil {
+		return
+	}
+	for _, extra := range outputFile.extras {
+		if (extra.format == FORMAT_BINARY_FILE) != isBinary {
+			continue
+		}
+		if outline, ok := outlines[extra.format]; ok {
+			_, _ = extra.file.WriteString(outline)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package net
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// A network and address to connect to.
+type Endpoint struct {
+	Address string
+	Network string
+}
+
+// Read "outbound.failover": primary servers, "host:port" or "network://address", tried in order
+// when "outbound.address" cannot be reached.
+func loadFailover() ([]Endpoint, error) {
+	result := []Endpoint{}
+	for _, value := range viper.GetStringSlice("outbound.failover") {
+		network, address := parseNetworkAddress(value)
+		if !streamNetworks[network] {
+			return nil, fmt.Errorf("outbound.failover '%s' network '%s' is not supported. Values: tcp, tcp4, tcp6, unix, unixpacket", value, network)
+		}
+		if viper.GetString("outbound.httpproxy.address") != "" && !strings.HasPrefix(network, "tcp") {
+			return nil, fmt.Errorf("outbound httpproxy requires a 'tcp' network, not '%s' for outbound.failover '%s'", network, value)
+		}
+		result = append(result, Endpoint{Address: address, Network: network})
+	}
+	return result, nil
+}
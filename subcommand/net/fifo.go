@@ -0,0 +1,214 @@
+package net
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Values of "output.fifopolicy".
+const (
+	FIFO_POLICY_BUFFER = "buffer" // Keep output in memory until a reader opens the FIFO.
+	FIFO_POLICY_DROP   = "drop"   // Discard output while no reader has the FIFO open.
+)
+
+const (
+	FIFO_BUFFER_DEFAULT = 1024 * 1024 // Default of "output.fifobuffer".
+	FIFO_RETRY_INTERVAL = time.Second // How often opening a FIFO without a reader is retried.
+	FIFO_CLOSE_TIMEOUT  = time.Second // Longest wait at shutdown for a reader to take queued output.
+)
+
+// Configure output to named pipes from "output.fifopolicy" and "output.fifobuffer".
+func loadFifo(cache *FileCache) error {
+	policy := strings.ToLower(viper.GetString("output.fifopolicy"))
+	switch policy {
+	case "":
+		policy = FIFO_POLICY_BUFFER
+	case FIFO_POLICY_BUFFER, FIFO_POLICY_DROP:
+	default:
+		return fmt.Errorf("output.fifopolicy '%s' is not '%s' or '%s'", policy, FIFO_POLICY_BUFFER, FIFO_POLICY_DROP)
+	}
+	bufferSize := FIFO_BUFFER_DEFAULT
+	if viper.IsSet("output.fifobuffer") {
+		bufferSize = viper.GetInt("output.fifobuffer")
+		if bufferSize < 0 {
+			return fmt.Errorf("output.fifobuffer '%s' is not a number of bytes", viper.GetString("output.fifobuffer"))
+		}
+	}
+	cache.setFifoPolicy(policy, bufferSize)
+	return nil
+}
+
+// An output file that is an existing named pipe (FIFO), read by another process.
+// Writes are queued, and written to the FIFO by a goroutine of its own, so a slow or stalled reader
+// does not hold up the FileCache, and with it every other output file.
+// The FIFO is opened without blocking.  Until a reader has it open, and after the reader closes it,
+// output is buffered, up to 'bufferSize' bytes, or dropped, by 'policy', and opening is retried.
+// While a reader has it open, up to 'bufferSize' bytes wait for it; more are dropped until it catches up.
+// The write end stays open when the FileCache closes the handle, so the reader does not see end-of-file.
+type Fifo struct {
+	bufferSize  int
+	closing     chan struct{} // Closed by Close().
+	done        chan struct{} // Closed when the writer goroutine ends.
+	file        *os.File      // nil while no reader has the FIFO open.  Guarded by 'lock'; written outside it.
+	isClosed    bool
+	isDropping  bool // If true, output is being discarded; logged once until it is written again.
+	lastAttempt time.Time
+	lock        sync.Mutex
+	name        string
+	pending     []byte // Waiting to be written.
+	policy      string
+	ready       *sync.Cond // Signaled when 'pending' grows or the FIFO is closed.
+}
+
+// Start writing to the named pipe 'name'.
+func newFifo(name string, policy string, bufferSize int) *Fifo {
+	result := &Fifo{
+		bufferSize: bufferSize,
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+		name:       name,
+		policy:     policy,
+	}
+	result.ready = sync.NewCond(&result.lock)
+	go result.run()
+	return result
+}
+
+// Queue 'data' for the FIFO.  Never waits for the reader.
+func (fifo *Fifo) Write(data []byte) (int, error) {
+	fifo.lock.Lock()
+	defer fifo.lock.Unlock()
+	if fifo.isClosed {
+		return len(data), nil
+	}
+	fifo.keep(data)
+	fifo.ready.Signal()
+	return len(data), nil
+}
+
+// Add to 'pending', or drop, by 'policy' and 'bufferSize'.  Must be called with 'fifo.lock' held.
+// With a reader, a write is always queued if nothing else is, so a 'bufferSize' of 0 still passes output through.
+func (fifo *Fifo) keep(data []byte) {
+	isRead := fifo.file != nil
+	switch {
+	case isRead && len(fifo.pending) == 0:
+	case (isRead || fifo.policy == FIFO_POLICY_BUFFER) && len(fifo.pending)+len(data) <= fifo.bufferSize:
+	default:
+		if !fifo.isDropping {
+			fifo.isDropping = true
+			if isRead {
+				log.Printf("WARNING: The reader of FIFO %s is behind by %d bytes. Dropping output until it catches up.\n", fifo.name, len(fifo.pending))
+			} else {
+				log.Printf("WARNING: No reader has FIFO %s open. Dropping output until one does.\n", fifo.name)
+			}
+		}
+		return
+	}
+	fifo.pending = append(fifo.pending, data...)
+}
+
+// Write 'pending' to the FIFO as it is queued, opening the FIFO when a reader has it open.
+func (fifo *Fifo) run() {
+	defer close(fifo.done)
+	fifo.lock.Lock()
+	defer fifo.lock.Unlock()
+	for {
+		for len(fifo.pending) == 0 && !fifo.isClosed {
+			fifo.ready.Wait()
+		}
+		if len(fifo.pending) == 0 || (fifo.isClosed && fifo.file == nil) {
+			return
+		}
+		if fifo.file == nil && !fifo.open() {
+			wait := FIFO_RETRY_INTERVAL - time.Since(fifo.lastAttempt)
+			fifo.lock.Unlock()
+			select {
+			case <-time.After(wait):
+			case <-fifo.closing:
+			}
+			fifo.lock.Lock()
+			continue
+		}
+		file, data := fifo.file, fifo.pending
+		fifo.pending = nil
+		fifo.isDropping = false
+		fifo.lock.Unlock()
+		count, err := file.Write(data)
+		fifo.lock.Lock()
+		if err == nil {
+			continue
+		}
+		if fifo.isClosed {
+			fifo.pending = append(data[count:], fifo.pending...)
+			return
+		}
+		if isFifoClosed(err) {
+			log.Printf("The reader of FIFO %s closed it.\n", fifo.name)
+		} else {
+			log.Printf("Writing FIFO %s failed. Err: %+v\n", fifo.name, err)
+		}
+		fifo.file.Close()
+		fifo.file = nil
+		fifo.keep(data[count:])
+	}
+}
+
+// Open the FIFO for writing, if a reader has it open.  Must be called with 'fifo.lock' held.
+func (fifo *Fifo) open() bool {
+	if time.Since(fifo.lastAttempt) < FIFO_RETRY_INTERVAL {
+		return false
+	}
+	fifo.lastAttempt = time.Now()
+	file, err := os.OpenFile(fifo.name, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if !isFifoUnread(err) {
+			log.Printf("Opening FIFO %s failed. Err: %+v\n", fifo.name, err)
+		}
+		return false
+	}
+	log.Printf("A reader opened FIFO %s.\n", fifo.name)
+	fifo.file = file
+	fifo.isDropping = false
+	return true
+}
+
+// Close the write end, at shutdown.  Queued output is written for up to FIFO_CLOSE_TIMEOUT.
+func (fifo *Fifo) Close() error {
+	fifo.lock.Lock()
+	if fifo.isClosed {
+		fifo.lock.Unlock()
+		return nil
+	}
+	fifo.isClosed = true
+	close(fifo.closing)
+	fifo.ready.Signal()
+	if fifo.file != nil {
+		fifo.file.SetWriteDeadline(time.Now().Add(FIFO_CLOSE_TIMEOUT))
+	}
+	fifo.lock.Unlock()
+	<-fifo.done
+	fifo.lock.Lock()
+	defer fifo.lock.Unlock()
+	if len(fifo.pending) > 0 {
+		log.Printf("WARNING: %d bytes for FIFO %s were never read.\n", len(fifo.pending), fifo.name)
+	}
+	if fifo.file == nil {
+		return nil
+	}
+	err := fifo.file.Close()
+	fifo.file = nil
+	return err
+}
+
+// Whether 'name' is an existing named pipe.
+func isFifo(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
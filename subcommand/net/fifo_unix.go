@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package net
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Whether opening a FIFO failed because no reader has it open.
+func isFifoUnread(err error) bool {
+	return errors.Is(err, syscall.ENXIO)
+}
+
+// Whether writing to a FIFO failed because its reader closed it.
+func isFifoClosed(err error) bool {
+	return errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,67 @@
+//go:build !windows
+// +build !windows
+
+package net
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFifoReaderThatNeverReads(test *testing.T) {
+	directory := test.TempDir()
+	name := filepath.Join(directory, "capture.fifo")
+	if err := syscall.Mkfifo(name, 0600); err != nil {
+		test.Fatal(err)
+	}
+	reader, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer reader.Close()
+
+	cache := newFileCache(0)
+	fifo, err := cache.open(name)
+	if err != nil {
+		test.Fatal(err)
+	}
+	other, err := cache.open(filepath.Join(directory, "other.txt"))
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// Far more than a pipe holds.  None of it is read, and none of it may wait for the reader.
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		block := strings.Repeat("x", 64*1024-1) + "\n"
+		for i := 0; i < 64; i++ {
+			fifo.WriteString(block)
+			other.WriteString("written\n")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		test.Fatal("writes waited for a reader that never reads")
+	}
+	if got, want := readFile(test, other), strings.Repeat("written\n", 64); got != want {
+		test.Errorf("other file has %d bytes, want %d", len(got), len(want))
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		cache.close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		test.Fatal("closing waited for a reader that never reads")
+	}
+}
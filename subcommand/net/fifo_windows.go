@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package net
+
+// Windows has no FIFOs in the file system; isFifo() is always false.
+func isFifoUnread(err error) bool {
+	return false
+}
+
+func isFifoClosed(err error) bool {
+	return false
+}
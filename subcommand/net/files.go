@@ -0,0 +1,711 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Defaults for "output.buffered".
+const (
+	OUTPUT_BUFFER_SIZE_DEFAULT    = 1024 * 64
+	OUTPUT_FLUSH_INTERVAL_DEFAULT = time.Second
+)
+
+// Values of "file.mode".
+const (
+	FILE_MODE_SHARED        = "shared"        // One file per output for the life of the process.
+	FILE_MODE_PERCONNECTION = "perconnection" // A new file per output for each accepted connection.
+)
+
+// Return the "file.mode" configuration value, defaulting to "shared".
+func fileMode() (string, error) {
+	mode := viper.GetString("file.mode")
+	switch mode {
+	case "":
+		return FILE_MODE_SHARED, nil
+	case FILE_MODE_SHARED, FILE_MODE_PERCONNECTION:
+		return mode, nil
+	}
+	return "", fmt.Errorf("file.mode '%s' is not '%s' or '%s'", mode, FILE_MODE_SHARED, FILE_MODE_PERCONNECTION)
+}
+
+const (
+	TIME_BUCKET_HOURLY = "hourly" // e.g. "capture-2024010113.log"
+	TIME_BUCKET_DAILY  = "daily"  // e.g. "capture-20240101.log"
+)
+
+// Time layouts of the TIME_BUCKET_* values.
+var timeBucketLayouts = map[string]string{
+	TIME_BUCKET_HOURLY: "2006010215",
+	TIME_BUCKET_DAILY:  "20060102",
+}
+
+// Configure time-bucketed output files from "output.timebucket".
+func loadTimeBucket(cache *FileCache) error {
+	value := strings.ToLower(viper.GetString("output.timebucket"))
+	if value == "" {
+		return nil
+	}
+	layout, ok := timeBucketLayouts[value]
+	if !ok {
+		return fmt.Errorf("output.timebucket '%s' is not '%s' or '%s'", value, TIME_BUCKET_HOURLY, TIME_BUCKET_DAILY)
+	}
+	cache.setTimeBucket(layout)
+	return nil
+}
+
+// Values of "output.lineending".
+const (
+	LINE_ENDING_LF   = "lf"
+	LINE_ENDING_CRLF = "crlf"
+)
+
+// Configure line endings from "output.lineending".
+// "binaryfile" output contains only proxied bytes, so its line endings are never changed.
+func loadLineEnding(cache *FileCache) error {
+	value := strings.ToLower(viper.GetString("output.lineending"))
+	switch value {
+	case "", LINE_ENDING_LF:
+		return nil
+	case LINE_ENDING_CRLF:
+		if viper.GetString(FORMAT) != FORMAT_BINARY_FILE {
+			cache.setCrlf(true)
+		}
+		return nil
+	}
+	return fmt.Errorf("output.lineending '%s' is not '%s' or '%s'", value, LINE_ENDING_LF, LINE_ENDING_CRLF)
+}
+
+const (
+	OUTPUT_DIR_MODE_DEFAULT = 0755
+)
+
+// Configure "output.mkdir" and "output.dirmode": create missing parent directories of output files.
+func loadMkdir(cache *FileCache) error {
+	if !viper.GetBool("output.mkdir") {
+		return nil
+	}
+	mode := os.FileMode(OUTPUT_DIR_MODE_DEFAULT)
+	if value := viper.GetString("output.dirmode"); value != "" {
+		parsed, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || parsed > 0777 {
+			return fmt.Errorf("output.dirmode '%s' is not an octal permission, like \"0755\"", value)
+		}
+		mode = os.FileMode(parsed)
+	}
+	cache.setDirMode(mode)
+	return nil
+}
+
+// Output file name that writes to standard output.
+const OUTPUT_STDOUT = "-"
+
+// Values of "output.stdout.buffering".
+const (
+	STDOUT_BUFFERING_LINE  = "line"  // Written at the end of each write that contains a newline, e.g. each block.
+	STDOUT_BUFFERING_BLOCK = "block" // Written when the buffer of "output.buffersize" bytes fills, and on shutdown.
+	STDOUT_BUFFERING_NONE  = "none"  // Written immediately.
+)
+
+// Configure buffering of standard output from "output.stdout.buffering", defaulting to "line".
+func loadStdoutBuffering(cache *FileCache) error {
+	value := strings.ToLower(viper.GetString("output.stdout.buffering"))
+	switch value {
+	case "":
+		value = STDOUT_BUFFERING_LINE
+	case STDOUT_BUFFERING_LINE, STDOUT_BUFFERING_BLOCK, STDOUT_BUFFERING_NONE:
+	default:
+		return fmt.Errorf("output.stdout.buffering '%s' is not '%s', '%s', or '%s'", value, STDOUT_BUFFERING_LINE, STDOUT_BUFFERING_BLOCK, STDOUT_BUFFERING_NONE)
+	}
+	cache.setStdoutBuffering(value)
+	return nil
+}
+
+// Replace each "\n" not already preceded by "\r" with "\r\n".
+func toCrlf(data []byte) []byte {
+	count := bytes.Count(data, []byte("\n"))
+	if count == 0 {
+		return data
+	}
+	result := make([]byte, 0, len(data)+count)
+	for index, aByte := range data {
+		if aByte == '\n' && (index == 0 || data[index-1] != '\r') {
+			result = append(result, '\r')
+		}
+		result = append(result, aByte)
+	}
+	return result
+}
+
+// Configure buffering from "output.buffered", "output.buffersize", and "output.flushinterval".
+// Buffered data is flushed every interval, when files are closed, and on shutdown.
+func startBuffering(ctx context.Context, cache *FileCache) {
+	if !viper.GetBool("output.buffered") {
+		return
+	}
+	bufferSize := viper.GetInt("output.buffersize")
+	if bufferSize <= 0 {
+		bufferSize = OUTPUT_BUFFER_SIZE_DEFAULT
+	}
+	interval := OUTPUT_FLUSH_INTERVAL_DEFAULT
+	if value := viper.GetString("output.flushinterval"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("Bad output.flushinterval '%s'. Err: %+v\n", value, err)
+		}
+		interval = parsed
+	}
+	cache.setBufferSize(bufferSize)
+	cache.startFlusher(ctx, interval)
+}
+
+// Name a per-connection file.  "{connection}" in 'name' is replaced by the connection number
+// and "{time}" by the time the connection was accepted.
+// If 'name' has neither, the connection number is inserted before the file extension.
+// Standard output is shared by all connections.
+func connectionFileName(name string, connection uint64, when time.Time) string {
+	if name == OUTPUT_STDOUT {
+		return name
+	}
+	number := strconv.FormatUint(connection, 10)
+	if !strings.Contains(name, "{connection}") && !strings.Contains(name, "{time}") {
+		extension := filepath.Ext(name)
+		return strings.TrimSuffix(name, extension) + "-" + number + extension
+	}
+	replacer := strings.NewReplacer(
+		"{connection}", number,
+		"{time}", timestamp(when).Format("20060102T150405.000"),
+	)
+	return replacer.Replace(name)
+}
+
+// An output file whose handle is kept in a FileCache.
+// The handle may be closed between writes and is reopened, in append mode, when needed.
+// With time buckets, each write goes to the file of the current bucket.
+type OutputFile struct {
+	cache    *FileCache
+	current  string      // Name of the bucket file last written.  Guarded by 'cache.lock'.
+	extras   []ExtraFile // Files of the other formats of a "format" list.
+	hold     *Trigger    // If set, writes are held until the connection matches "capture.trigger".
+	isBinary bool        // If true, "output.lineending" is not applied.
+	isClosed bool        // Close() has been called.  Guarded by 'cache.lock'.
+	name     string
+	raw      *OutputFile // If set, the "output.raw" sidecar, which gets the proxied bytes.
+}
+
+// Open file handles, shared by all OutputFiles with the same name.
+// If 'capacity' is greater than 0, no more than 'capacity' handles are kept open;
+// the least-recently-used handle is closed to make room.
+// If 'bufferSize' is greater than 0, writes are buffered and written when the buffer fills,
+// when flush() is called, or when the handle is closed.
+// If 'timeBucket' is set, it is the time layout inserted before the extension of each file name.
+type FileCache struct {
+	banners    map[string]string // By name of an OutputFile: the banner each new file of it begins with.  See begin().
+	bufferSize int
+	capacity   int
+	captures   map[string]bool // Names of the capture files, which get markers.  See writeMarker().
+	crlf       bool            // If true, "\n" is written as "\r\n".
+	dirMode    os.FileMode     // If not 0, missing parent directories are created with this mode.
+	disk       *DiskLimit      // If set, caps the total size of 'files'.
+	elements   map[string]*list.Element
+	fifoBuffer int // See Fifo.
+	fifoPolicy string
+	fifos      map[string]*Fifo // Named pipes written, by name.  They stay open when their handles are closed.
+	files      map[string]bool  // Names of every file opened, for "disk.maxtotalbytes".
+	lock       sync.Mutex
+	order      *list.List // Front is most recently used.
+	stdout     string     // Buffering of OUTPUT_STDOUT: a STDOUT_BUFFERING_* value.
+	stdoutUsed bool       // OUTPUT_STDOUT has had a handle, so it is not new.
+	timeBucket string
+	users      map[string]int // By name of an OutputFile: how many are open.  Their current files are not deleted.
+}
+
+type fileCacheEntry struct {
+	crlf           bool
+	fifo           *Fifo    // If set, the file is a named pipe, written instead of 'file'.
+	file           *os.File // nil for a named pipe.
+	isLineBuffered bool     // If true, 'writer' is flushed after each write containing a newline.
+	isNew          bool     // The file was empty when opened and has not been written since.
+	isStdout       bool     // If true, 'file' is os.Stdout, which is flushed but never closed.
+	name           string
+	writer         *bufio.Writer // nil if unbuffered.
+}
+
+func (entry *fileCacheEntry) Write(data []byte) (int, error) {
+	if entry.crlf {
+		if _, err := entry.write(toCrlf(data)); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	return entry.write(data)
+}
+
+func (entry *fileCacheEntry) write(data []byte) (int, error) {
+	if len(data) > 0 {
+		entry.isNew = false
+	}
+	if entry.writer != nil {
+		count, err := entry.writer.Write(data)
+		if err == nil && entry.isLineBuffered && bytes.IndexByte(data, '\n') >= 0 {
+			err = entry.writer.Flush()
+		}
+		return count, err
+	}
+	if entry.fifo != nil {
+		return entry.fifo.Write(data)
+	}
+	return entry.file.Write(data)
+}
+
+// Cache used by openFile(). Its capacity is set from "output.maxopenfiles".
+var fileCache = newFileCache(0)
+
+func newFileCache(capacity int) *FileCache {
+	return &FileCache{
+		banners:    map[string]string{},
+		capacity:   capacity,
+		captures:   map[string]bool{},
+		elements:   map[string]*list.Element{},
+		fifoBuffer: FIFO_BUFFER_DEFAULT,
+		fifoPolicy: FIFO_POLICY_BUFFER,
+		fifos:      map[string]*Fifo{},
+		files:      map[string]bool{},
+		order:      list.New(),
+		stdout:     STDOUT_BUFFERING_LINE,
+		users:      map[string]int{},
+	}
+}
+
+// Write line endings as "\r\n".
+func (cache *FileCache) setCrlf(crlf bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.crlf = crlf
+}
+
+// Handle named pipes with 'policy' while no reader has them open, buffering up to 'bufferSize' bytes each.
+func (cache *FileCache) setFifoPolicy(policy string, bufferSize int) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.fifoPolicy = policy
+	cache.fifoBuffer = bufferSize
+}
+
+// Buffer standard output by 'buffering', a STDOUT_BUFFERING_* value.
+func (cache *FileCache) setStdoutBuffering(buffering string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.stdout = buffering
+}
+
+// Create missing parent directories of files, with 'mode', when they are opened.
+func (cache *FileCache) setDirMode(mode os.FileMode) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.dirMode = mode
+}
+
+// Set the number of handles kept open.  0 means no limit.
+func (cache *FileCache) setCapacity(capacity int) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.capacity = capacity
+	cache.evict()
+}
+
+// Buffer writes with a buffer of 'bufferSize' bytes.  0 means unbuffered.
+// Applies to handles opened afterwards.
+func (cache *FileCache) setBufferSize(bufferSize int) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.bufferSize = bufferSize
+}
+
+// Start a new file for each time bucket, named by inserting 'layout' before the extension.
+func (cache *FileCache) setTimeBucket(layout string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.timeBucket = layout
+}
+
+// Name of the file 'name' is written to at 'when'.  Must be called with 'cache.lock' held.
+func (cache *FileCache) bucketName(name string, when time.Time) string {
+	if cache.timeBucket == "" || name == OUTPUT_STDOUT {
+		return name
+	}
+	extension := filepath.Ext(name)
+	return strings.TrimSuffix(name, extension) + "-" + timestamp(when).Format(cache.timeBucket) + extension
+}
+
+// Return an open handle for 'name'.  Must be called with 'cache.lock' held.
+func (cache *FileCache) handle(name string) (*fileCacheEntry, error) {
+	if element, ok := cache.elements[name]; ok {
+		cache.order.MoveToFront(element)
+		return element.Value.(*fileCacheEntry), nil
+	}
+	if name == OUTPUT_STDOUT {
+		return cache.stdoutHandle(), nil
+	}
+	if isFifo(name) {
+		return cache.fifoHandle(name), nil
+	}
+	directory := filepath.Dir(name)
+	if cache.dirMode != 0 {
+		if err := os.MkdirAll(directory, cache.dirMode); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		if _, statErr := os.Stat(directory); os.IsNotExist(statErr) {
+			return nil, fmt.Errorf("output directory '%s' of '%s' does not exist. Create it, or set output.mkdir", directory, name)
+		}
+		return nil, err
+	}
+	entry := &fileCacheEntry{
+		crlf: cache.crlf,
+		file: file,
+		name: name,
+	}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		entry.isNew = true
+	}
+	if cache.bufferSize > 0 {
+		entry.writer = bufio.NewWriterSize(file, cache.bufferSize)
+	}
+	cache.elements[name] = cache.order.PushFront(entry)
+	cache.files[name] = true
+	cache.evict()
+	return entry, nil
+}
+
+// Return a handle for standard output, buffered by 'cache.stdout'.  Must be called with 'cache.lock' held.
+func (cache *FileCache) stdoutHandle() *fileCacheEntry {
+	entry := &fileCacheEntry{
+		crlf:     cache.crlf,
+		file:     os.Stdout,
+		isNew:    !cache.stdoutUsed,
+		isStdout: true,
+		name:     OUTPUT_STDOUT,
+	}
+	cache.stdoutUsed = true
+	bufferSize := cache.bufferSize
+	if bufferSize <= 0 {
+		bufferSize = OUTPUT_BUFFER_SIZE_DEFAULT
+	}
+	switch cache.stdout {
+	case STDOUT_BUFFERING_LINE:
+		entry.writer = bufio.NewWriterSize(os.Stdout, bufferSize)
+		entry.isLineBuffered = true
+	case STDOUT_BUFFERING_BLOCK:
+		entry.writer = bufio.NewWriterSize(os.Stdout, bufferSize)
+	}
+	cache.elements[OUTPUT_STDOUT] = cache.order.PushFront(entry)
+	cache.evict()
+	return entry
+}
+
+// Return a handle for the named pipe 'name'.  Must be called with 'cache.lock' held.
+// Named pipes are not in 'files': they hold no bytes on disk, and are never deleted.
+func (cache *FileCache) fifoHandle(name string) *fileCacheEntry {
+	fifo, ok := cache.fifos[name]
+	isNew := !ok
+	if !ok {
+		fifo = newFifo(name, cache.fifoPolicy, cache.fifoBuffer)
+		cache.fifos[name] = fifo
+	}
+	entry := &fileCacheEntry{
+		crlf:  cache.crlf,
+		fifo:  fifo,
+		isNew: isNew,
+		name:  name,
+	}
+	if cache.bufferSize > 0 {
+		entry.writer = bufio.NewWriterSize(fifo, cache.bufferSize)
+	}
+	cache.elements[name] = cache.order.PushFront(entry)
+	cache.evict()
+	return entry
+}
+
+// Write all buffered data to the files.
+func (cache *FileCache) flush() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for element := cache.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*fileCacheEntry)
+		if entry.writer != nil {
+			if err := entry.writer.Flush(); err != nil {
+				log.Printf("Flushing %s failed. Err: %+v\n", entry.name, err)
+			}
+		}
+	}
+}
+
+// Flush and close every handle, so each file is reopened by name on its next write.
+// After an external tool, like logrotate, renames a file, writes go to a new file with the original name.
+func (cache *FileCache) reopen() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for cache.order.Len() > 0 {
+		if err := cache.remove(cache.order.Back()); err != nil {
+			log.Printf("Closing output file failed. Err: %+v\n", err)
+		}
+	}
+}
+
+// Flush and close every handle at shutdown.
+// Writes after this are not buffered, so nothing written late is left in a buffer when the process exits.
+func (cache *FileCache) close() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.bufferSize = 0
+	cache.stdout = STDOUT_BUFFERING_NONE
+	for cache.order.Len() > 0 {
+		if err := cache.remove(cache.order.Back()); err != nil {
+			log.Printf("Closing output file failed. Err: %+v\n", err)
+		}
+	}
+	for name, fifo := range cache.fifos {
+		if err := fifo.Close(); err != nil {
+			log.Printf("Closing FIFO %s failed. Err: %+v\n", name, err)
+		}
+	}
+}
+
+// Begin each new file of OutputFile 'name' with 'banner': the first, each time bucket's, and one recreated
+// after a rename, e.g. by logrotate before SIGHUP.  A file that already has content is written as is.
+func (cache *FileCache) setBanner(name string, banner string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.banners[name] = banner
+}
+
+// Write the banner of OutputFile 'name' to 'entry' if it is a new file.  Must be called with 'cache.lock' held.
+func (cache *FileCache) begin(entry *fileCacheEntry, name string) error {
+	banner := cache.banners[name]
+	if !entry.isNew || banner == "" {
+		return nil
+	}
+	if !cache.allowWrite(len(banner)) {
+		return nil // Dropped: "disk.maxtotalbytes" is reached.
+	}
+	_, err := entry.Write([]byte(banner))
+	return err
+}
+
+// Record 'name' as a capture file.  It is forgotten when the file is closed.
+func (cache *FileCache) addCapture(name string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.captures[name] = true
+}
+
+// Write 'data' to every capture file, without regard to "capture.trigger".  Returns the number written.
+func (cache *FileCache) writeCaptures(data []byte) int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	count := 0
+	for name := range cache.captures {
+		if !cache.allowWrite(len(data)) {
+			break
+		}
+		entry, err := cache.handle(cache.bucketName(name, time.Now()))
+		if err == nil {
+			err = cache.begin(entry, name)
+		}
+		if err == nil {
+			_, err = entry.Write(data)
+		}
+		if err != nil {
+			log.Printf("Writing to %s failed. Err: %+v\n", name, err)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// Flush every 'interval' until 'ctx' is done.
+func (cache *FileCache) startFlusher(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cache.flush()
+			}
+		}
+	}()
+}
+
+// Close least-recently-used handles until within capacity.  Must be called with 'cache.lock' held.
+func (cache *FileCache) evict() {
+	for cache.capacity > 0 && cache.order.Len() > cache.capacity {
+		cache.remove(cache.order.Back())
+	}
+}
+
+// Flush and close a handle.  Must be called with 'cache.lock' held.
+// A named pipe and standard output are only flushed; see Fifo.
+func (cache *FileCache) remove(element *list.Element) error {
+	entry := element.Value.(*fileCacheEntry)
+	cache.order.Remove(element)
+	delete(cache.elements, entry.name)
+	if entry.writer != nil {
+		if err := entry.writer.Flush(); err != nil {
+			if entry.file != nil {
+				entry.file.Close()
+			}
+			return err
+		}
+	}
+	if entry.fifo != nil || entry.isStdout {
+		return nil
+	}
+	return entry.file.Close()
+}
+
+// Open 'name' in the cache, returning any error opening it.
+func (cache *FileCache) open(name string) (*OutputFile, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	current := cache.bucketName(name, time.Now())
+	if _, err := cache.handle(current); err != nil {
+		return nil, err
+	}
+	cache.users[name]++
+	return &OutputFile{
+		cache:   cache,
+		current: current,
+		name:    name,
+	}, nil
+}
+
+// Write to the file, reopening it if its handle was closed.
+// Writes to the same file are serialized, so blocks from different goroutines do not interleave.
+// When the time bucket changes, the previous bucket's file is closed.
+func (outputFile *OutputFile) Write(data []byte) (int, error) {
+	if outputFile.hold.hold(outputFile, data) {
+		return len(data), nil
+	}
+	return outputFile.write(data)
+}
+
+// Write, without regard to "capture.trigger".
+func (outputFile *OutputFile) write(data []byte) (int, error) {
+	outputFile.cache.lock.Lock()
+	defer outputFile.cache.lock.Unlock()
+	current := outputFile.cache.bucketName(outputFile.name, time.Now())
+	if current != outputFile.current {
+		if element, ok := outputFile.cache.elements[outputFile.current]; ok {
+			if err := outputFile.cache.remove(element); err != nil {
+				log.Printf("Closing %s failed. Err: %+v\n", outputFile.current, err)
+			}
+		}
+		outputFile.current = current
+	}
+	if !outputFile.cache.allowWrite(len(data)) {
+		return len(data), nil // Dropped: "disk.maxtotalbytes" is reached.
+	}
+	entry, err := outputFile.cache.handle(current)
+	if err != nil {
+		return 0, err
+	}
+	if err := outputFile.cache.begin(entry, outputFile.name); err != nil {
+		return 0, err
+	}
+	if outputFile.isBinary {
+		return entry.write(data)
+	}
+	return entry.Write(data)
+}
+
+func (outputFile *OutputFile) WriteString(data string) (int, error) {
+	return outputFile.Write([]byte(data))
+}
+
+// Flush and close the file's handle, and those of its sidecar and extra files.  A later Write reopens it.
+func (outputFile *OutputFile) Close() error {
+	if outputFile.raw != nil {
+		if err := outputFile.raw.Close(); err != nil {
+			log.Printf("Closing %s failed. Err: %+v\n", outputFile.raw.Name(), err)
+		}
+	}
+	for _, extra := range outputFile.extras {
+		if err := extra.file.Close(); err != nil {
+			log.Printf("Closing %s failed. Err: %+v\n", extra.file.Name(), err)
+		}
+	}
+	outputFile.cache.lock.Lock()
+	defer outputFile.cache.lock.Unlock()
+	delete(outputFile.cache.captures, outputFile.name)
+	if !outputFile.isClosed {
+		outputFile.isClosed = true
+		outputFile.cache.users[outputFile.name]--
+		if outputFile.cache.users[outputFile.name] <= 0 {
+			delete(outputFile.cache.users, outputFile.name)
+		}
+	}
+	if element, ok := outputFile.cache.elements[outputFile.current]; ok {
+		return outputFile.cache.remove(element)
+	}
+	return nil
+}
+
+// The same file, sidecar, and extra files, with writes held by 'trigger'.
+func (outputFile *OutputFile) heldBy(trigger *Trigger) *OutputFile {
+	if trigger == nil {
+		return outputFile
+	}
+	var raw *OutputFile
+	if outputFile.raw != nil {
+		raw = outputFile.raw.heldBy(trigger)
+	}
+	extras := []ExtraFile{}
+	for _, extra := range outputFile.extras {
+		extras = append(extras, ExtraFile{file: extra.file.heldBy(trigger), format: extra.format})
+	}
+	outputFile.cache.lock.Lock()
+	defer outputFile.cache.lock.Unlock()
+	outputFile.cache.users[outputFile.name]++
+	return &OutputFile{
+		cache:    outputFile.cache,
+		current:  outputFile.current,
+		extras:   extras,
+		hold:     trigger,
+		isBinary: outputFile.isBinary,
+		name:     outputFile.name,
+		raw:      raw,
+	}
+}
+
+// Write proxied bytes to the file's "output.raw" sidecar, if it has one.
+func (outputFile *OutputFile) writeRaw(data []byte) {
+	if outputFile == nil || outputFile.raw == nil {
+		return
+	}
+	if _, err := outputFile.raw.Write(data); err != nil {
+		log.Printf("Writing %s failed. Err: %+v\n", outputFile.raw.Name(), err)
+	}
+}
+
+func (outputFile *OutputFile) Name() string {
+	return outputFile.name
+}
@@ -0,0 +1,83 @@
+package net
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Decides which clients may connect, by their IP address.
+// A denied address is never allowed.  An empty allow list allows every address that is not denied.
+type AddressFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// AddressFilter built from "inbound.allow" and "inbound.deny".  If nil, every client is allowed.
+var addressFilter *AddressFilter
+
+// Build an AddressFilter from lists of CIDRs, e.g. "10.0.0.0/8".  A bare IP address is a single-address CIDR.
+func loadAddressFilter() *AddressFilter {
+	allow := viper.GetStringSlice("inbound.allow")
+	deny := viper.GetStringSlice("inbound.deny")
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	return &AddressFilter{
+		allow: parseCidrs("inbound.allow", allow),
+		deny:  parseCidrs("inbound.deny", deny),
+	}
+}
+
+func parseCidrs(key string, values []string) []*net.IPNet {
+	result := []*net.IPNet{}
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value = value + "/32"
+			} else {
+				value = value + "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			log.Fatalf("Bad %s value '%s'. Err: %+v\n", key, value, err)
+		}
+		result = append(result, network)
+	}
+	return result
+}
+
+// Whether a client with remote address 'address' may connect.
+// Addresses without an IP (e.g. "unix" clients) are allowed only if the allow list is empty.
+func (filter *AddressFilter) allowed(address net.Addr) bool {
+	if filter == nil {
+		return true
+	}
+	var ip net.IP
+	switch address := address.(type) {
+	case *net.TCPAddr:
+		ip = address.IP
+	case *net.UDPAddr:
+		ip = address.IP
+	}
+	if ip == nil {
+		return len(filter.allow) == 0
+	}
+	for _, network := range filter.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(filter.allow) == 0 {
+		return true
+	}
+	for _, network := range filter.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
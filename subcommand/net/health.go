@@ -0,0 +1,103 @@
+package net
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Longest time a health probe waits for a tee to accept a connection.
+const HEALTH_DIAL_TIMEOUT = time.Second * 5
+
+// Dialer used by health probes.
+var probeDialer NetworkDialer = &net.Dialer{Timeout: HEALTH_DIAL_TIMEOUT}
+
+// Reachability of tee endpoints, probed every "health.interval".
+type Health struct {
+	alive    map[string]bool // By tee id.  Missing means not yet probed.
+	lock     sync.Mutex
+	skipDead bool
+}
+
+// Health built from "health.interval".  If nil, tees are not probed.
+var health *Health
+
+// Start probing the configured tees every "health.interval".
+// With "health.skipdead", tees that failed their last probe are left out of new connections.
+func startHealth(ctx context.Context) *Health {
+	value := viper.GetString("health.interval")
+	if value == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		log.Fatalf("Bad health.interval '%s'. Err: %+v\n", value, err)
+	}
+	result := &Health{
+		alive:    map[string]bool{},
+		skipDead: viper.GetBool("health.skipdead"),
+	}
+	result.probeAll()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				result.probeAll()
+			}
+		}
+	}()
+	return result
+}
+
+// Probe each enabled tee with a connection attempt.  Datagram tees cannot be probed.
+// A tee reached through an HTTP proxy is probed at the proxy.
+func (health *Health) probeAll() {
+	for _, definition := range getTeeDefinitions() {
+		if !definition.Enabled || datagramNetworks[definition.Network] {
+			continue
+		}
+		network, address := definition.Network, definition.Address
+		if definition.HttpProxy != "" {
+			network, address = "tcp", definition.HttpProxy
+		}
+		connection, err := probeDialer.Dial(network, address)
+		if err == nil {
+			connection.Close()
+		}
+		health.record(definition.Id, address, err)
+	}
+}
+
+// Record a probe result, logging changes in reachability.
+func (health *Health) record(id string, address string, err error) {
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	wasAlive, probed := health.alive[id]
+	isAlive := err == nil
+	health.alive[id] = isAlive
+	switch {
+	case !isAlive && (wasAlive || !probed):
+		log.Printf("Tee '%s' at '%s' is unreachable. Err: %+v\n", id, address, err)
+	case isAlive && probed && !wasAlive:
+		log.Printf("Tee '%s' at '%s' is reachable again.\n", id, address)
+	}
+}
+
+// Whether a new connection should include the tee.  False only for dead tees with "health.skipdead".
+func (health *Health) useTee(id string) bool {
+	if health == nil || !health.skipDead {
+		return true
+	}
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	alive, probed := health.alive[id]
+	return alive || !probed
+}
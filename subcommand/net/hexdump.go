@@ -0,0 +1,91 @@
+package net
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	HEX_WIDTH_DEFAULT = 16
+
+	// Bytes between the extra spaces that split a line into groups.
+
+	HEX_GROUP_LENGTH = 8
+)
+
+// Bytes per line for "hex", "hexparsed", and "binaryxml" formats, from "hex.width".
+func hexWidth() int {
+	width := viper.GetInt("hex.width")
+	if width <= 0 {
+		return HEX_WIDTH_DEFAULT
+	}
+	return width
+}
+
+// Address of the first byte in a hex dump.
+// With "hex.streamoffsets", addresses are positions in the connection stream, in that direction.
+// Otherwise addresses start at 0 for each dump.
+func hexBaseOffset(streamOffset int) int {
+	if viper.GetBool("hex.streamoffsets") {
+		return streamOffset
+	}
+	return 0
+}
+
+// Dump a message for the "hex" and "hexparsed" formats, with hexWidth() bytes per line.
+// With "hex.head" or "hex.tail", a message longer than head + tail bytes is shown as its first 'head'
+// and last 'tail' bytes, with a line marking the bytes between them.
+func hexDumpMessage(data []byte, baseOffset int) string {
+	head := viper.GetInt("hex.head")
+	tail := viper.GetInt("hex.tail")
+	if head < 0 {
+		head = 0
+	}
+	if tail < 0 {
+		tail = 0
+	}
+	if (head == 0 && tail == 0) || len(data) <= head+tail {
+		return hexDump(data, hexWidth(), baseOffset)
+	}
+	tailStart := len(data) - tail
+	return hexDump(data[:head], hexWidth(), baseOffset) +
+		fmt.Sprintf("... %d bytes not shown ...\n", tailStart-head) +
+		hexDump(data[tailStart:], hexWidth(), baseOffset+tailStart)
+}
+
+// Format 'data' like "hexdump -C", with 'width' bytes per line.
+// Addresses start at 'baseOffset'.
+// With a width of 16 and a baseOffset of 0 the result is identical to hex.Dump().
+func hexDump(data []byte, width int, baseOffset int) string {
+	var result strings.Builder
+	for offset := 0; offset < len(data); offset += width {
+		end := offset + width
+		if end > len(data) {
+			end = len(data)
+		}
+		line := data[offset:end]
+
+		fmt.Fprintf(&result, "%08x  ", baseOffset+offset)
+		for index := 0; index < width; index++ {
+			if index < len(line) {
+				fmt.Fprintf(&result, "%02x ", line[index])
+			} else {
+				result.WriteString("   ")
+			}
+			if (index+1)%HEX_GROUP_LENGTH == 0 && index+1 < width {
+				result.WriteString(" ")
+			}
+		}
+		result.WriteString(" |")
+		for _, aByte := range line {
+			if aByte < 32 || aByte > 126 {
+				aByte = '.'
+			}
+			result.WriteByte(aByte)
+		}
+		result.WriteString("|\n")
+	}
+	return result.String()
+}
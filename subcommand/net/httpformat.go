@@ -0,0 +1,158 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+
+	// Largest incomplete HTTP message buffered by the "http" format.  Larger ones are logged as text.
+
+	HTTP_MAX_BUFFERED = 1024 * 1024
+)
+
+// Bytes of one direction of a connection that the "http" format has not yet logged.
+type httpStream struct {
+	isUntilClose bool   // If true, the body of the last response lasts until the connection closes.
+	pending      []byte // The start of a message not yet complete.
+}
+
+// 'streamOffset' is the position of 'message' in the connection stream.
+// Requests are logged with their method, target, and headers, and responses with their status and headers,
+// each followed by its body.  Bodies framed by Content-Length or chunked encoding may span reads:
+// the bytes are buffered, and the message is logged in the block of the read that completes it.
+// Bytes that are not HTTP are logged as text.
+func httpParse(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) string {
+	session := getSession(ctx)
+	stream := session.takeHttpStream(direction, teeId, streamOffset)
+	nextOffset := streamOffset + len(message)
+
+	// A body that lasts until the connection closes is logged as it is read.
+
+	if stream.isUntilClose {
+		session.putHttpStream(direction, teeId, nextOffset, stream)
+		return describeHttpBody(message, streamOffset)
+	}
+
+	data := append(stream.pending, message...)
+	var result strings.Builder
+	for len(data) > 0 {
+		described, consumed, isUntilClose, err := readHttpMessage(direction, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if len(data) > HTTP_MAX_BUFFERED {
+				fmt.Fprintf(&result, "[http: %d bytes without a complete message]\n%s\n", len(data), data)
+				break
+			}
+			fmt.Fprintf(&result, "[http: %d bytes of an incomplete message, logged when it is complete]\n", len(data))
+			session.putHttpStream(direction, teeId, nextOffset, httpStream{pending: data})
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(&result, "%s\n", data)
+			break
+		}
+		result.WriteString(described)
+		data = data[consumed:]
+		if isUntilClose {
+			result.WriteString(describeHttpBody(data, nextOffset-len(data)))
+			session.putHttpStream(direction, teeId, nextOffset, httpStream{isUntilClose: true})
+			break
+		}
+	}
+	return result.String()
+}
+
+// Read one request or response from the start of 'data'.  Returns its description and the number of bytes in it.
+// io.EOF or io.ErrUnexpectedEOF means 'data' holds only part of the message.
+// For a response without Content-Length or chunked encoding, only its header is read, and 'isUntilClose' is true.
+func readHttpMessage(direction string, data []byte) (string, int, bool, error) {
+	reader := bytes.NewReader(data)
+	buffered := bufio.NewReader(reader)
+	consumed := func() int {
+		return len(data) - reader.Len() - buffered.Buffered()
+	}
+	var result strings.Builder
+	if direction == DIRECTION_REQUEST {
+		request, err := http.ReadRequest(buffered)
+		if err != nil {
+			return "", 0, false, err
+		}
+		fmt.Fprintf(&result, "%s %s %s\n", request.Method, request.RequestURI, request.Proto)
+		fmt.Fprintf(&result, "Host: %s\n", request.Host)
+		writeHttpHeader(&result, request.Header, request.TransferEncoding)
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			return "", 0, false, err
+		}
+		result.WriteString(describeHttpBody(body, 0))
+		return result.String(), consumed(), false, nil
+	}
+
+	// Responses are read without their requests, so a response to HEAD is expected to have a body if it has a Content-Length.
+
+	response, err := http.ReadResponse(buffered, nil)
+	if err != nil {
+		return "", 0, false, err
+	}
+	fmt.Fprintf(&result, "%s %s\n", response.Proto, response.Status)
+	writeHttpHeader(&result, response.Header, response.TransferEncoding)
+	if response.ContentLength < 0 && len(response.TransferEncoding) == 0 && response.StatusCode >= 200 && response.StatusCode != 204 && response.StatusCode != 304 {
+		return result.String(), consumed(), true, nil
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", 0, false, err
+	}
+	result.WriteString(describeHttpBody(body, 0))
+	return result.String(), consumed(), false, nil
+}
+
+// Write the header lines, and the blank line ending them.  Go removes Transfer-Encoding from the header, so it is added back.
+func writeHttpHeader(writer io.Writer, header http.Header, transferEncoding []string) {
+	header.Write(writer)
+	if len(transferEncoding) > 0 {
+		fmt.Fprintf(writer, "Transfer-Encoding: %s\n", strings.Join(transferEncoding, ", "))
+	}
+	fmt.Fprintf(writer, "\n")
+}
+
+// A body for logging: text if printable, otherwise in hex.  Chunked bodies are shown decoded.
+func describeHttpBody(body []byte, streamOffset int) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if detectFormat(body) == FORMAT_STRING {
+		return string(body) + "\n"
+	}
+	return hexDump(body, hexWidth(), hexBaseOffset(streamOffset))
+}
+
+// Remove and return the unlogged bytes of the stream expected at 'offset' in 'direction' from 'teeId'.
+func (session *Session) takeHttpStream(direction string, teeId string, offset int) httpStream {
+	if session == nil {
+		return httpStream{}
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	key := streamKey{direction: direction, offset: offset, teeId: teeId}
+	stream := session.http[key]
+	delete(session.http, key)
+	return stream
+}
+
+// Record the unlogged bytes of the stream, expected to continue at 'offset' in 'direction' from 'teeId'.
+func (session *Session) putHttpStream(direction string, teeId string, offset int, stream httpStream) {
+	if session == nil {
+		return
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.http[streamKey{direction: direction, offset: offset, teeId: teeId}] = stream
+}
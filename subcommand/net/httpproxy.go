@@ -0,0 +1,53 @@
+package net
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Longest time to wait for an HTTP proxy to answer a CONNECT request.
+const HTTP_PROXY_TIMEOUT = time.Second * 10
+
+// A connection whose first bytes were already read into a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (connection *bufferedConn) Read(data []byte) (int, error) {
+	return connection.reader.Read(data)
+}
+
+// Connect to 'address' through the HTTP proxy at 'proxyAddress' with an HTTP CONNECT tunnel.
+// The returned connection carries raw bytes to and from 'address'.
+func dialHttpProxy(proxyAddress string, address string) (net.Conn, error) {
+	connection, err := networkDialer.Dial("tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	connection.SetDeadline(time.Now().Add(HTTP_PROXY_TIMEOUT))
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", address, address)
+	if _, err := connection.Write([]byte(request)); err != nil {
+		connection.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(connection)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		connection.Close()
+		return nil, fmt.Errorf("reading CONNECT response from HTTP proxy '%s': %v", proxyAddress, err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		connection.Close()
+		return nil, fmt.Errorf("HTTP proxy '%s' refused CONNECT to '%s': %s", proxyAddress, address, response.Status)
+	}
+	connection.SetDeadline(time.Time{})
+	return &bufferedConn{
+		Conn:   connection,
+		reader: reader,
+	}, nil
+}
@@ -0,0 +1,82 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Columns of the "index.csv" file.
+var indexHeader = []string{"time", "direction", "tee", "offset", "length", "root", "decoded"}
+
+// A CSV file with a row per logged message, pointing into the capture files.
+type Index struct {
+	file *OutputFile
+}
+
+// Index built from "index.csv".  If nil, no index is written.
+var messageIndex *Index
+
+// Open "index.csv", writing the header row if the file is new or empty.
+func startIndex(ctx context.Context) *Index {
+	fileName := viper.GetString("index.csv")
+	if fileName == "" {
+		return nil
+	}
+	info, err := os.Stat(fileName)
+	isNew := err != nil || info.Size() == 0
+	result := &Index{
+		file: openFile(ctx, fileName),
+	}
+	if isNew {
+		result.write(indexHeader)
+	}
+	return result
+}
+
+// Add a row for a message read at 'when', 'offset' bytes into its direction of the connection.
+// For messages that begin with binaryXML frames, "root" lists the frames' root elements
+// and "decoded" is whether every frame decoded; both are empty for other messages.
+func (index *Index) add(ctx context.Context, when time.Time, direction string, tee string, offset int, message []byte) {
+	if index == nil {
+		return
+	}
+	root := ""
+	decoded := ""
+	if len(message) > 0 && message[0] == BINARY_XML_START {
+		frames, isOk := decodeFrames(ctx, message)
+		roots := []string{}
+		for _, frame := range frames {
+			roots = append(roots, frame.Type)
+		}
+		root = strings.Join(roots, ";")
+		decoded = strconv.FormatBool(isOk)
+	}
+	index.write([]string{
+		timestamp(when).Format(time.RFC3339Nano),
+		direction,
+		tee,
+		strconv.Itoa(offset),
+		strconv.Itoa(len(message)),
+		root,
+		decoded,
+	})
+}
+
+// Write one row.  OutputFile serializes writes, so rows from different connections do not interleave.
+func (index *Index) write(row []string) {
+	buffer := &bytes.Buffer{}
+	writer := csv.NewWriter(buffer)
+	writer.Write(row)
+	writer.Flush()
+	if _, err := index.file.Write(buffer.Bytes()); err != nil {
+		log.Printf("Writing index.csv failed. Err: %+v\n", err)
+	}
+}
@@ -0,0 +1,54 @@
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Direction of a message in the "json" format.
+const (
+	DIRECTION_REQUEST  = "request"  // Client to server.
+	DIRECTION_RESPONSE = "response" // Server to client.
+)
+
+// One message in the "json" format, written as a line of JSON.
+// Requests and the responses that answer them share a 'corrId'.  See Session.
+// 'RequestBytes' and 'ResponseBytes' are totals for the connection, including the message.
+type JsonRecord struct {
+	ConnectionId  uint64 `json:"connectionId"`
+	CorrId        uint64 `json:"corrId"`
+	Data          []byte `json:"data"` // Base64 encoded.
+	Direction     string `json:"direction"`
+	RequestBytes  uint64 `json:"requestBytes"`  // Read from the client.
+	ResponseBytes uint64 `json:"responseBytes"` // Read from the tee, or for requests, from the primary server.
+	Tee           string `json:"tee"`
+	Time          string `json:"time"`
+	Title         string `json:"title"`
+}
+
+// Format a message as a line of JSON.  The connection's id and byte totals are those of the session of 'ctx'.
+func jsonLine(ctx context.Context, when time.Time, title string, tee string, direction string, corrId uint64, message []byte) string {
+	session := getSession(ctx)
+	responder := tee
+	if direction == DIRECTION_REQUEST {
+		responder = "outbound" // The primary server's tee id.
+	}
+	requestBytes, responseBytes := session.byteTotals(responder)
+	record := JsonRecord{
+		ConnectionId:  session.id(),
+		CorrId:        corrId,
+		Data:          message,
+		Direction:     direction,
+		RequestBytes:  requestBytes,
+		ResponseBytes: responseBytes,
+		Tee:           tee,
+		Time:          timestamp(when).Format(time.RFC3339Nano),
+		Title:         title,
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		panic(err)
+	}
+	return string(line) + "\n"
+}
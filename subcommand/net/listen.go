@@ -0,0 +1,33 @@
+package net
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Default NetworkListener using the "net" package.
+// For "tcp" networks, "inbound.reuseaddr" sets SO_REUSEADDR, so a restarted proxy can listen
+// while connections of the previous one are in TIME_WAIT, and "inbound.backlog" sets the accept backlog.
+type netListener struct{}
+
+func (netListener) Listen(network string, address string) (net.Listener, error) {
+	isTcp := strings.HasPrefix(network, "tcp")
+	listenConfig := net.ListenConfig{}
+	if isTcp && viper.GetBool("inbound.reuseaddr") {
+		listenConfig.Control = reuseAddress
+	}
+	listener, err := listenConfig.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	if backlog := viper.GetInt("inbound.backlog"); isTcp && backlog > 0 {
+		if err := setBacklog(listener.(*net.TCPListener), backlog); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
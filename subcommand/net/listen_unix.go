@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package net
+
+import (
+	"net"
+	"syscall"
+)
+
+// net.ListenConfig Control function setting SO_REUSEADDR before the socket is bound.
+func reuseAddress(network string, address string, connection syscall.RawConn) error {
+	var err error
+	controlErr := connection.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// Replace the accept backlog chosen by the "net" package by listening again on the socket.
+// The OS may limit the backlog, e.g. to net.core.somaxconn on Linux.
+func setBacklog(listener *net.TCPListener, backlog int) error {
+	connection, err := listener.SyscallConn()
+	if err != nil {
+		return err
+	}
+	controlErr := connection.Control(func(fd uintptr) {
+		err = syscall.Listen(int(fd), backlog)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package net
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// On Windows, SO_REUSEADDR lets another socket take over a port in use, so it is not set.
+// Windows allows listening during TIME_WAIT without it.
+func reuseAddress(network string, address string, connection syscall.RawConn) error {
+	return nil
+}
+
+func setBacklog(listener *net.TCPListener, backlog int) error {
+	return fmt.Errorf("inbound.backlog is not supported on Windows")
+}
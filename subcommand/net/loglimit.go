@@ -0,0 +1,56 @@
+package net
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Caps the bytes one connection logs to one tee's file, from "log.maxperconnection".
+// Only logging stops at the cap; traffic is still proxied.
+type LogLimit struct {
+	isTruncated bool
+	lock        sync.Mutex
+	logged      int
+	maximum     int
+}
+
+// LogLimit for a new connection's tee.  If nil, there is no limit.
+func newLogLimit() *LogLimit {
+	maximum := viper.GetInt("log.maxperconnection")
+	if maximum <= 0 {
+		return nil
+	}
+	return &LogLimit{
+		maximum: maximum,
+	}
+}
+
+// Whether a block of 'length' bytes may be written to 'file'.
+// The first block over the cap is replaced by a marker, except in "binaryfile" and "json" formats,
+// where it is logged instead so the file keeps its layout.
+func (limit *LogLimit) allow(file *OutputFile, length int) bool {
+	if limit == nil {
+		return true
+	}
+	limit.lock.Lock()
+	defer limit.lock.Unlock()
+	if limit.isTruncated {
+		return false
+	}
+	if limit.logged+length <= limit.maximum {
+		limit.logged += length
+		return true
+	}
+	limit.isTruncated = true
+	marker := fmt.Sprintf("log truncated for this connection: log.maxperconnection of %d bytes reached", limit.maximum)
+	format := viper.GetString(FORMAT)
+	if format == FORMAT_BINARY_FILE || format == FORMAT_JSON {
+		log.Printf("%s: %s\n", file.Name(), marker)
+	} else {
+		_, _ = file.WriteString("# " + marker + blockSeparator())
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Marker text written when SIGUSR1 is caught.
+const MARKER_SIGNAL_TEXT = "SIGUSR1"
+
+// Write a timestamped marker block to every capture file, so that outside events can be found among the traffic.
+// Markers are not written to "binaryfile" captures, which must contain only proxied bytes.
+func writeMarker(text string) int {
+	format := viper.GetString(FORMAT)
+	if format == FORMAT_BINARY_FILE {
+		return 0
+	}
+	block := fmt.Sprintf("%s\n%s%s", horizontalRule("Marker"), text, blockSeparator())
+	if format == FORMAT_JSON {
+		block = jsonLine(context.Background(), time.Now(), "Marker", "", "marker", 0, []byte(text))
+	}
+	count := fileCache.writeCaptures([]byte(block))
+	if !viper.GetBool("quiet") {
+		log.Printf("Wrote marker '%s' to %d capture files.\n", text, count)
+	}
+	return count
+}
+
+// With "control.socket", listen on a Unix socket for markers.
+// Each line a client sends is written as a marker, and answered with the number of files it was written to.
+// Closing the returned listener removes the socket file.  Returns nil without "control.socket".
+func startControl(ctx context.Context) net.Listener {
+	fileName := viper.GetString("control.socket")
+	if fileName == "" {
+		return nil
+	}
+
+	// A socket file left by an earlier run would make Listen fail.
+
+	if info, err := os.Stat(fileName); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(fileName)
+	}
+	listener, err := net.Listen("unix", fileName)
+	if err != nil {
+		log.Fatalf("Listening on control.socket '%s' failed. Err: %+v\n", fileName, err)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleControl(connection)
+		}
+	}()
+	return listener
+}
+
+// Read markers from one control connection.
+func handleControl(connection net.Conn) {
+	defer connection.Close()
+	scanner := bufio.NewScanner(connection)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		count := writeMarker(text)
+		fmt.Fprintf(connection, "marked %d\n", count)
+	}
+}
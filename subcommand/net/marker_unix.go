@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package net
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// On SIGUSR1, write a marker to every capture file.
+func handleMarkerSignal(ctx context.Context) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGUSR1)
+	go func() {
+		defer signal.Stop(sigc)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigc:
+				writeMarker(MARKER_SIGNAL_TEXT)
+			}
+		}
+	}()
+}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package net
+
+import "context"
+
+// Windows has no SIGUSR1.  Markers are written through "control.socket" only.
+func handleMarkerSignal(ctx context.Context) {
+}
@@ -3,22 +3,31 @@ package net
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/xml"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/BixData/binaryxml"
-	"github.com/BixData/binaryxml/messages"
+	"github.com/docktermj/go-proxy-tee/common/configpath"
+	"github.com/docktermj/go-proxy-tee/common/decode"
 	"github.com/docopt/docopt-go"
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
@@ -49,49 +58,323 @@ const (
 
 	// Acceptable output file formats.
 
-	FORMAT             = "format"
-	FORMAT_BINARY_FILE = "binaryfile"
-	FORMAT_BINARY_XML  = "binaryxml"
-	FORMAT_HEX         = "hex"
-	FORMAT_HEX_PARSED  = "hexparsed"
-	FORMAT_STRING      = "string"
+	FORMAT               = "format"
+	FORMAT_BINARY_FILE   = "binaryfile"
+	FORMAT_BINARY_XML    = "binaryxml"
+	FORMAT_HEX           = "hex"
+	FORMAT_HEX_PARSED    = "hexparsed"
+	FORMAT_HTTP          = "http" // HTTP requests and responses, each with its headers and body.
+	FORMAT_JSON          = "json"
+	FORMAT_PROTOBUF_WIRE = "protobufwire" // Length-prefixed protocol buffers, each field with its number and wire type.
+	FORMAT_STRING        = "string"
+	FORMAT_WEBSOCKET     = "websocket" // WebSocket frames, each with its opcode and unmasked payload.
+	FORMAT_AUTO          = "auto"      // "string" or "hexparsed", chosen for each connection by its first bytes.
 
 	BUFFER_LENGTH = 1024 * 16
+
+	// Largest payload written in a single datagram.
+
+	MAX_DATAGRAM_LENGTH = 1024 * 8
+
+	// Values of "outbound.backpressure": what to do when a write to the primary server
+	// does not complete within "outbound.backpressuretimeout".
+
+	BACKPRESSURE                 = "outbound.backpressure"
+	BACKPRESSURE_BLOCK           = "block"      // Wait.  The client is not read meanwhile.
+	BACKPRESSURE_DROP            = "drop"       // Drop the rest of the message and continue.
+	BACKPRESSURE_DISCONNECT      = "disconnect" // Close the client connection.
+	BACKPRESSURE_TIMEOUT_DEFAULT = time.Second
+
+	// Longest time, at shutdown, for connections to finish writing what they have read.
+
+	SHUTDOWN_TIMEOUT = time.Second * 5
 )
 
+// Networks that are connection-oriented.  These may be listened on and used for any connection.
+var streamNetworks = map[string]bool{
+	"tcp":        true,
+	"tcp4":       true,
+	"tcp6":       true,
+	"unix":       true,
+	"unixpacket": true,
+}
+
+// Networks that are message-oriented.  These may only be used for tees.
+var datagramNetworks = map[string]bool{
+	"udp":      true,
+	"udp4":     true,
+	"udp6":     true,
+	"unixgram": true,
+}
+
+// Creates servers.  Tests may replace 'networkListener' with an in-memory implementation.
+type NetworkListener interface {
+	Listen(network string, address string) (net.Listener, error)
+}
+
+// Creates client connections.  Tests may replace 'networkDialer', e.g. with one returning net.Pipe() connections.
+type NetworkDialer interface {
+	Dial(network string, address string) (net.Conn, error)
+}
+
+var (
+	networkDialer   NetworkDialer   = &net.Dialer{}
+	networkListener NetworkListener = netListener{}
+)
+
+// Program name and version reported in banners.  Set by main.
+var Version = "go-proxy-tee"
+
+// When the net command started.
+var startTime = time.Now()
+
+// Configuration set from the command line.  Kept so a configuration re-read on SIGHUP is overridden the same way.
+var commandLineOverrides = map[string]interface{}{}
+
 type Tee struct {
-	Address    string
-	Connection net.Conn
-	File       *os.File
-	Id         string
-	Network    string
-	Output     string
-	PassThru   bool
+	Address             string
+	Backpressure        string // BACKPRESSURE_* policy for writes. "" blocks.
+	BackpressureTimeout time.Duration
+	Comparison          *Comparison // If set, responses are compared with those of the other server.
+	Connection          net.Conn
+	Failover            []Endpoint // Tried in order when Address cannot be reached.
+	File                *OutputFile
+	HttpProxy           string // If set, connect through this HTTP proxy with CONNECT.
+	Id                  string
+	IsDatagram          bool
+	LogLimit            *LogLimit // If set, caps the bytes logged for this connection.
+	MaxInFlight         int       // If greater than 0, the tee is written from a queue of at most this many bytes.
+	Network             string
+	Output              string
+	Overflow            string // TEE_QUEUE_OVERFLOW_* policy of the tee's queue.  "" uses "teequeue.overflow".
+	PassThru            bool
+	Pool                *Pool        // If set, connections are taken from and returned to this pool.
+	Tls                 *tls.Config  // If set, connect with TLS.
+	Transaction         *Transaction // If set, blocks are held and written as transactions.
+}
+
+// A tee as described in the configuration file.
+type TeeDefinition struct {
+	Address     string
+	Enabled     bool
+	HttpProxy   string
+	Id          string
+	MaxInFlight int
+	Network     string
+	Output      string
+	Overflow    string
+	Sample      float64
+	Tls         *tls.Config
+}
+
+// Tee definitions used when a connection is accepted.  Replaced when the configuration file changes.
+var (
+	teeDefinitions     []TeeDefinition
+	teeDefinitionsLock sync.Mutex
+)
+
+func getTeeDefinitions() []TeeDefinition {
+	teeDefinitionsLock.Lock()
+	defer teeDefinitionsLock.Unlock()
+	return teeDefinitions
+}
+
+func setTeeDefinitions(definitions []TeeDefinition) {
+	teeDefinitionsLock.Lock()
+	defer teeDefinitionsLock.Unlock()
+	teeDefinitions = definitions
+}
+
+// Build a TeeDefinition from one "tee" stanza.
+func newTeeDefinition(id string, stanza map[string]interface{}) TeeDefinition {
+	result := TeeDefinition{
+		Enabled: true,
+		Id:      id,
+		Sample:  1.0,
+	}
+	result.Address, _ = stanza["address"].(string)
+	result.Network, _ = stanza["network"].(string)
+	result.Output, _ = stanza["output"].(string)
+	if httpProxy, ok := stanza["httpproxy"].(map[string]interface{}); ok {
+		result.HttpProxy, _ = httpProxy["address"].(string)
+	}
+	if block, ok := stanza["tls"].(map[string]interface{}); ok {
+		config, err := clientTlsConfig(block)
+		if err != nil {
+			log.Fatalf("tee '%s' tls failed. Err: %+v\n", id, err)
+		}
+		result.Tls = config
+	}
+	if enabled, ok := stanza["enabled"].(bool); ok {
+		result.Enabled = enabled
+	}
+	switch sample := stanza["sample"].(type) {
+	case float64:
+		result.Sample = sample
+	case int:
+		result.Sample = float64(sample)
+	case int64:
+		result.Sample = float64(sample)
+	}
+	if result.Sample < 0 || result.Sample > 1 {
+		log.Printf("tee '%s' sample %v is not between 0.0 and 1.0. Using 1.0\n", id, result.Sample)
+		result.Sample = 1.0
+	}
+	switch maxInFlight := stanza["maxinflight"].(type) {
+	case float64:
+		result.MaxInFlight = int(maxInFlight)
+	case int:
+		result.MaxInFlight = maxInFlight
+	case int64:
+		result.MaxInFlight = int(maxInFlight)
+	}
+	if result.MaxInFlight < 0 {
+		log.Fatalf("tee '%s' maxinflight %d is negative\n", id, result.MaxInFlight)
+	}
+	overflow, _ := stanza["overflow"].(string)
+	result.Overflow = strings.ToLower(overflow)
+	if result.Overflow != "" && result.Overflow != TEE_QUEUE_OVERFLOW_BLOCK && result.Overflow != TEE_QUEUE_OVERFLOW_DROP {
+		log.Fatalf("tee '%s' overflow '%s' is not '%s' or '%s'\n", id, overflow, TEE_QUEUE_OVERFLOW_BLOCK, TEE_QUEUE_OVERFLOW_DROP)
+	}
+	return result
+}
+
+// Read the "tee" configuration of 'config'.
+// As a list of objects with a "name" field, declaration order is preserved.
+// As a map keyed by name, tees are ordered by name so the order is the same from run to run.
+func loadTeeDefinitions(config *viper.Viper) []TeeDefinition {
+	result := []TeeDefinition{}
+	switch stanzas := config.Get("tee").(type) {
+	case []interface{}:
+		for index, value := range stanzas {
+			stanza, ok := value.(map[string]interface{})
+			if !ok {
+				log.Fatalf("tee[%d] is not an object\n", index)
+			}
+			id, _ := stanza["name"].(string)
+			if id == "" {
+				id = fmt.Sprintf("tee-%d", index)
+			}
+			result = append(result, newTeeDefinition(id, stanza))
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(stanzas))
+		for key := range stanzas {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			stanza, ok := stanzas[key].(map[string]interface{})
+			if !ok {
+				log.Fatalf("tee.%s is not an object\n", key)
+			}
+			result = append(result, newTeeDefinition(key, stanza))
+		}
+	}
+	return result
+}
+
+// Counts bytes proxied in both directions and cancels the root context when 'maximum' is reached.
+type ByteLimit struct {
+	cancel  context.CancelFunc
+	count   int64
+	maximum int64
+}
+
+// Limit set by "--maxbytes".  If nil, there is no limit.
+var byteLimit *ByteLimit
+
+func (limit *ByteLimit) add(count int) {
+	if limit == nil {
+		return
+	}
+	total := atomic.AddInt64(&limit.count, int64(count))
+	if total >= limit.maximum && total-int64(count) < limit.maximum {
+		if !viper.GetBool("quiet") {
+			log.Printf("Proxied %d bytes, reaching the limit of %d bytes: shutting down.\n", total, limit.maximum)
+		}
+		limit.cancel()
+	}
 }
 
 type Inbound struct {
 	Address    string
 	Connection net.Conn
-	File       *os.File
+	File       *OutputFile
 	Listener   net.Listener
 	Network    string
 	Output     string
 }
 
 // Make a timestampped "horizontal rule" to separate output into groups.
-func horizontalRule(title string) string {
-	now := time.Now().String()
-	newTitle := fmt.Sprintf("%s %s", now, title)
-	result := "-------- " + newTitle + " " + strings.Repeat("-", 68-len(newTitle))
+// Optional 'fields' (e.g. "latency=1ms") are appended to the title.
+func horizontalRule(title string, fields ...string) string {
+	now := timestamp(time.Now()).Round(0).String() // Round(0) strips the monotonic clock reading.
+	newTitle := strings.Join(append([]string{now, title}, fields...), " ")
+	padding := 68 - len(newTitle)
+	if padding < 8 {
+		padding = 8
+	}
+	result := "-------- " + newTitle + " " + strings.Repeat("-", padding)
 	return result
 }
 
+// Text written after each logged block, from "block.separator".  Default: a blank line.
+func blockSeparator() string {
+	return viper.GetString("block.separator")
+}
+
+// Horizontal rule fields naming the endpoints of the connection a block's bytes traveled, with "block.addresses".
+func addressFields(from net.Addr, to net.Addr) []string {
+	if !viper.GetBool("block.addresses") || from == nil || to == nil {
+		return nil
+	}
+	return []string{fmt.Sprintf("from=%s", from), fmt.Sprintf("to=%s", to)}
+}
+
+// Read "outbound.backpressure" and "outbound.backpressuretimeout".
+func loadBackpressure() (string, time.Duration, error) {
+	policy := strings.ToLower(viper.GetString(BACKPRESSURE))
+	switch policy {
+	case "":
+		policy = BACKPRESSURE_BLOCK
+	case BACKPRESSURE_BLOCK, BACKPRESSURE_DROP, BACKPRESSURE_DISCONNECT:
+	default:
+		return "", 0, fmt.Errorf("%s '%s' is not '%s', '%s', or '%s'", BACKPRESSURE, policy, BACKPRESSURE_BLOCK, BACKPRESSURE_DROP, BACKPRESSURE_DISCONNECT)
+	}
+	timeout := BACKPRESSURE_TIMEOUT_DEFAULT
+	if value := viper.GetString("outbound.backpressuretimeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return "", 0, fmt.Errorf("Bad outbound.backpressuretimeout '%s'. Err: %+v", value, err)
+		}
+		timeout = parsed
+	}
+	return policy, timeout, nil
+}
+
+// Split "network://address" into network and address.  A plain address is "tcp".
+func parseNetworkAddress(value string) (string, string) {
+	if index := strings.Index(value, "://"); index >= 0 {
+		return value[:index], value[index+3:]
+	}
+	return "tcp", value
+}
+
 // Load configuration file.
 func loadConfig(args map[string]interface{}) {
 
 	// Set configuration file path.
 
-	viper.SetConfigName("go-proxy-tee") // name of config file (without extension)
+	configName := "go-proxy-tee" // name of config file (without extension)
+	if configNameParameter := args["--configName"]; configNameParameter != nil {
+		configName = configNameParameter.(string)
+	}
+	viper.SetConfigName(configName)
+	viper.SetDefault("banner", true)
+	viper.SetDefault("block.separator", "\n\n")
+	viper.SetDefault("outbound.passthru", true)
+	viper.SetDefault("inbound.reuseaddr", true)
 
 	// Add paths of where the configuration file may be found. Order is important.  First defined; first used.
 
@@ -104,72 +387,238 @@ func loadConfig(args map[string]interface{}) {
 
 	// Other paths in precedence order.  Order is important.
 
-	viper.AddConfigPath(".")
-	viper.AddConfigPath("$HOME/go/src/github.com/docktermj/go-proxy-tee/")
-	viper.AddConfigPath("$HOME/.go-proxy-tee") // call multiple times to add many search paths
-	viper.AddConfigPath("/etc/go-proxy-tee/")  // path to look for the config file in
+	for _, path := range configpath.Paths() {
+		viper.AddConfigPath(path)
+	}
 
 	// Load configuration contents.
 
+	// Without a configuration file, --listen and --outbound are enough to run.
+
+	isFlagsOnly := args["--listen"] != nil && args["--outbound"] != nil
 	err := viper.ReadInConfig() // Find and read the config file
 	if err != nil {             // Handle errors reading the config file
-		panic(fmt.Errorf("Fatal error config file: %s \n", err))
+		if _, notFound := err.(viper.ConfigFileNotFoundError); !notFound || !isFlagsOnly {
+			panic(fmt.Errorf("Fatal error config file: %s \n", err))
+		}
+		viper.SetDefault("inbound.output", "go-proxy-tee-inbound.txt")
+		viper.SetDefault("outbound.output", "go-proxy-tee-outbound.txt")
 	}
 
 	// Command-line options override configuration file.
 
+	listenParameter := args["--listen"]
+	if listenParameter != nil {
+		network, address := parseNetworkAddress(listenParameter.(string))
+		viper.Set("inbound.network", network)
+		viper.Set("inbound.address", address)
+		commandLineOverrides["inbound.network"] = network
+		commandLineOverrides["inbound.address"] = address
+	}
+
+	outboundParameter := args["--outbound"]
+	if outboundParameter != nil {
+		network, address := parseNetworkAddress(outboundParameter.(string))
+		viper.Set("outbound.network", network)
+		viper.Set("outbound.address", address)
+		commandLineOverrides["outbound.network"] = network
+		commandLineOverrides["outbound.address"] = address
+	}
+
+	// Each --tee replaces the configuration file's tees.  The Nth --tee-output is the Nth tee's output file.
+
+	teeParameters, _ := args["--tee"].([]string)
+	teeOutputParameters, _ := args["--tee-output"].([]string)
+	if len(teeParameters) > 0 {
+		stanzas := []interface{}{}
+		for index, teeParameter := range teeParameters {
+			network, address := parseNetworkAddress(teeParameter)
+			output := fmt.Sprintf("go-proxy-tee-tee-%d.txt", index)
+			if index < len(teeOutputParameters) {
+				output = teeOutputParameters[index]
+			}
+			stanzas = append(stanzas, map[string]interface{}{
+				"address": address,
+				"network": network,
+				"output":  output,
+			})
+		}
+		viper.Set("tee", stanzas)
+		commandLineOverrides["tee"] = stanzas
+	}
+
 	debugParameter := args["--debug"]
 	if debugParameter.(bool) {
 		viper.Set("debug", true)
 	}
 
+	durationParameter := args["--duration"]
+	if durationParameter != nil {
+		viper.Set("limit.duration", durationParameter.(string))
+	}
+
+	maxbytesParameter := args["--maxbytes"]
+	if maxbytesParameter != nil {
+		maxbytes, err := strconv.ParseInt(maxbytesParameter.(string), 10, 64)
+		if err != nil {
+			panic(fmt.Errorf("Bad --maxbytes value '%s': %s \n", maxbytesParameter, err))
+		}
+		viper.Set("limit.maxbytes", maxbytes)
+	}
+
+	watchParameter := args["--watch"]
+	if watchParameter.(bool) {
+		viper.Set("config.watch", true)
+	}
+
+	noPassthruParameter := args["--no-passthru"]
+	if noPassthruParameter.(bool) {
+		viper.Set("outbound.passthru", false)
+	}
+
+	// Quiet suppresses informational output, including debugging messages.
+
+	quietParameter := args["--quiet"]
+	if quietParameter.(bool) {
+		viper.Set("quiet", true)
+		viper.Set("debug", false)
+	}
+
 	formatParameter := args["--format"]
 	if formatParameter != nil {
-		var format string
-		switch strings.ToLower(formatParameter.(string)) {
-		case FORMAT_BINARY_FILE:
-			format = FORMAT_BINARY_FILE
-		case FORMAT_BINARY_XML:
-			format = FORMAT_BINARY_XML
-		case FORMAT_HEX:
-			format = FORMAT_HEX
-		case FORMAT_HEX_PARSED:
-			format = FORMAT_HEX_PARSED
-		case FORMAT_STRING:
-			format = FORMAT_STRING
-		default:
-			format = FORMAT_STRING
+		format := FORMAT_STRING
+		if isFormat(strings.ToLower(formatParameter.(string))) || strings.Contains(formatParameter.(string), ",") {
+			format = strings.ToLower(formatParameter.(string)) // A list is checked by loadFormats().
 		}
 		viper.Set(FORMAT, format)
 	}
 }
 
-// Pretty-print XML.
-func formatXML(data []byte) ([]byte, error) {
-	b := &bytes.Buffer{}
-	decoder := xml.NewDecoder(bytes.NewReader(data))
-	encoder := xml.NewEncoder(b)
-	encoder.Indent("", "   ")
-	for {
-		token, err := decoder.Token()
-		if err == io.EOF {
-			encoder.Flush()
-			return b.Bytes(), nil
-		}
-		if err != nil {
-			return nil, err
+// Reload tee definitions when the configuration file changes.
+// Existing connections keep the tees they were accepted with; newly accepted connections use the new tees.
+// The inbound listener cannot be changed without a restart.
+// The file's directory is watched, so a file replaced by an editor's rename is still seen.
+func watchConfig(ctx context.Context, inbound *Inbound) {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+	fileName := filepath.Clean(viper.ConfigFileUsed())
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Watching configuration file failed. Err: %+v\n", err)
+		return
+	}
+	if err := watcher.Add(filepath.Dir(fileName)); err != nil {
+		log.Printf("Watching configuration file failed. Err: %+v\n", err)
+		watcher.Close()
+		return
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != fileName || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				config, err := readConfigFile()
+				if err != nil {
+					log.Printf("Reading configuration file failed. Keeping the current configuration. Err: %+v\n", err)
+					continue
+				}
+				reloadTees(config, inbound, event.Name)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Watching configuration file failed. Err: %+v\n", err)
+			}
 		}
-		err = encoder.EncodeToken(token)
-		if err != nil {
-			return nil, err
+	}()
+}
+
+// Read the configuration file into a configuration of its own, overridden by the command line as the global one is.
+// Connections read the global configuration as they run, so changing it after Run() starts would race with them.
+func readConfigFile() (*viper.Viper, error) {
+	config := viper.New()
+	config.SetConfigFile(viper.ConfigFileUsed())
+	if err := config.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	for key, value := range commandLineOverrides {
+		config.Set(key, value)
+	}
+	return config, nil
+}
+
+// Replace the tee definitions with those of 'config', just read from 'fileName'.
+func reloadTees(config *viper.Viper, inbound *Inbound, fileName string) {
+	inboundNetwork := config.GetString("inbound.network")
+	inboundAddress := config.GetString("inbound.address")
+	if inboundNetwork != inbound.Network || inboundAddress != inbound.Address {
+		log.Printf("Changing inbound to '%s' network with address '%s' requires a restart. Still listening on '%s' network with address '%s'\n", inboundNetwork, inboundAddress, inbound.Network, inbound.Address)
+	}
+	definitions := loadTeeDefinitions(config)
+	if err := validateNetworks(inbound.Network, config.GetString("outbound.network"), definitions); err != nil {
+		log.Printf("Ignoring configuration change. Err: %+v\n", err)
+		return
+	}
+	setTeeDefinitions(definitions)
+	if !viper.GetBool("quiet") {
+		log.Printf("Reloaded configuration file '%s'. Tee changes apply to new connections.\n", fileName)
+	}
+}
+
+// On SIGHUP, re-read the configuration file, reload tees, and reopen output files.
+// Reopening lets logrotate rename output files without stopping the proxy.
+// Only the tee definitions are taken from the file, see readConfigFile(), and they are swapped under a lock.
+func handleHangup(ctx context.Context, inbound *Inbound) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigc)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigc:
+				if !viper.GetBool("quiet") {
+					log.Println("Caught signal hangup: reloading configuration and reopening output files.")
+				}
+				if config, err := readConfigFile(); err != nil {
+					log.Printf("Reading configuration file failed. Keeping the current configuration. Err: %+v\n", err)
+				} else {
+					reloadTees(config, inbound, config.ConfigFileUsed())
+				}
+				fileCache.reopen()
+			}
 		}
+	}()
+}
+
+// Byte order of the binaryXML frame length, from "binaryxml.byteorder": "big" (default) or "little".
+// An unknown value returns big-endian and an error.
+func binaryXmlByteOrder() (binary.ByteOrder, error) {
+	value := viper.GetString("binaryxml.byteorder")
+	switch strings.ToLower(value) {
+	case "", "big":
+		return binary.BigEndian, nil
+	case "little":
+		return binary.LittleEndian, nil
 	}
+	return binary.BigEndian, fmt.Errorf("binaryxml.byteorder '%s' is not 'big' or 'little'", value)
 }
 
 func hexParseSplit(message []byte) []byte {
 
 	reader := bytes.NewReader(message)
 	splitLength := uint32(len(message))
+	byteOrder, _ := binaryXmlByteOrder() // Validated by Command().
 
 	// Read token.
 
@@ -183,7 +632,7 @@ func hexParseSplit(message []byte) []byte {
 	switch token {
 	case BINARY_XML_START:
 		var messageLength uint32
-		if err := binary.Read(reader, binary.BigEndian, &messageLength); err != nil {
+		if err := binary.Read(reader, byteOrder, &messageLength); err != nil {
 			return message
 		}
 		finalLength := messageLength + BINARY_XML_LENGTHS
@@ -198,68 +647,256 @@ func hexParseSplit(message []byte) []byte {
 
 }
 
-func hexParse(message []byte) string {
+// 'streamOffset' is the position of 'message' in the connection stream. See hexBaseOffset().
+func hexParse(message []byte, streamOffset int) string {
 	result := ""
 	offset := 0
 	for offset < len(message) {
 		slice := hexParseSplit(message[offset:])
-		result = fmt.Sprintf("%s\n%s", result, hex.Dump(slice))
+		result = fmt.Sprintf("%s\n%s", result, hexDumpMessage(slice, hexBaseOffset(streamOffset+offset)))
 		offset += len(slice)
 	}
 	return result
 }
 
-func binaryxmlParse(message []byte) string {
-	result := hex.Dump(message)
+// Time limit for decoding one binaryXML frame, from "decode.timeout".
+func decodeTimeout() time.Duration {
+	value := viper.GetString("decode.timeout")
+	if value == "" {
+		return decode.DEFAULT_TIMEOUT
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Bad decode.timeout '%s'. Using %s. Err: %+v\n", value, decode.DEFAULT_TIMEOUT, err)
+		return decode.DEFAULT_TIMEOUT
+	}
+	return timeout
+}
+
+// Timeouts and panics get a marker in the output; other decode errors are only logged.
+func isDecodeMarked(err error) bool {
+	_, isPanic := err.(*decode.PanicError)
+	return isPanic || err == decode.ErrTimeout
+}
+
+// Log a failed decode.  After a panic, the offending frame is logged in hex.
+func logDecodeFailure(function string, offset int, frame []byte, err error) {
+	log.Printf("%s failed at offset %d. Err: %+v\n", function, offset, err)
+	if _, isPanic := err.(*decode.PanicError); isPanic {
+		log.Printf("Frame at offset %d:\n%s", offset, hexDump(frame, HEX_WIDTH_DEFAULT, 0))
+	}
+}
+
+// 'streamOffset' is the position of 'message' in the connection stream. See hexBaseOffset().
+func binaryxmlParse(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) string {
+	result := hexDump(message, hexWidth(), hexBaseOffset(streamOffset))
+	timeout := decodeTimeout()
 	var param uint8
 	xmlBuffer := make([]byte, BUFFER_LENGTH)
 	offset := 0
 
-	for offset < len(message) {
-		switch message[offset] {
+	// A frame begun in an earlier message is decoded once this message completes it.
+	// Offsets are then positions in 'data', which begins with that frame.
+
+	session := getSession(ctx)
+	pending := session.takeBinaryxmlPending(direction, teeId, streamOffset)
+	data := append(pending, message...)
+	dataOffset := streamOffset - len(pending)
+
+	for offset < len(data) {
+		switch data[offset] {
 		case BINARY_XML_START:
-			reader := bytes.NewReader(message[offset:])
+			if frameLength, ok := binaryxmlFrameLength(data[offset:]); !ok || frameLength > len(data)-offset {
+				result += bufferBinaryxmlFrame(session, direction, teeId, data[offset:], frameLength, streamOffset+len(message), dataOffset+offset)
+				offset = len(data)
+				break
+			}
+			reader := bytes.NewReader(data[offset:])
 			readerOriginalLength := reader.Len()
-			err := messages.ReadMessage(reader, &param, &xmlBuffer)
+			frame := hexParseSplit(data[offset:])
+			err := decode.ReadMessage(ctx, timeout, reader, &param, &xmlBuffer)
 			if err != nil {
-				log.Printf("binaryxml_messages.ReadMessage() failed. Err: %+v\n", err)
+				logDecodeFailure("binaryxml_messages.ReadMessage()", offset, frame, err)
+				if isDecodeMarked(err) {
+					result = fmt.Sprintf("%s\n[%s at offset %d]\n", result, err, offset)
+				}
+
+				// Move on to the next frame, as delimited by the frame's length.
+
+				offset += len(frame)
 				break
 			}
 			readerFinalLength := reader.Len()
-			binaryXmlString, err := binaryxml.ToXML(xmlBuffer)
+			frameOffset := offset
+			offset = offset + (readerOriginalLength - readerFinalLength)
+			binaryXmlString, err := decode.ToXML(ctx, timeout, xmlBuffer)
 			if err != nil {
-				log.Printf("binaryxml.ToXML() failed. Err: %+v\n", err)
+				logDecodeFailure("binaryxml.ToXML()", frameOffset, frame, err)
+				if isDecodeMarked(err) {
+					result = fmt.Sprintf("%s\n[%s at offset %d]\n", result, err, frameOffset)
+				}
 				break
 			}
 			if len(binaryXmlString) > 0 {
-				formattedXML, _ := formatXML([]byte(binaryXmlString))
+				formattedXML, _ := decode.Format([]byte(binaryXmlString), viper.GetBool("xml.compact"))
 				result = fmt.Sprintf("%s\n%s", result, formattedXML)
+			} else if viper.GetBool("binaryxml.reportempty") {
+				log.Printf("binaryxml.ToXML() returned empty XML at offset %d.\n", frameOffset)
+				result = fmt.Sprintf("%s\n[empty XML at offset %d]\n%s", result, frameOffset, hexDump(frame, hexWidth(), hexBaseOffset(dataOffset+frameOffset)))
 			}
-			offset = offset + (readerOriginalLength - readerFinalLength)
 		default:
-			offset = len(message)
+			offset = len(data)
 		}
 	}
 	return result
 }
 
+// Keep the start of a frame cut off by the end of a message, to be decoded with the message at 'nextOffset'.
+// 'frameLength' is the length its prefix claims, and 'frameOffset' its position in the stream.
+// A frame longer than "framing.maxbuffer" is not kept: it is logged as an error, its bytes are written in hex,
+// and parsing starts afresh with the next message.
+func bufferBinaryxmlFrame(session *Session, direction string, teeId string, partial []byte, frameLength int, nextOffset int, frameOffset int) string {
+	if maxBuffer := binaryxmlMaxBuffer(); frameLength > maxBuffer {
+		log.Printf("binaryxml frame at stream offset %d claims %d bytes, more than framing.maxbuffer %d. Not buffering it.\n", frameOffset, frameLength, maxBuffer)
+		return fmt.Sprintf("\n[frame of %d bytes exceeds framing.maxbuffer %d: %d bytes not decoded]\n%s", frameLength, maxBuffer, len(partial), hexDump(partial, hexWidth(), hexBaseOffset(frameOffset)))
+	}
+	session.putBinaryxmlPending(direction, teeId, nextOffset, partial)
+	if frameLength == 0 {
+		return fmt.Sprintf("\n[%d bytes of a frame header, decoded when the frame is complete]\n", len(partial))
+	}
+	return fmt.Sprintf("\n[%d bytes of a %d byte frame, decoded when it is complete]\n", len(partial), frameLength)
+}
+
+// Format of messages in one direction: "inbound.format" for client requests and
+// "outbound.format" for server responses, falling back to "format".
+// Overrides are ignored when "format" is "binaryfile" or "json", which define the layout of whole output files.
+func directionFormat(direction string) string {
+	format := viper.GetString(FORMAT)
+	if format == FORMAT_BINARY_FILE || format == FORMAT_JSON {
+		return format
+	}
+	key := "inbound.format"
+	if direction == DIRECTION_RESPONSE {
+		key = "outbound.format"
+	}
+	if override := strings.ToLower(viper.GetString(key)); override != "" {
+		return override
+	}
+	return format
+}
+
+// Check "inbound.format" and "outbound.format".  They may not be "binaryfile" or "json".
+func validateDirectionFormats() error {
+	for _, key := range []string{"inbound.format", "outbound.format"} {
+		format := strings.ToLower(viper.GetString(key))
+		if format == "" {
+			continue
+		}
+		if !isFormat(format) || format == FORMAT_BINARY_FILE || format == FORMAT_JSON || format == FORMAT_AUTO {
+			return fmt.Errorf("%s '%s' is not 'binaryxml', 'hex', 'hexparsed', 'string', 'http', or 'websocket'", key, format)
+		}
+	}
+	return nil
+}
+
+// Construct output string for logging, according to the format's Encoder.  An unknown format is logged as "string".
+// For FORMAT_BINARY_FILE the result is empty; the raw bytes are written instead.
+func formatMessage(ctx context.Context, format string, direction string, teeId string, message []byte, streamOffset int) string {
+
+	// An external decoder replaces the format.  If it fails, the message is logged in hex.
+
+	if command := decodeCommand(); command != "" && format != FORMAT_BINARY_FILE {
+		decoded, err := externalDecode(ctx, command, message)
+		if err == nil {
+			return decoded
+		}
+		log.Printf("decode.command '%s' failed. Err: %+v\n", command, err)
+		return hexDump(message, hexWidth(), hexBaseOffset(streamOffset))
+	}
+
+	encoder, ok := encoders[format]
+	if !ok {
+		encoder = encoders[FORMAT_STRING]
+	}
+	encoded, err := encoder.Encode(ctx, direction, teeId, message, streamOffset)
+	if err != nil {
+		log.Printf("Encoding as '%s' failed. Err: %+v\n", format, err)
+		return hexDump(message, hexWidth(), hexBaseOffset(streamOffset))
+	}
+	return string(encoded)
+}
+
 // Open a file for writing.
-func openFile(ctx context.Context, fileName string) *os.File {
-	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+// Handles are shared by name and limited by "output.maxopenfiles". See FileCache.
+func openFile(ctx context.Context, fileName string) *OutputFile {
+	file, err := fileCache.open(fileName)
 	if err != nil {
-		panic(err)
+		fatalf("Opening output file failed. Err: %+v\n", err)
 	}
+	file.hold = getTrigger(ctx)
 	return file
 }
 
+// Describe the configuration in comment-style lines.
+func banner() string {
+	lines := []string{
+		fmt.Sprintf("%s started %s", Version, timestamp(startTime).Format(time.RFC3339)),
+		fmt.Sprintf("inbound: '%s' network with address '%s'", viper.GetString("inbound.network"), viper.GetString("inbound.address")),
+		fmt.Sprintf("outbound: '%s' network with address '%s'", viper.GetString("outbound.network"), viper.GetString("outbound.address")),
+	}
+	for _, teeDefinition := range getTeeDefinitions() {
+		lines = append(lines, fmt.Sprintf("tee %s: '%s' network with address '%s'", teeDefinition.Id, teeDefinition.Network, teeDefinition.Address))
+	}
+	lines = append(lines, fmt.Sprintf("format: %s", strings.Join(append([]string{viper.GetString(FORMAT)}, extraFormats...), ", ")))
+	return "# " + strings.Join(lines, "\n# ") + blockSeparator()
+}
+
+// Write the banner at the top of an output file.
+// Suppressed for "binaryfile" format, which must contain only proxied bytes,
+// and for "json" format, which must contain only JSON lines.
+// The file is recorded as a capture file, which gets markers.
+// Each new file gets the banner, so a file shared by connections gets it once.  See FileCache.setBanner().
+func writeBanner(ctx context.Context, file *OutputFile) {
+	file.cache.addCapture(file.name)
+	if !viper.GetBool("banner") || viper.GetString(FORMAT) == FORMAT_BINARY_FILE || viper.GetString(FORMAT) == FORMAT_JSON {
+		return
+	}
+	file.cache.setBanner(file.name, banner())
+	_, _ = file.WriteString("") // Begins a new file with the banner.
+}
+
+// Write comment lines describing a connection, suppressed like the banner.
+func writeComments(ctx context.Context, file *OutputFile, lines []string) {
+	if !viper.GetBool("banner") || viper.GetString(FORMAT) == FORMAT_BINARY_FILE || viper.GetString(FORMAT) == FORMAT_JSON {
+		return
+	}
+	_, _ = file.WriteString("# " + strings.Join(lines, "\n# ") + blockSeparator())
+}
+
+// With "output.raw", open the "<output>.raw" sidecar of a capture file.
+// It gets the proxied bytes, after redaction, as the "binaryfile" format would write them, so they can be replayed.
+func openRawFile(ctx context.Context, file *OutputFile) {
+	if !viper.GetBool("output.raw") || viper.GetString(FORMAT) == FORMAT_BINARY_FILE {
+		return
+	}
+	file.raw = openFile(ctx, file.Name()+".raw")
+	file.raw.isBinary = true
+}
+
 // Convenience method for "Inbound" object.
 func openInputFile(ctx context.Context, inbound *Inbound) {
 	inbound.File = openFile(ctx, inbound.Output)
+	openRawFile(ctx, inbound.File)
+	openExtraFiles(ctx, inbound.File)
+	writeBanner(ctx, inbound.File)
 }
 
 // Convenience method for "Tee" object.
 func openOutputFile(ctx context.Context, tee *Tee) {
 	tee.File = openFile(ctx, tee.Output)
+	openRawFile(ctx, tee.File)
+	openExtraFiles(ctx, tee.File)
+	writeBanner(ctx, tee.File)
 }
 
 // As a server, listen on a port.
@@ -269,67 +906,316 @@ func listen(ctx context.Context, inbound *Inbound) {
 		inbound.Connection.Close()
 	}
 
-	// Inbound listener.  net.Listen creates a server.
+	// Inbound listener.  networkListener.Listen creates a server.
 
-	inboundListener, err := net.Listen(inbound.Network, inbound.Address)
+	inboundListener, err := networkListener.Listen(inbound.Network, inbound.Address)
 	if err != nil {
 		log.Fatal("Listen error: ", err)
 	}
 
-	// Configure listener to exit when program ends.
+	// With "inbound.certfile", clients connect over TLS.
+
+	tlsConfig, err := inboundTlsConfig()
+	if err != nil {
+		log.Fatal("Inbound TLS error: ", err)
+	}
+	if tlsConfig != nil {
+		inboundListener = tls.NewListener(inboundListener, tlsConfig)
+	}
+
+	// Configure listener to close when a signal is caught.
+	// accept() then returns and Command() shuts down, closing connections and files.
+	// A second signal is not caught, so it ends the program immediately.
 
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
 	go func(listener net.Listener, c chan os.Signal) {
 		sig := <-c
-		log.Printf("Caught signal %s: shutting down.\n", sig)
+		signal.Stop(c)
+		if !viper.GetBool("quiet") {
+			log.Printf("Caught signal %s: shutting down.\n", sig)
+		}
 		listener.Close()
-		os.Exit(0)
 	}(inboundListener, sigc)
 
 	inbound.Listener = inboundListener
 }
 
+// Wait for the clients of connections in progress to finish, e.g. after "capture.stopafter" closed the listener.
+// Returns early when 'ctx' is done or on SIGINT or SIGTERM.
+func waitForClients(ctx context.Context, clients *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		clients.Wait()
+		close(done)
+	}()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	select {
+	case <-done:
+	case <-ctx.Done():
+	case <-sigc:
+	}
+}
+
+// Whether 'err' is the result of using a closed listener or connection.
+func isTimeoutError(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func isClosedError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "use of closed network connection")
+}
+
 // As a server, accept a connection request.
 // This is a blocking function.   It waits until client makes a request.
-func accept(ctx context.Context, inbound *Inbound) {
+// An error is returned once the listener is closed, either by a signal or because 'ctx' is done.
+func accept(ctx context.Context, inbound *Inbound) error {
 	isDebug := viper.GetBool("debug")
 
 	inboundConnection, err := inbound.Listener.Accept()
+	for err == nil && !admit(ctx, inboundConnection) {
+		inboundConnection.Close()
+		inboundConnection, err = inbound.Listener.Accept()
+	}
 	if err != nil {
-		log.Fatalf("inbound.Listener.Accept() failed. Err: %+v\n", err)
+		if ctx.Err() != nil || isClosedError(err) {
+			if !viper.GetBool("quiet") {
+				log.Println("Listener closed. No longer accepting connections.")
+			}
+			return err
+		}
+		errorLog.add(ctx, "inbound", fmt.Sprintf("inbound.Listener.Accept() failed. Err: %+v", err))
+		fatalf("inbound.Listener.Accept() failed. Err: %+v\n", err)
 	}
 	if isDebug {
 		log.Println("Accepted inbound connection.")
 	}
 	inbound.Connection = inboundConnection
+	return nil
+}
+
+// Whether to proxy an accepted connection: its address is allowed by "inbound.allow" and "inbound.deny",
+// and it is within "accept.ratelimit", which may delay it.  Rejected connections are logged.
+func admit(ctx context.Context, connection net.Conn) bool {
+	if !addressFilter.allowed(connection.RemoteAddr()) {
+		log.Printf("Rejected connection from %s by inbound.allow/inbound.deny.\n", connection.RemoteAddr())
+		return false
+	}
+	return acceptRateLimit.take(ctx, connection.RemoteAddr())
+}
+
+// Log and exit, like log.Fatalf(), after writing buffered output so files are not truncated.
+func fatalf(format string, values ...interface{}) {
+	fileCache.close()
+	log.Fatalf(format, values...)
+}
+
+// Verify the network types of inbound, outbound, and tees can be used together.
+// Inbound and outbound need a connection-oriented network. Tees may also use a datagram network.
+func validateNetworks(inboundNetwork string, outboundNetwork string, definitions []TeeDefinition) error {
+	if !streamNetworks[inboundNetwork] {
+		return fmt.Errorf("inbound.network '%s' is not supported. Values: tcp, tcp4, tcp6, unix, unixpacket", inboundNetwork)
+	}
+	if !streamNetworks[outboundNetwork] {
+		return fmt.Errorf("outbound.network '%s' is not supported. Values: tcp, tcp4, tcp6, unix, unixpacket", outboundNetwork)
+	}
+	if viper.GetString("outbound.httpproxy.address") != "" && !strings.HasPrefix(outboundNetwork, "tcp") {
+		return fmt.Errorf("outbound httpproxy requires a 'tcp' network, not '%s'", outboundNetwork)
+	}
+	for _, definition := range definitions {
+		if !streamNetworks[definition.Network] && !datagramNetworks[definition.Network] {
+			return fmt.Errorf("tee '%s' network '%s' is not supported. Values: tcp, tcp4, tcp6, unix, unixpacket, udp, udp4, udp6, unixgram", definition.Id, definition.Network)
+		}
+		if definition.HttpProxy != "" && !strings.HasPrefix(definition.Network, "tcp") {
+			return fmt.Errorf("tee '%s' httpproxy requires a 'tcp' network, not '%s'", definition.Id, definition.Network)
+		}
+		if definition.Tls != nil && datagramNetworks[definition.Network] {
+			return fmt.Errorf("tee '%s' tls requires a stream network, not '%s'", definition.Id, definition.Network)
+		}
+	}
+	return nil
 }
 
 // As a client, connect to a service.
+// If the tee's address cannot be reached, its Failover endpoints are tried in order.
+// The endpoint connected to becomes the tee's Network and Address.
+// With a Pool, an idle connection to an endpoint is used before dialing it.
 func connect(ctx context.Context, tee *Tee) {
 	if tee.Connection != nil {
 		tee.Connection.Close()
 	}
-	teeConnection, err := net.Dial(tee.Network, tee.Address)
-	if err != nil {
-		log.Fatal("net.Dial error", err)
+	endpoints := append([]Endpoint{{Address: tee.Address, Network: tee.Network}}, tee.Failover...)
+	for index, endpoint := range endpoints {
+		if pooled := tee.Pool.get(endpoint); pooled != nil {
+			if viper.GetBool("debug") {
+				log.Printf("Reusing pooled connection to '%s' for '%s'\n", endpoint.Address, tee.Id)
+			}
+			tee.Address, tee.Network = endpoint.Address, endpoint.Network
+			tee.Connection = pooled
+			tee.IsDatagram = datagramNetworks[tee.Network]
+			return
+		}
+		teeConnection, err := dial(tee, endpoint)
+		if err != nil {
+			if index == len(endpoints)-1 {
+				errorLog.add(ctx, tee.Id, fmt.Sprintf("Connecting to '%s' for '%s' failed. Err: %+v", endpoint.Address, tee.Id, err))
+				fatalf("Connecting to '%s' for '%s' failed. Err: %+v\n", endpoint.Address, tee.Id, err)
+			}
+			logError(ctx, tee.Id, "Connecting to '%s' for '%s' failed; trying '%s'. Err: %+v\n", endpoint.Address, tee.Id, endpoints[index+1].Address, err)
+			continue
+		}
+		tee.Address, tee.Network = endpoint.Address, endpoint.Network
+		tee.Connection = teeConnection
+		tee.IsDatagram = datagramNetworks[tee.Network]
+		return
+	}
+}
+
+// Connect to one of a tee's endpoints, through its HTTP proxy and with TLS if it has them.
+func dial(tee *Tee, endpoint Endpoint) (net.Conn, error) {
+	var teeConnection net.Conn
+	var err error
+	if tee.HttpProxy != "" {
+		teeConnection, err = dialHttpProxy(tee.HttpProxy, endpoint.Address)
+		if err != nil {
+			return nil, fmt.Errorf("HTTP CONNECT failed: %v", err)
+		}
+	} else {
+		teeConnection, err = networkDialer.Dial(endpoint.Network, endpoint.Address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tee.Tls != nil {
+		teeConnection, err = tlsClient(teeConnection, tee.Tls, endpoint.Address)
+		if err != nil {
+			return nil, fmt.Errorf("TLS handshake failed: %v", err)
+		}
 	}
-	tee.Connection = teeConnection
+	return teeConnection, nil
+}
+
+// Write a message to a tee's network connection.
+// For datagram networks the message is split so that each datagram stays within MAX_DATAGRAM_LENGTH.
+func writeTee(tee Tee, message []byte) (int, error) {
+	if tee.Backpressure != "" && tee.Backpressure != BACKPRESSURE_BLOCK {
+		tee.Connection.SetWriteDeadline(time.Now().Add(tee.BackpressureTimeout))
+		defer tee.Connection.SetWriteDeadline(time.Time{})
+	}
+	if !tee.IsDatagram {
+		return tee.Connection.Write(message)
+	}
+	total := 0
+	for offset := 0; offset < len(message); offset += MAX_DATAGRAM_LENGTH {
+		end := offset + MAX_DATAGRAM_LENGTH
+		if end > len(message) {
+			end = len(message)
+		}
+		count, err := tee.Connection.Write(message[offset:end])
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
 }
 
 // Append a Tee to a list of Tees.
 // Also, open the output file and connect to service.
 func appendTee(ctx context.Context, tees []Tee, tee Tee) []Tee {
 	openOutputFile(ctx, &tee)
+	tee.LogLimit = newLogLimit()
+	if mode, _ := framing(); mode == FRAMING_TRANSACTION {
+		tee.Transaction = &Transaction{file: tee.File}
+	}
 	connect(ctx, &tee)
 	return append(tees, tee)
 }
 
+// Bytes to inject from a configuration key.
+// A value beginning with "hex:" is decoded as hex.  Otherwise the string's bytes are used.
+func injectionBytes(key string) []byte {
+	value := viper.GetString(key)
+	if strings.HasPrefix(value, "hex:") {
+		result, err := hex.DecodeString(strings.TrimPrefix(value, "hex:"))
+		if err != nil {
+			log.Fatalf("Bad %s value '%s'. Err: %+v\n", key, value, err)
+		}
+		return result
+	}
+	return []byte(value)
+}
+
+// Send bytes that did not come from either peer, e.g. a handshake the client does not perform.
+// The bytes are logged to 'tee's file with a distinct title.
+// For FORMAT_BINARY_FILE, the raw bytes are written to 'rawFile', the file recording that direction.
+func inject(ctx context.Context, connection net.Conn, message []byte, tee Tee, rawFile *OutputFile, title string, direction string) error {
+	if len(message) == 0 {
+		return nil
+	}
+	if _, err := connection.Write(message); err != nil {
+		return err
+	}
+	rawFile.writeRaw(message)
+	format := directionFormat(direction)
+	if format == FORMAT_AUTO {
+		format = detectFormat(message) // Injected bytes do not fix the connection's format.
+	}
+	outString := formatMessage(ctx, format, direction, tee.Id, message, 0)
+	header := horizontalRule(title, addressFields(connection.LocalAddr(), connection.RemoteAddr())...)
+	extras := extraOutlines(ctx, header, title, tee.Id, direction, 0, time.Now(), message, 0)
+	rawFile.writeExtras(extras, true)
+	tee.File.writeExtras(extras, false)
+	if len(outString) > 0 {
+		outline := fmt.Sprintf("%s\n%s%s", header, outString, blockSeparator())
+		if format == FORMAT_JSON {
+			outline = jsonLine(ctx, time.Now(), title, tee.Id, direction, 0, message)
+		}
+		_, _ = tee.File.WriteString(outline)
+		sink.send(tee.Id, header, outString)
+		combined.send(tee.Id, outline)
+	} else {
+		_, _ = rawFile.Write(message)
+	}
+	return nil
+}
+
+// Connections, like *net.TCPConn and *net.UnixConn, that can be closed in one direction.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Shut down the writing side of a connection, passing an end-of-file along while still reading.
+func closeWrite(connection net.Conn) {
+	closer, ok := connection.(closeWriter)
+	if !ok {
+		return
+	}
+	if err := closer.CloseWrite(); err != nil {
+		log.Printf("CloseWrite() failed. Err: %+v\n", err)
+	}
+}
+
 // One-way proxy from inbound (tee) to outbound.
 // 'prefix' and network message are written to 'outFile'.
 func proxy(ctx context.Context, tee Tee, outbound Inbound, prefix string) {
+	defer recoverConnection(ctx, tee.Id, outbound.Connection, []Tee{tee})
 	isDebug := viper.GetBool("debug")
+	isHalfClose := viper.GetBool("halfclose")
+	isJson := directionFormat(DIRECTION_RESPONSE) == FORMAT_JSON
+	isCorrelated := isJson || isExtraFormat(FORMAT_JSON)
+	isZeroCopy := zeroCopy(DIRECTION_RESPONSE)
+	trigger := getTrigger(ctx)
+	isLatency := viper.GetBool("latency")
+	isSinkOnly := sink != nil && viper.GetBool("output.sinkonly")
 	byteBuffer := make([]byte, BUFFER_LENGTH)
+	totalBytesRead := 0
+	addresses := addressFields(tee.Connection.RemoteAddr(), tee.Connection.LocalAddr())
+	defer tee.Transaction.flush()
+	defer tee.Comparison.end(compareSide(tee))
 
 	// Read-write loop.
 
@@ -339,49 +1225,91 @@ func proxy(ctx context.Context, tee Tee, outbound Inbound, prefix string) {
 
 		numberOfBytesRead, err := tee.Connection.Read(byteBuffer)
 		if err != nil {
-			log.Printf("tee.Connection.Read(...) failed. Err: %+v\n", err)
+			if tee.Pool.returned(tee.Connection) {
+				return
+			}
+			logError(ctx, tee.Id, "tee.Connection.Read(...) failed. Err: %+v\n", err)
+			if err == io.EOF && tee.PassThru && isHalfClose {
+				closeWrite(outbound.Connection)
+			}
 			return
 		}
-
-		message := make([]byte, numberOfBytesRead)
-		copy(message, byteBuffer[0:numberOfBytesRead])
+		pause.wait(ctx)
+		stats.add(tee.Id, DIRECTION_RESPONSE, numberOfBytesRead)
+		getSession(ctx).addBytes(DIRECTION_RESPONSE, tee.Id, numberOfBytesRead)
+		readTime := time.Now()
+
+		message := readMessage(byteBuffer, numberOfBytesRead, isZeroCopy)
+		trigger.check(message)
+
+		// Remove sensitive bytes before anything is logged.
+
+		message = redactor.redact(message)
+		streamOffset := totalBytesRead
+		totalBytesRead += numberOfBytesRead
+		messageIndex.add(ctx, readTime, DIRECTION_RESPONSE, tee.Id, streamOffset, message)
+		tee.Comparison.add(ctx, compareSide(tee), message)
+		tee.File.writeRaw(message)
+		if version, ok := schemaPath.detect(ctx, message); ok {
+			writeComments(ctx, tee.File, []string{"schema: " + version})
+		}
 
 		// Construct output string for logging.
 
-		var outString string
-		switch viper.Get(FORMAT) {
-		case FORMAT_BINARY_FILE:
-			outString = ""
-		case FORMAT_BINARY_XML:
-			outString = binaryxmlParse(message)
-		case FORMAT_HEX:
-			outString = hex.Dump(message)
-		case FORMAT_HEX_PARSED:
-			outString = hexParse(message)
-		case FORMAT_STRING:
-			outString = string(message)
-		default:
-			outString = string(message)
+		format := connectionFormat(ctx, DIRECTION_RESPONSE, message)
+		outString := formatMessage(ctx, format, DIRECTION_RESPONSE, tee.Id, message, streamOffset)
+		frames := typedFrames(ctx, format, message)
+		fields := append(append([]string{}, addresses...), getSession(ctx).schemaFields()...)
+		if tee.PassThru && isLatency {
+			if latency, ok := getSession(ctx).latency(readTime); ok {
+				fields = append(fields, fmt.Sprintf("latency=%s", latency))
+			}
 		}
+		title := horizontalRule(prefix, fields...)
+
+		// The primary server answers requests in order; other tees are paired with the latest request.
+
+		corrId := uint64(0)
+		if isCorrelated {
+			corrId = getSession(ctx).requestId()
+			if tee.PassThru {
+				corrId = getSession(ctx).responseId()
+			}
+		}
+		extras := extraOutlines(ctx, title, prefix, tee.Id, DIRECTION_RESPONSE, corrId, readTime, message, streamOffset)
+		tee.File.writeExtras(extras, true)
+		tee.File.writeExtras(extras, false)
 
 		// Log message to file.
 
 		if len(outString) > 0 {
-			outline := fmt.Sprintf("%s\n%s\n\n", horizontalRule(prefix), outString)
-			_, _ = tee.File.WriteString(outline)
-		} else {
-			_, _ = tee.File.Write(byteBuffer[0:numberOfBytesRead])
+			outline := fmt.Sprintf("%s\n%s%s", title, outString, blockSeparator())
+			if isJson {
+				outline = jsonLine(ctx, readTime, prefix, tee.Id, DIRECTION_RESPONSE, corrId, message)
+			}
+			if !isSinkOnly && tee.LogLimit.allow(tee.File, len(outline)) && !writeTypedFrames(ctx, tee.File, title, frames) {
+				if tee.Transaction != nil {
+					tee.Transaction.response(outline)
+				} else {
+					_, _ = tee.File.WriteString(outline)
+				}
+			}
+			sink.send(tee.Id, title, outString)
+			combined.send(tee.Id, outline)
+		} else if tee.LogLimit.allow(tee.File, len(message)) {
+			_, _ = tee.File.Write(message)
 		}
 
 		// If PassThru, write to outbound network connection.
 
 		if tee.PassThru {
+			byteLimit.add(numberOfBytesRead)
 			if isDebug {
 				log.Printf("Bytes returned by proxy: %d\n", numberOfBytesRead)
 			}
 			_, err := outbound.Connection.Write(byteBuffer[0:numberOfBytesRead])
 			if err != nil {
-				log.Printf("outbound.Write() failed. Err: %+v\n", err)
+				logError(ctx, "inbound", "outbound.Write() failed. Err: %+v\n", err)
 				return
 			}
 		}
@@ -390,8 +1318,38 @@ func proxy(ctx context.Context, tee Tee, outbound Inbound, prefix string) {
 
 // One-way proxy from inbound to multiple outbounds via 'tees'
 func proxyTee(ctx context.Context, inbound Inbound, tees []Tee, prefix string) {
+	defer recoverConnection(ctx, "inbound", inbound.Connection, tees)
 	isDebug := viper.GetBool("debug")
+	isHalfClose := viper.GetBool("halfclose")
+	isJson := directionFormat(DIRECTION_REQUEST) == FORMAT_JSON
+	isCorrelated := isJson || isExtraFormat(FORMAT_JSON)
+	isZeroCopy := zeroCopy(DIRECTION_REQUEST)
+	trigger := getTrigger(ctx)
+	isLatency := viper.GetBool("latency")
+	isSinkOnly := sink != nil && viper.GetBool("output.sinkonly")
 	byteBuffer := make([]byte, BUFFER_LENGTH)
+	totalBytesRead := 0
+	addresses := addressFields(inbound.Connection.RemoteAddr(), inbound.Connection.LocalAddr())
+	maxFirstMessage, _ := loadMaxFirstMessage() // Validated by Run().
+
+	// Tees other than the primary server, tees[0], may be written by goroutines of their own.
+	// The primary server is always written in this loop, so it is never dropped.
+
+	queues := map[string]*TeeQueue{}
+	queueLength, isQueueDrop, _ := loadTeeQueue() // Validated by Run().
+	if len(tees) > 1 {
+		for _, tee := range tees[1:] {
+			if length, isDrop, ok := teeQueueConfig(tee, queueLength, isQueueDrop); ok {
+				queues[tee.Id] = startTeeQueue(ctx, inbound, tee, length, isDrop)
+			}
+		}
+	}
+	stopQueues := func() {
+		for _, queue := range queues {
+			queue.stop()
+		}
+	}
+	defer stopQueues()
 
 	// Read-write loop.
 
@@ -401,112 +1359,325 @@ func proxyTee(ctx context.Context, inbound Inbound, tees []Tee, prefix string) {
 
 		numberOfBytesRead, err := inbound.Connection.Read(byteBuffer)
 		if err != nil {
-			log.Printf("inbound.Connection.Read() failed. Err: %+v\n", err)
+			logError(ctx, "inbound", "inbound.Connection.Read() failed. Err: %+v\n", err)
+			if err == io.EOF && isHalfClose {
+				stopQueues()
+				for _, tee := range tees {
+					closeWrite(tee.Connection)
+				}
+			}
 			return
 		}
 
+		// Drop a client whose first message is too long, before any of it is decoded or sent.
+
+		if totalBytesRead == 0 && maxFirstMessage > 0 && numberOfBytesRead > maxFirstMessage {
+			log.Printf("First message from %s has %d bytes, more than inbound.maxfirstmessage %d. Connection closed.\n", inbound.Connection.RemoteAddr(), numberOfBytesRead, maxFirstMessage)
+			closeConnections(inbound.Connection, tees)
+			return
+		}
+		pause.wait(ctx)
+
 		if isDebug {
 			log.Printf("Bytes sent to proxy: %d\n", numberOfBytesRead)
 		}
+		byteLimit.add(numberOfBytesRead)
+		stats.add("inbound", DIRECTION_REQUEST, numberOfBytesRead)
+		getSession(ctx).addBytes(DIRECTION_REQUEST, "inbound", numberOfBytesRead)
+		readTime := time.Now()
+		if isLatency {
+			getSession(ctx).addRequest(readTime)
+		}
+
+		message := readMessage(byteBuffer, numberOfBytesRead, isZeroCopy)
+		trigger.check(message)
 
-		message := make([]byte, numberOfBytesRead)
-		copy(message, byteBuffer[0:numberOfBytesRead])
+		// Remove sensitive bytes before anything is logged.
+
+		message = redactor.redact(message)
+		streamOffset := totalBytesRead
+		totalBytesRead += numberOfBytesRead
+		messageIndex.add(ctx, readTime, DIRECTION_REQUEST, "inbound", streamOffset, message)
+		if version, ok := schemaPath.detect(ctx, message); ok {
+			for _, tee := range tees {
+				writeComments(ctx, tee.File, []string{"schema: " + version})
+			}
+		}
 
 		// Construct output string for logging.
 
-		var outString string
-		switch viper.Get(FORMAT) {
-		case FORMAT_BINARY_FILE:
-			outString = ""
+		format := connectionFormat(ctx, DIRECTION_REQUEST, message)
+		outString := formatMessage(ctx, format, DIRECTION_REQUEST, "inbound", message, streamOffset)
+		frames := typedFrames(ctx, format, message)
+		if format == FORMAT_BINARY_FILE {
 			inbound.File.Write(message)
-		case FORMAT_BINARY_XML:
-			outString = binaryxmlParse(message)
-		case FORMAT_HEX:
-			outString = hex.Dump(message)
-		case FORMAT_HEX_PARSED:
-			outString = hexParse(message)
-		case FORMAT_STRING:
-			outString = string(message)
-		default:
-			outString = string(message)
 		}
+		inbound.File.writeRaw(message)
 
 		// Construct the message for logging.
 
-		outline := fmt.Sprintf("%s\n%s\n\n", horizontalRule(prefix), outString)
+		title := horizontalRule(prefix, append(append([]string{}, addresses...), getSession(ctx).schemaFields()...)...)
+		outline := fmt.Sprintf("%s\n%s%s", title, outString, blockSeparator())
+		corrId := uint64(0)
+		if isCorrelated {
+			corrId = getSession(ctx).nextRequestId()
+		}
+		if isJson {
+			outline = jsonLine(ctx, readTime, prefix, "inbound", DIRECTION_REQUEST, corrId, message)
+		}
+		extras := extraOutlines(ctx, title, prefix, "inbound", DIRECTION_REQUEST, corrId, readTime, message, streamOffset)
+		inbound.File.writeExtras(extras, true)
+		if len(outString) > 0 {
+			sink.send("inbound", title, outString)
+			combined.send("inbound", outline)
+		}
 
 		// Process each tee as outbound.
 
+		delivery := TeeDelivery{
+			extras:   extras,
+			frames:   frames,
+			isLogged: len(outString) > 0 && !isSinkOnly,
+			outline:  outline,
+			payload:  byteBuffer[0:numberOfBytesRead],
+			title:    title,
+		}
 		for _, tee := range tees {
+			if queue, ok := queues[tee.Id]; ok {
+				queued := delivery
+				queued.payload = append([]byte{}, delivery.payload...)
+				queue.send(queued)
+				continue
+			}
+			if !deliver(ctx, inbound, tee, delivery) {
+				return
+			}
+		}
+	}
+}
 
-			// Log message to tee's file.
+// Log a client request to a tee's file and write it to the tee's network connection.
+// Returns false if the client connection should end.
+func deliver(ctx context.Context, inbound Inbound, tee Tee, delivery TeeDelivery) bool {
 
-			if len(outString) > 0 {
-				_, _ = tee.File.WriteString(outline)
-			}
+	// Log message to tee's file.
 
-			// Write to tee's outbound network connection.
+	if delivery.isLogged && tee.LogLimit.allow(tee.File, len(delivery.outline)) && !writeTypedFrames(ctx, tee.File, delivery.title, delivery.frames) {
+		if tee.Transaction != nil {
+			tee.Transaction.request(delivery.outline)
+		} else {
+			_, _ = tee.File.WriteString(delivery.outline)
+		}
+	}
+	tee.File.writeExtras(delivery.extras, false)
 
-			_, err := tee.Connection.Write(byteBuffer[0:numberOfBytesRead])
-			if err != nil {
-				log.Printf("tee.Connection.Write() failed. Err: %+v\n", err)
-				return
-			}
+	// Write to tee's outbound network connection.
+	// Datagrams may be lost, so a failed datagram write does not end the connection.
+
+	_, err := writeTee(tee, delivery.payload)
+	if err != nil {
+		stats.addError(tee.Id)
+		if isTimeoutError(err) && tee.Backpressure == BACKPRESSURE_DROP {
+			logError(ctx, tee.Id, "Write to '%s' timed out. Message dropped.\n", tee.Id)
+			return true
+		}
+		if isTimeoutError(err) && tee.Backpressure == BACKPRESSURE_DISCONNECT {
+			logError(ctx, tee.Id, "Write to '%s' timed out. Disconnecting client.\n", tee.Id)
+			inbound.Connection.Close()
+			return false
 		}
+		logError(ctx, tee.Id, "tee.Connection.Write() failed. Err: %+v\n", err)
+		return tee.IsDatagram
 	}
+	return true
 }
 
 // Function for the "command pattern".
 func Command(argv []string) {
+	Run(context.Background(), nil)
+}
+
+// Print the configuration in effect after merging the configuration file, environment, and command-line options.
+func printConfig() {
+	contents, err := json.MarshalIndent(viper.AllSettings(), "", "  ")
+	if err != nil {
+		log.Fatalf("json.MarshalIndent() failed. Err: %+v\n", err)
+	}
+	fmt.Println(string(contents))
+}
+
+// Run the proxy until 'ctx' is done, a signal is caught, or a limit is reached.
+// 'argv' is parsed as the command line, e.g. []string{"net", "--configPath=/tmp"}; if nil, os.Args is used.
+func Run(parentCtx context.Context, argv []string) {
 
 	usage := `
 Usage:
-    go-proxy-tee net [options]
+    go-proxy-tee net [options] [--tee=<address>]... [--tee-output=<file>]...
 
 Options:
    -h, --help
+   --configName=<name>                 Configuration file name without extension. Default: 'go-proxy-tee'
    --configPath=<configuration_path>   Directory of go-proxy-tee.json configuration file
-   --format=<format>                   Output format.
+   --format=<format>                   Output format, or a comma-separated list of formats.
    --debug                             Log debugging messages
+   --duration=<duration>               Stop after running for this long
+   --listen=<address>                  Inbound address, overriding inbound.network and inbound.address
+   --maxbytes=<count>                  Stop after proxying this many bytes
+   --no-passthru                       Log primary server responses without returning them to the client
+   --outbound=<address>                Primary server address, overriding outbound.network and outbound.address
+   --print-config                      Print the effective configuration as JSON and exit
+   --quiet                             Suppress informational output; errors are still logged
+   --strict                            Refuse to start if the configuration has keys that are not used, such as misspellings
+   --tee=<address>                     Additional server address, replacing configured tees. Repeatable.
+   --tee-output=<file>                 Output file of the matching --tee. Repeatable.
+   --watch                             Apply configuration file changes to new connections
 
 Where:
    configuration_path   Example: '/path/to/configuration'
-   format               Values: 'binaryfile', 'binaryxml', 'hex', 'hexparsed', and default value: 'string'.
+   format               Values: 'binaryfile', 'binaryxml', 'hex', 'hexparsed', 'json', and default value: 'string'.
+   duration             Example: '30s', '5m', '1h'
+   count                Bytes in both directions. Example: '1048576'
+   address              'host:port' for tcp, or 'network://address'. Example: 'unix:///tmp/socket'
+
+With --listen and --outbound, no configuration file is needed.
 `
 
 	// Create context.
 
-	ctx, cancel := context.WithCancel(context.Background())
+	startTime = time.Now()
+	ctx, cancel := context.WithCancel(parentCtx)
 	defer cancel()
 
 	// DocOpt processing.
 
-	args, _ := docopt.Parse(usage, nil, true, "", false)
+	args, _ := docopt.Parse(usage, argv, true, "", false)
 
 	// Get configuration.
 
 	loadConfig(args)
+	if args["--print-config"].(bool) {
+		printConfig()
+		return
+	}
+	if args["--strict"].(bool) {
+		if err := checkKeys(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := loadFormats(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTimezone(); err != nil {
+		log.Fatal(err)
+	}
 	inboundNetwork := viper.GetString("inbound.network")
 	inboundAddress := viper.GetString("inbound.address")
 	inboundOutput := viper.GetString("inbound.output")
 	outboundNetwork := viper.GetString("outbound.network")
 	outboundAddress := viper.GetString("outbound.address")
 	outboundOutput := viper.GetString("outbound.output")
+	isPassThru := viper.GetBool("outbound.passthru")
+	backpressure, backpressureTimeout, err := loadBackpressure()
+	if err != nil {
+		log.Fatal(err)
+	}
+	outboundTls, err := outboundTlsConfig()
+	if err != nil {
+		log.Fatalf("outbound.tls failed. Err: %+v\n", err)
+	}
 	isDebug := viper.GetBool("debug")
-	teeDefinitions := viper.GetStringMap("tee")
+	isQuiet := viper.GetBool("quiet")
+	setTeeDefinitions(loadTeeDefinitions(viper.GetViper()))
+	redactor = loadRedactor()
+	schemaPath, err = loadSchemaPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	addressFilter = loadAddressFilter()
+	fileCache.setCapacity(viper.GetInt("output.maxopenfiles"))
+	if err := loadTimeBucket(fileCache); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadLineEnding(fileCache); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadMkdir(fileCache); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadFifo(fileCache); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadStdoutBuffering(fileCache); err != nil {
+		log.Fatal(err)
+	}
+	startBuffering(ctx, fileCache)
+	if err := startDiskLimit(ctx, fileCache); err != nil {
+		log.Fatal(err)
+	}
+	defer fileCache.close()
+	mode, err := fileMode()
+	if err != nil {
+		log.Fatal(err)
+	}
+	isPerConnection := mode == FILE_MODE_PERCONNECTION
+	if _, err := binaryXmlByteOrder(); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateDirectionFormats(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := framing(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := splitByTypeMode(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := protobufPrefix(); err != nil {
+		log.Fatal(err)
+	}
+	if _, _, err := loadTeeQueue(); err != nil {
+		log.Fatal(err)
+	}
+	compareTee, compareMode, err := loadCompare()
+	if err != nil {
+		log.Fatal(err)
+	}
+	routes, err := loadRoutes()
+	if err != nil {
+		log.Fatal(err)
+	}
+	failover, err := loadFailover()
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool, err := loadPool()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessionMaxDuration, err := loadSessionMaxDuration()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := loadMaxFirstMessage(); err != nil {
+		log.Fatal(err)
+	}
+	acceptRateLimit, err = loadRateLimit()
+	if err != nil {
+		log.Fatal(err)
+	}
+	outboundPreamble := injectionBytes("outbound.preamble")
+	inboundGreeting := injectionBytes("inbound.greeting")
+	if err := validateNetworks(inboundNetwork, outboundNetwork, getTeeDefinitions()); err != nil {
+		log.Fatal(err)
+	}
 
 	// Debugging information.
 
 	if isDebug {
 		log.Printf("Listening on '%s' network with address '%s' into file '%s'\n", inboundNetwork, inboundAddress, inboundOutput)
 		log.Printf("Communicating with '%s' network with address '%s' into file '%s'\n", outboundNetwork, outboundAddress, outboundOutput)
-		teeDefinitions := viper.GetStringMap("tee")
-		for key, _ := range teeDefinitions {
-			teeDefinition := teeDefinitions[key].(map[string]interface{})
-			teeNetwork := teeDefinition["network"].(string)
-			teeAddress := teeDefinition["address"].(string)
-			teeOutput := teeDefinition["output"].(string)
-			log.Printf("Tee-ing to '%s' network with address '%s' into file '%s'\n", teeNetwork, teeAddress, teeOutput)
+		for _, teeDefinition := range getTeeDefinitions() {
+			log.Printf("Tee-ing to '%s' network with address '%s' into file '%s'\n", teeDefinition.Network, teeDefinition.Address, teeDefinition.Output)
 		}
 		log.Printf("Formatting output as '%s'\n", viper.GetString(FORMAT))
 	}
@@ -518,55 +1689,273 @@ Where:
 		Network: inboundNetwork,
 		Output:  inboundOutput,
 	}
+
+	// Stop when the duration or byte limit is reached.
+
+	if duration := viper.GetString("limit.duration"); duration != "" {
+		timeout, err := time.ParseDuration(duration)
+		if err != nil {
+			log.Fatalf("Bad duration '%s'. Err: %+v\n", duration, err)
+		}
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if maxbytes := viper.GetInt64("limit.maxbytes"); maxbytes > 0 {
+		byteLimit = &ByteLimit{
+			cancel:  cancel,
+			maximum: maxbytes,
+		}
+	}
+
+	capture, err = loadCapture(func() { inbound.Listener.Close() })
+	if err != nil {
+		log.Fatal(err)
+	}
 	listen(ctx, &inbound)
-	openInputFile(ctx, &inbound)
-	defer inbound.File.Close()
+	if !isPerConnection {
+		openInputFile(ctx, &inbound)
+		defer inbound.File.Close()
+	}
+	sink = startSink(ctx)
+	combined = startCombined(ctx)
+	stats = startStats(ctx)
+	messageIndex = startIndex(ctx)
+	errorLog = startErrorLog(ctx)
+	health = startHealth(ctx)
+	defer combined.stop()
+
+	// At shutdown, connections are closed first.  Then their goroutines may finish writing what they read.
+
+	var connections sync.WaitGroup
+	var clients sync.WaitGroup // Client halves of the connections.
+	defer func() {
+		done := make(chan struct{})
+		go func() {
+			connections.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(SHUTDOWN_TIMEOUT):
+			log.Printf("Connections did not finish within %s of shutdown.\n", SHUTDOWN_TIMEOUT)
+		}
+	}()
+
+	// After the root context ends, close the listener so accept() returns.
+
+	go func() {
+		<-ctx.Done()
+		if !isQuiet && ctx.Err() == context.DeadlineExceeded {
+			log.Printf("Ran for %s: shutting down.\n", viper.GetString("limit.duration"))
+		}
+		inbound.Listener.Close()
+	}()
+
+	if viper.GetBool("config.watch") {
+		watchConfig(ctx, &inbound)
+	}
+	handleHangup(ctx, &inbound)
+	handleMarkerSignal(ctx)
+	handlePauseSignal(ctx)
+	if control := startControl(ctx); control != nil {
+		defer control.Close()
+	}
 
 	// As a server, Read and Echo loop.
 
+	var connectionNumber uint64
 	for {
 		tees := []Tee{}
 
 		// As a server, listen for a connection request. This is blocking.
 
-		accept(ctx, &inbound)
+		if err := accept(ctx, &inbound); err != nil {
+			if capture.isStopped() {
+				waitForClients(ctx, &clients)
+			}
+			break
+		}
+		stats.addConnection()
+
+		// With TLS, a client that fails the handshake (e.g. without a valid certificate) is dropped.
+
+		tlsState, err := handshake(inbound.Connection)
+		if err != nil {
+			logError(ctx, "inbound", "TLS handshake failed. Err: %+v\n", err)
+			inbound.Connection.Close()
+			continue
+		}
+		identity := clientIdentity(tlsState)
+		details := tlsDetails(tlsState)
+		if details != "" && !isQuiet {
+			log.Printf("TLS from %s: %s\n", inbound.Connection.RemoteAddr(), details)
+		}
+		if identity != "" && !isQuiet {
+			log.Printf("Accepted client %s\n", identity)
+		}
+
+		// With "routes", the client's server name chooses the primary server.
+
+		connectionOutboundNetwork, connectionOutboundAddress, connectionOutboundOutput := outboundNetwork, outboundAddress, outboundOutput
+		connectionFailover := failover
+		if route, ok := findRoute(routes, tlsState); ok {
+			connectionOutboundNetwork, connectionOutboundAddress = route.Network, route.Address
+			connectionFailover = nil
+			if route.Output != "" {
+				connectionOutboundOutput = route.Output
+			}
+			if isDebug {
+				log.Printf("Routing server name '%s' to '%s' network with address '%s'\n", tlsState.ServerName, route.Network, route.Address)
+			}
+		}
 
 		// Create a "per-connection" context.
+		// With "capture.trigger", the connection's output is held until its traffic matches.
 
-		connectionCtx, connectionCtxCancel := context.WithCancel(ctx)
+		connectionNumber++
+		connectionCtx, connectionCtxCancel := context.WithCancel(withTrigger(withSession(ctx, connectionNumber), capture.newTrigger()))
 		defer connectionCtxCancel()
 
-		// Add "outbound" to tees with PassThru=true.
+		// With "file.mode: perconnection", each connection gets its own files.
+
+		acceptTime := time.Now()
+		outputName := func(name string) string {
+			if isPerConnection {
+				return connectionFileName(name, connectionNumber, acceptTime)
+			}
+			return name
+		}
+		connectionInbound := inbound
+		if isPerConnection {
+			connectionInbound.Output = outputName(inbound.Output)
+			openInputFile(connectionCtx, &connectionInbound)
+		} else if inbound.File != nil {
+			connectionInbound.File = inbound.File.heldBy(getTrigger(connectionCtx))
+		}
+
+		// Add "outbound" to tees with PassThru=true, unless "outbound.passthru" is false.
 
 		tee := Tee{
-			Address:  outboundAddress,
-			Id:       "outbound",
-			Network:  outboundNetwork,
-			Output:   outboundOutput,
-			PassThru: true,
+			Address:             connectionOutboundAddress,
+			Backpressure:        backpressure,
+			BackpressureTimeout: backpressureTimeout,
+			Failover:            connectionFailover,
+			HttpProxy:           viper.GetString("outbound.httpproxy.address"),
+			Id:                  "outbound",
+			Network:             connectionOutboundNetwork,
+			Output:              outputName(connectionOutboundOutput),
+			PassThru:            isPassThru,
+			Pool:                pool,
+			Tls:                 outboundTls,
 		}
 		tees = appendTee(connectionCtx, tees, tee)
 
+		// Inject configured bytes before any client bytes are proxied.
+
+		if err := inject(connectionCtx, tees[0].Connection, outboundPreamble, tees[0], connectionInbound.File, "Injected outbound preamble", DIRECTION_REQUEST); err != nil {
+			logError(connectionCtx, tees[0].Id, "Writing outbound.preamble failed. Err: %+v\n", err)
+		}
+		if err := inject(connectionCtx, connectionInbound.Connection, inboundGreeting, tees[0], tees[0].File, "Injected inbound greeting", DIRECTION_RESPONSE); err != nil {
+			logError(connectionCtx, "inbound", "Writing inbound.greeting failed. Err: %+v\n", err)
+		}
+
 		// Add tees from configuration file.
 
-		for key, _ := range teeDefinitions {
-			teeDefinition := teeDefinitions[key].(map[string]interface{})
+		for _, teeDefinition := range getTeeDefinitions() {
+			if !teeDefinition.Enabled {
+				continue
+			}
+			if !health.useTee(teeDefinition.Id) {
+				if isDebug {
+					log.Printf("Tee '%s' skipped: unreachable at its last health probe.\n", teeDefinition.Id)
+				}
+				continue
+			}
+
+			// Sampling is per connection: the tee gets all or none of a connection's traffic.
+
+			if teeDefinition.Sample < 1.0 && rand.Float64() >= teeDefinition.Sample {
+				if isDebug {
+					log.Printf("Tee '%s' not sampled for this connection.\n", teeDefinition.Id)
+				}
+				continue
+			}
 			tee := Tee{
-				Address: teeDefinition["address"].(string),
-				Id:      key,
-				Network: teeDefinition["network"].(string),
-				Output:  teeDefinition["output"].(string),
+				Address:     teeDefinition.Address,
+				HttpProxy:   teeDefinition.HttpProxy,
+				Id:          teeDefinition.Id,
+				MaxInFlight: teeDefinition.MaxInFlight,
+				Network:     teeDefinition.Network,
+				Output:      outputName(teeDefinition.Output),
+				Overflow:    teeDefinition.Overflow,
+				Tls:         teeDefinition.Tls,
 			}
 			tees = appendTee(connectionCtx, tees, tee)
 		}
 
+		// Optionally compare the primary server's responses with those of "compare.tee".
+
+		if compareTee != "" {
+			for index := range tees {
+				if tees[index].Id == compareTee {
+					comparison := newComparison(connectionCtx, compareTee, compareMode)
+					tees[0].Comparison = comparison
+					tees[index].Comparison = comparison
+				}
+			}
+		}
+
+		// Optionally record the TLS parameters and verified client in each of the connection's files.
+
+		comments := []string{}
+		if details != "" && viper.GetBool("inbound.tlsbanner") {
+			comments = append(comments, "tls: "+details)
+		}
+		if identity != "" && viper.GetBool("inbound.identitybanner") {
+			comments = append(comments, "client: "+identity)
+		}
+		if len(comments) > 0 {
+			writeComments(connectionCtx, connectionInbound.File, comments)
+			for _, tee := range tees {
+				writeComments(connectionCtx, tee.File, comments)
+			}
+		}
+
 		// Asynchronously handle bi-directional traffic.
 
-		defer inbound.Connection.Close()
-		go proxyTee(connectionCtx, inbound, tees, "Client request")
+		// Per-connection file handles are released when the client is done.
+		// A late server response reopens its file in append mode.
+
+		defer connectionInbound.Connection.Close()
+		connections.Add(1 + len(tees))
+		clients.Add(1)
+		sessionDone := make(chan struct{})
+		limitSession(connectionCtx, connectionCtxCancel, sessionDone, sessionMaxDuration, connectionInbound.Connection, tees)
+		go func(connectionInbound Inbound, tees []Tee) {
+			defer connections.Done()
+			defer clients.Done()
+			proxyTee(connectionCtx, connectionInbound, tees, "Client request")
+			close(sessionDone)
+			for _, tee := range tees {
+				tee.Transaction.flush()
+			}
+
+			// With "outbound.pool", the primary server's connection is kept for a later client.
+
+			tees[0].Pool.release(tees[0])
+			if isPerConnection {
+				connectionInbound.File.Close()
+				for _, tee := range tees {
+					tee.File.Close()
+				}
+			}
+		}(connectionInbound, tees)
 		for _, tee := range tees {
 			defer tee.Connection.Close()
-			go proxy(connectionCtx, tee, inbound, "Server response")
+			go func(tee Tee) {
+				defer connections.Done()
+				proxy(connectionCtx, tee, connectionInbound, "Server response")
+			}(tee)
 		}
 	}
 }
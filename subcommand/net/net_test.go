@@ -0,0 +1,482 @@
+package net
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+/*
+ * The unit tests in this file use an in-memory network instead of binding ports.
+ */
+
+// An in-memory network.  Each Dial() creates a net.Pipe() whose server end is returned by Accept().
+type pipeNetwork struct {
+	connections chan net.Conn
+	done        chan struct{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func newPipeNetwork() *pipeNetwork {
+	return &pipeNetwork{
+		connections: make(chan net.Conn),
+		done:        make(chan struct{}),
+	}
+}
+
+func (network *pipeNetwork) Listen(networkName string, address string) (net.Listener, error) {
+	return network, nil
+}
+
+func (network *pipeNetwork) Dial(networkName string, address string) (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case network.connections <- server:
+		return client, nil
+	case <-network.done:
+		return nil, errors.New("pipe network closed")
+	}
+}
+
+func (network *pipeNetwork) Accept() (net.Conn, error) {
+	select {
+	case connection := <-network.connections:
+		return connection, nil
+	case <-network.done:
+		return nil, errors.New("use of closed network connection")
+	}
+}
+
+func (network *pipeNetwork) Close() error {
+	close(network.done)
+	return nil
+}
+
+func (network *pipeNetwork) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Replace the real network for the duration of a test.
+func usePipeNetwork(test *testing.T) *pipeNetwork {
+	network := newPipeNetwork()
+	savedDialer, savedListener := networkDialer, networkListener
+	networkDialer, networkListener = network, network
+	test.Cleanup(func() {
+		networkDialer, networkListener = savedDialer, savedListener
+	})
+	return network
+}
+
+func tempFile(test *testing.T) *OutputFile {
+	file := openFile(context.Background(), filepath.Join(test.TempDir(), "go-proxy-tee.txt"))
+	test.Cleanup(func() { file.Close() })
+	return file
+}
+
+func readString(test *testing.T, connection net.Conn, length int) string {
+	buffer := make([]byte, length)
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(connection, buffer); err != nil {
+		test.Fatal(err)
+	}
+	return string(buffer)
+}
+
+func readFile(test *testing.T, file *OutputFile) string {
+	contents, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		test.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestListenAcceptConnect(test *testing.T) {
+	usePipeNetwork(test)
+	ctx := context.Background()
+
+	inbound := Inbound{Network: "tcp", Address: "in-memory"}
+	listen(ctx, &inbound)
+	defer inbound.Listener.Close()
+
+	clientConnection := make(chan net.Conn)
+	go func() {
+		connection, _ := networkDialer.Dial("tcp", "in-memory")
+		clientConnection <- connection
+	}()
+	if err := accept(ctx, &inbound); err != nil {
+		test.Fatal(err)
+	}
+	client := <-clientConnection
+
+	go client.Write([]byte("ping"))
+	if got := readString(test, inbound.Connection, 4); got != "ping" {
+		test.Errorf("accepted connection read %q, want %q", got, "ping")
+	}
+
+	tee := Tee{Network: "tcp", Address: "in-memory"}
+	go func() {
+		server, _ := inbound.Listener.Accept()
+		server.Write([]byte("pong"))
+	}()
+	connect(ctx, &tee)
+	if got := readString(test, tee.Connection, 4); got != "pong" {
+		test.Errorf("connected tee read %q, want %q", got, "pong")
+	}
+}
+
+func TestProxyTee(test *testing.T) {
+	viper.Set(FORMAT, FORMAT_STRING)
+	client, inboundConnection := net.Pipe()
+	teeConnection, server := net.Pipe()
+	file := tempFile(test)
+
+	done := make(chan struct{})
+	go func() {
+		proxyTee(context.Background(), Inbound{Connection: inboundConnection}, []Tee{{Connection: teeConnection, File: file, Id: "test"}}, "Client request")
+		close(done)
+	}()
+
+	go client.Write([]byte("hello"))
+	if got := readString(test, server, 5); got != "hello" {
+		test.Errorf("tee received %q, want %q", got, "hello")
+	}
+	client.Close()
+	<-done
+
+	contents := readFile(test, file)
+	if !strings.Contains(contents, "Client request") || !strings.Contains(contents, "hello") {
+		test.Errorf("tee file missing client request: %q", contents)
+	}
+}
+
+func TestProxyPassThru(test *testing.T) {
+	viper.Set(FORMAT, FORMAT_STRING)
+	client, inboundConnection := net.Pipe()
+	teeConnection, server := net.Pipe()
+	file := tempFile(test)
+
+	done := make(chan struct{})
+	go func() {
+		proxy(context.Background(), Tee{Connection: teeConnection, File: file, Id: "outbound", PassThru: true}, Inbound{Connection: inboundConnection}, "Server response")
+		close(done)
+	}()
+
+	go server.Write([]byte("world"))
+	if got := readString(test, client, 5); got != "world" {
+		test.Errorf("client received %q, want %q", got, "world")
+	}
+	server.Close()
+	<-done
+
+	contents := readFile(test, file)
+	if !strings.Contains(contents, "Server response") || !strings.Contains(contents, "world") {
+		test.Errorf("tee file missing server response: %q", contents)
+	}
+}
+
+// A format registered as third-party decoders are: it decodes as "string", except that it panics,
+// as a decoder bug would, on a message of PANIC_MESSAGE.
+const (
+	FORMAT_PANIC  = "panictest"
+	PANIC_MESSAGE = "panic"
+)
+
+func init() {
+	RegisterEncoder(FORMAT_PANIC, EncoderFunc(func(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) ([]byte, error) {
+		if string(message) == PANIC_MESSAGE {
+			panic("decoder bug")
+		}
+		return encoders[FORMAT_STRING].Encode(ctx, direction, teeId, message, streamOffset)
+	}))
+}
+
+func TestRunRecoversPanic(test *testing.T) {
+
+	// Clients dial 'clients', which Run() listens on.  Run() dials the server on 'servers'.
+
+	clients, servers := newPipeNetwork(), newPipeNetwork()
+	savedDialer, savedListener := networkDialer, networkListener
+	networkDialer, networkListener = servers, clients
+	directory := test.TempDir()
+	viper.Reset() // Settings of earlier tests would override the configuration file.
+	test.Cleanup(func() {
+		networkDialer, networkListener = savedDialer, savedListener
+		viper.Reset()
+		for key := range commandLineOverrides {
+			delete(commandLineOverrides, key)
+		}
+	})
+	config := `{
+		"format": "` + FORMAT_PANIC + `",
+		"inbound": {"address": "clients", "network": "tcp", "output": "` + filepath.ToSlash(filepath.Join(directory, "inbound.txt")) + `"},
+		"outbound": {"address": "servers", "network": "tcp", "output": "` + filepath.ToSlash(filepath.Join(directory, "outbound.txt")) + `"}
+	}`
+	if err := ioutil.WriteFile(filepath.Join(directory, "go-proxy-tee.json"), []byte(config), 0600); err != nil {
+		test.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		Run(ctx, []string{"net", "--configPath=" + directory, "--quiet"})
+		close(stopped)
+	}()
+	connect := func() (net.Conn, net.Conn) {
+		client, err := clients.Dial("tcp", "clients")
+		if err != nil {
+			test.Fatal(err)
+		}
+		server, err := servers.Accept()
+		if err != nil {
+			test.Fatal(err)
+		}
+		return client, server
+	}
+
+	// The connection whose decoder panics is closed.
+
+	client, server := connect()
+	go client.Write([]byte(PANIC_MESSAGE))
+	for name, connection := range map[string]net.Conn{"client": client, "server": server} {
+		connection.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := connection.Read(make([]byte, 1)); err != io.EOF && !errors.Is(err, io.ErrClosedPipe) {
+			test.Errorf("%s connection not closed after the panic. Err: %v", name, err)
+		}
+	}
+
+	// The server keeps accepting, proxying, and logging other connections.
+
+	client, server = connect()
+	go client.Write([]byte("hello"))
+	if got := readString(test, server, 5); got != "hello" {
+		test.Errorf("server received %q after the panic, want %q", got, "hello")
+	}
+	go server.Write([]byte("world"))
+	if got := readString(test, client, 5); got != "world" {
+		test.Errorf("client received %q after the panic, want %q", got, "world")
+	}
+	select {
+	case <-stopped:
+		test.Fatal("Run() returned after a connection panicked")
+	default:
+	}
+	client.Close()
+	server.Close()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		test.Fatal("Run() did not return when its context ended")
+	}
+	contents := readFile(test, &OutputFile{name: filepath.Join(directory, "outbound.txt")})
+	if !strings.Contains(contents, "hello") || !strings.Contains(contents, "world") {
+		test.Errorf("server file missing the connection after the panic: %q", contents)
+	}
+}
+
+func TestHexDumpMatchesDefault(test *testing.T) {
+	data := []byte{}
+	for length := 0; length < 40; length++ {
+		if got, want := hexDump(data, HEX_WIDTH_DEFAULT, 0), hex.Dump(data); got != want {
+			test.Errorf("hexDump() of %d bytes:\n%s\nwant:\n%s", length, got, want)
+		}
+		data = append(data, byte(length*7))
+	}
+}
+
+func TestHexDumpWidth(test *testing.T) {
+	got := hexDump([]byte("0123456789"), 8, 0x100)
+	want := "00000100  30 31 32 33 34 35 36 37  |01234567|\n" +
+		"00000108  38 39                    |89|\n"
+	if got != want {
+		test.Errorf("hexDump() width 8:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFileCacheReopensEvicted(test *testing.T) {
+	directory := test.TempDir()
+	cache := newFileCache(1)
+	first, err := cache.open(filepath.Join(directory, "first.txt"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	second, err := cache.open(filepath.Join(directory, "second.txt"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	for _, file := range []*OutputFile{first, second, first, second} {
+		if _, err := file.WriteString(filepath.Base(file.Name()) + "\n"); err != nil {
+			test.Fatal(err)
+		}
+		if cache.order.Len() != 1 {
+			test.Errorf("%d handles open, want 1", cache.order.Len())
+		}
+	}
+	if got, want := readFile(test, first), "first.txt\nfirst.txt\n"; got != want {
+		test.Errorf("first file is %q, want %q", got, want)
+	}
+}
+
+func TestFileCacheBannerBeginsEachNewFile(test *testing.T) {
+	directory := test.TempDir()
+	name := filepath.Join(directory, "capture.txt")
+	cache := newFileCache(0)
+	for _, text := range []string{"one\n", "two\n"} {
+		file, err := cache.open(name)
+		if err != nil {
+			test.Fatal(err)
+		}
+		cache.setBanner(name, "# banner\n")
+		if _, err := file.WriteString(text); err != nil {
+			test.Fatal(err)
+		}
+	}
+	if got, want := readFile(test, &OutputFile{name: name}), "# banner\none\ntwo\n"; got != want {
+		test.Errorf("shared file is %q, want %q", got, want)
+	}
+
+	// After a rename and reopen, as by logrotate and SIGHUP, the recreated file gets the banner too.
+
+	if err := os.Rename(name, name+".1"); err != nil {
+		test.Fatal(err)
+	}
+	cache.reopen()
+	file, err := cache.open(name)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if _, err := file.WriteString("three\n"); err != nil {
+		test.Fatal(err)
+	}
+	if got, want := readFile(test, file), "# banner\nthree\n"; got != want {
+		test.Errorf("recreated file is %q, want %q", got, want)
+	}
+}
+
+func TestDiskDeleteKeepsFilesStillWritten(test *testing.T) {
+	directory := test.TempDir()
+	cache := newFileCache(1)
+	first, err := cache.open(filepath.Join(directory, "first.txt"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	second, err := cache.open(filepath.Join(directory, "second.txt"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	first.WriteString("12345678\n")
+	second.WriteString("x\n") // Evicts the handle of 'first', which is still written.
+	cache.disk = &DiskLimit{maximum: 10, policy: DISK_POLICY_DELETE}
+	cache.checkDisk()
+	if _, err := os.Stat(first.Name()); err != nil {
+		test.Errorf("file still written was deleted: %v", err)
+	}
+	first.Close()
+	cache.checkDisk()
+	if _, err := os.Stat(first.Name()); !os.IsNotExist(err) {
+		test.Errorf("closed file was not deleted: %v", err)
+	}
+}
+
+func TestComparisonResetsDivergedSides(test *testing.T) {
+	file, err := newFileCache(0).open(filepath.Join(test.TempDir(), "compare.txt"))
+	if err != nil {
+		test.Fatal(err)
+	}
+	comparison := &Comparison{file: file, mode: COMPARE_MODE_BYTES, teeId: "mirror"}
+	comparison.add(context.Background(), COMPARE_PRIMARY, make([]byte, COMPARE_MAX_BUFFERED+1))
+	if len(comparison.pending[COMPARE_PRIMARY]) != 0 {
+		test.Errorf("%d bytes still held", len(comparison.pending[COMPARE_PRIMARY]))
+	}
+	if got := readFile(test, file); !strings.Contains(got, "Sides diverged") {
+		test.Errorf("compare file is %q", got)
+	}
+}
+
+func TestWebsocketHeaderSplitAcrossMessages(test *testing.T) {
+	ctx := withSession(context.Background(), 1)
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x81, 0x80 | 5}, mask...)
+	for index, value := range []byte("hello") {
+		frame = append(frame, value^mask[index%4])
+	}
+	websocketParse(ctx, DIRECTION_REQUEST, "inbound", frame[:3], 0)
+	got := websocketParse(ctx, DIRECTION_REQUEST, "inbound", frame[3:], 3)
+	if !strings.Contains(got, "opcode=text") || !strings.Contains(got, "hello") {
+		test.Errorf("frame completed by the second message is:\n%s", got)
+	}
+}
+
+func TestHttpStreamsOfTeesAreSeparate(test *testing.T) {
+	ctx := withSession(context.Background(), 1)
+	partial := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nab"
+	httpParse(ctx, DIRECTION_RESPONSE, "outbound", []byte(partial), 0)
+	if got := httpParse(ctx, DIRECTION_RESPONSE, "mirror", []byte("cde"), len(partial)); strings.Contains(got, "ab") {
+		test.Errorf("response of 'mirror' continues the one of 'outbound':\n%s", got)
+	}
+	if got := httpParse(ctx, DIRECTION_RESPONSE, "outbound", []byte("cde"), len(partial)); !strings.Contains(got, "abcde") {
+		test.Errorf("completed response of 'outbound' is:\n%s", got)
+	}
+}
+
+// A connection that reads 'reads' copies of 'payload', then EOF.  Writes are discarded.
+type repeatConn struct {
+	net.Conn
+	payload []byte
+	reads   int
+}
+
+func (connection *repeatConn) Read(buffer []byte) (int, error) {
+	if connection.reads <= 0 {
+		return 0, io.EOF
+	}
+	connection.reads--
+	return copy(buffer, connection.payload), nil
+}
+
+func (connection *repeatConn) Write(buffer []byte) (int, error) { return len(buffer), nil }
+func (connection *repeatConn) Close() error                     { return nil }
+func (connection *repeatConn) LocalAddr() net.Addr              { return pipeAddr{} }
+func (connection *repeatConn) RemoteAddr() net.Addr             { return pipeAddr{} }
+
+// Compare allocations per read with and without "performance.zerocopy".
+func BenchmarkProxy(benchmark *testing.B) {
+	payload := []byte(strings.Repeat("go-proxy-tee benchmark ", 512))
+	for _, isZeroCopy := range []bool{false, true} {
+		name := "copy"
+		if isZeroCopy {
+			name = "zerocopy"
+		}
+		benchmark.Run(name, func(benchmark *testing.B) {
+			viper.Set(FORMAT, FORMAT_STRING)
+			viper.Set("performance.zerocopy", isZeroCopy)
+			defer viper.Set("performance.zerocopy", false)
+			file := openFile(context.Background(), filepath.Join(benchmark.TempDir(), "go-proxy-tee.txt"))
+			defer file.Close()
+			tee := Tee{
+				Connection: &repeatConn{payload: payload, reads: benchmark.N},
+				File:       file,
+				Id:         "outbound",
+				PassThru:   true,
+			}
+			benchmark.ReportAllocs()
+			benchmark.SetBytes(int64(len(payload)))
+			benchmark.ResetTimer()
+			proxy(context.Background(), tee, Inbound{Connection: &repeatConn{}}, "Server response")
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package net
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// Forwarding, stopped and started by SIGUSR2, e.g. to examine a server's state mid-session.
+// While paused, each message read is held, and neither logged nor forwarded, until forwarding resumes.
+// Clients and servers stay connected; once their socket buffers fill, their writes block.
+type Pause struct {
+	isPaused bool
+	lock     sync.Mutex
+	resumed  chan struct{} // Closed when forwarding resumes.
+}
+
+var pause = &Pause{}
+
+// Pause forwarding, or resume it if paused.  A marker is written to every capture file.
+func (pause *Pause) toggle() {
+	pause.lock.Lock()
+	if pause.isPaused {
+		pause.isPaused = false
+		close(pause.resumed)
+	} else {
+		pause.isPaused = true
+		pause.resumed = make(chan struct{})
+	}
+	isPaused := pause.isPaused
+	pause.lock.Unlock()
+	if isPaused {
+		log.Printf("Forwarding paused. Send SIGUSR2 again to resume.\n")
+		writeMarker("Forwarding paused")
+	} else {
+		log.Printf("Forwarding resumed.\n")
+		writeMarker("Forwarding resumed")
+	}
+}
+
+// Block while forwarding is paused, or until 'ctx' ends.
+func (pause *Pause) wait(ctx context.Context) {
+	pause.lock.Lock()
+	if !pause.isPaused {
+		pause.lock.Unlock()
+		return
+	}
+	resumed := pause.resumed
+	pause.lock.Unlock()
+	select {
+	case <-resumed:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package net
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// On SIGUSR2, pause forwarding, or resume it.
+func handlePauseSignal(ctx context.Context) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(sigc)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigc:
+				pause.toggle()
+			}
+		}
+	}()
+}
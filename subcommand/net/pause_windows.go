@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package net
+
+import "context"
+
+// Windows has no SIGUSR2, so forwarding cannot be paused.
+func handlePauseSignal(ctx context.Context) {
+}
@@ -0,0 +1,25 @@
+package net
+
+import (
+	"github.com/spf13/viper"
+)
+
+// Whether messages read in 'direction' may be logged straight from the read buffer, without a copy,
+// with "performance.zerocopy".  Not for "binaryxml" or with "index.csv": a binaryXML decode that
+// times out keeps reading its bytes after the read buffer is reused.
+func zeroCopy(direction string) bool {
+	if !viper.GetBool("performance.zerocopy") || messageIndex != nil {
+		return false
+	}
+	return directionFormat(direction) != FORMAT_BINARY_XML
+}
+
+// The bytes read into 'byteBuffer', copied unless 'isZeroCopy'.
+func readMessage(byteBuffer []byte, numberOfBytesRead int, isZeroCopy bool) []byte {
+	if isZeroCopy {
+		return byteBuffer[0:numberOfBytesRead]
+	}
+	message := make([]byte, numberOfBytesRead)
+	copy(message, byteBuffer[0:numberOfBytesRead])
+	return message
+}
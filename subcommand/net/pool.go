@@ -0,0 +1,148 @@
+package net
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Defaults for "outbound.pool".
+const (
+	POOL_MAX_IDLE_DEFAULT     = 4
+	POOL_IDLE_TIMEOUT_DEFAULT = time.Minute
+
+	// How long a pooled connection is read to check that the server has not closed it.
+
+	POOL_PROBE_TIMEOUT = time.Millisecond
+)
+
+// Idle connections to primary servers, kept for later client connections.
+// Only safe for protocols without per-connection state.
+type Pool struct {
+	ended       map[net.Conn]bool             // Connections whose proxy() ended before they were released.
+	idle        map[string][]pooledConnection // By "network://address".
+	idleTimeout time.Duration
+	lock        sync.Mutex
+	maxIdle     int
+	releasing   map[net.Conn]string // Connections being returned, to the key they are returned under.
+}
+
+type pooledConnection struct {
+	connection net.Conn
+	since      time.Time
+}
+
+// Read "outbound.pool", "outbound.poolmaxidle", and "outbound.poolidletimeout".  Returns nil if connections are not pooled.
+func loadPool() (*Pool, error) {
+	if !viper.GetBool("outbound.pool") {
+		return nil, nil
+	}
+	if viper.GetBool("halfclose") {
+		return nil, fmt.Errorf("outbound.pool cannot be used with halfclose, which closes the connection's writing side")
+	}
+	maxIdle := POOL_MAX_IDLE_DEFAULT
+	if viper.IsSet("outbound.poolmaxidle") {
+		maxIdle = viper.GetInt("outbound.poolmaxidle")
+		if maxIdle <= 0 {
+			return nil, fmt.Errorf("outbound.poolmaxidle %d is not greater than 0", maxIdle)
+		}
+	}
+	idleTimeout := POOL_IDLE_TIMEOUT_DEFAULT
+	if value := viper.GetString("outbound.poolidletimeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("bad outbound.poolidletimeout '%s'. Err: %+v", value, err)
+		}
+		idleTimeout = parsed
+	}
+	return &Pool{
+		ended:       map[net.Conn]bool{},
+		idle:        map[string][]pooledConnection{},
+		idleTimeout: idleTimeout,
+		maxIdle:     maxIdle,
+		releasing:   map[net.Conn]string{},
+	}, nil
+}
+
+func poolKey(endpoint Endpoint) string {
+	return endpoint.Network + "://" + endpoint.Address
+}
+
+// An idle connection to 'endpoint', or nil if there is none.
+// Connections idle too long, closed by the server, or with unexpected bytes waiting are closed and skipped.
+func (pool *Pool) get(endpoint Endpoint) net.Conn {
+	if pool == nil {
+		return nil
+	}
+	key := poolKey(endpoint)
+	for {
+		pool.lock.Lock()
+		idle := pool.idle[key]
+		if len(idle) == 0 {
+			pool.lock.Unlock()
+			return nil
+		}
+		pooled := idle[len(idle)-1]
+		pool.idle[key] = idle[:len(idle)-1]
+		pool.lock.Unlock()
+		if time.Since(pooled.since) < pool.idleTimeout && isIdle(pooled.connection) {
+			return pooled.connection
+		}
+		pooled.connection.Close()
+	}
+}
+
+// Whether a connection is open with nothing to read.
+func isIdle(connection net.Conn) bool {
+	connection.SetReadDeadline(time.Now().Add(POOL_PROBE_TIMEOUT))
+	defer connection.SetReadDeadline(time.Time{})
+	_, err := connection.Read(make([]byte, 1))
+	return err != nil && isTimeoutError(err)
+}
+
+// Start returning a tee's connection to the pool when its client disconnects.
+// The tee's proxy() is stopped by a read deadline and completes the return with returned().
+// A connection whose proxy() has already ended, because the server closed it or failed, is not pooled.
+func (pool *Pool) release(tee Tee) {
+	if pool == nil || tee.Connection == nil {
+		return
+	}
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.ended[tee.Connection] {
+		delete(pool.ended, tee.Connection)
+		return
+	}
+	pool.releasing[tee.Connection] = poolKey(Endpoint{Address: tee.Address, Network: tee.Network})
+	tee.Connection.SetReadDeadline(time.Now())
+}
+
+// Called by proxy() when a read fails.  If the connection is being released, it is added to the pool
+// and true is returned.  The connection is closed instead if the pool is full.
+func (pool *Pool) returned(connection net.Conn) bool {
+	if pool == nil {
+		return false
+	}
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	key, ok := pool.releasing[connection]
+	if !ok {
+		pool.ended[connection] = true
+		return false
+	}
+	delete(pool.releasing, connection)
+	connection.SetReadDeadline(time.Time{})
+	if len(pool.idle[key]) >= pool.maxIdle {
+		connection.Close()
+		return true
+	}
+	pool.idle[key] = append(pool.idle[key], pooledConnection{connection: connection, since: time.Now()})
+	if viper.GetBool("debug") {
+		log.Printf("Returned connection to '%s' to the pool. %d idle.\n", key, len(pool.idle[key]))
+	}
+	return true
+}
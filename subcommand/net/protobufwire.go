@@ -0,0 +1,241 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+)
+
+// Length prefixes of the "protobufwire" format, from "protobufwire.prefix".
+const (
+	PROTOBUF_PREFIX_GRPC   = "grpc"   // A compressed-flag byte, then a 4-byte big-endian length, as in gRPC.
+	PROTOBUF_PREFIX_UINT32 = "uint32" // A 4-byte big-endian length.
+	PROTOBUF_PREFIX_VARINT = "varint" // A varint length, as written by writeDelimitedTo().  Default.
+)
+
+// Protocol buffer wire types.
+const (
+	PROTOBUF_WIRE_VARINT  = 0
+	PROTOBUF_WIRE_FIXED64 = 1
+	PROTOBUF_WIRE_BYTES   = 2
+	PROTOBUF_WIRE_START   = 3 // Start of a group.
+	PROTOBUF_WIRE_END     = 4 // End of a group.
+	PROTOBUF_WIRE_FIXED32 = 5
+)
+
+const (
+	PROTOBUF_MAX_BUFFERED    = 1024 * 1024 * 16 // Largest message buffered until it is complete.
+	PROTOBUF_MAX_DEPTH       = 32               // Deepest nesting of messages decoded.
+	PROTOBUF_INDENT          = "  "
+	PROTOBUF_PRINTABLE_RATIO = 0.9 // Share of printable characters for a length-delimited field to be shown as text.
+)
+
+// Read "protobufwire.prefix".
+func protobufPrefix() (string, error) {
+	prefix := strings.ToLower(viper.GetString("protobufwire.prefix"))
+	switch prefix {
+	case "":
+		return PROTOBUF_PREFIX_VARINT, nil
+	case PROTOBUF_PREFIX_GRPC, PROTOBUF_PREFIX_UINT32, PROTOBUF_PREFIX_VARINT:
+		return prefix, nil
+	}
+	return "", fmt.Errorf("protobufwire.prefix '%s' is not '%s', '%s', or '%s'", prefix, PROTOBUF_PREFIX_VARINT, PROTOBUF_PREFIX_UINT32, PROTOBUF_PREFIX_GRPC)
+}
+
+// Read the length prefix at the start of 'data'.  Returns the prefix's length and the message's length,
+// or false if 'data' is too short to hold the prefix.  An invalid varint returns a length of -1.
+func readProtobufPrefix(prefix string, data []byte) (int, int, bool) {
+	switch prefix {
+	case PROTOBUF_PREFIX_GRPC:
+		if len(data) < 5 {
+			return 0, 0, false
+		}
+		return 5, int(binary.BigEndian.Uint32(data[1:5])), true
+	case PROTOBUF_PREFIX_UINT32:
+		if len(data) < 4 {
+			return 0, 0, false
+		}
+		return 4, int(binary.BigEndian.Uint32(data[0:4])), true
+	}
+	length, prefixLength := binary.Uvarint(data)
+	switch {
+	case prefixLength == 0:
+		return 0, 0, false
+	case prefixLength < 0 || length > math.MaxInt32:
+		return len(data), -1, true
+	}
+	return prefixLength, int(length), true
+}
+
+// 'streamOffset' is the position of 'message' in the connection stream.
+// Each length-prefixed message is logged with a header giving its length, then its fields, without a schema:
+// each field's number, wire type, and value.  Length-delimited fields are shown as text if printable,
+// as a nested message if they decode as one, otherwise in hex.
+// A message cut off by the end of the read is buffered and logged in the block of the read that completes it.
+func protobufParse(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) string {
+	prefix, _ := protobufPrefix() // Validated by Run().
+	session := getSession(ctx)
+	pending := session.takeProtobufPending(direction, teeId, streamOffset)
+	nextOffset := streamOffset + len(message)
+	data := append(pending, message...)
+	dataOffset := nextOffset - len(data)
+
+	var result strings.Builder
+	offset := 0
+	for offset < len(data) {
+		prefixLength, length, ok := readProtobufPrefix(prefix, data[offset:])
+		if ok && length < 0 {
+			fmt.Fprintf(&result, "[protobufwire: bad %s length prefix: %d bytes not decoded]\n", prefix, len(data)-offset)
+			result.WriteString(hexDump(data[offset:], hexWidth(), hexBaseOffset(dataOffset+offset)))
+			break
+		}
+		if ok && length > PROTOBUF_MAX_BUFFERED {
+			fmt.Fprintf(&result, "[protobufwire: message of %d bytes exceeds %d: %d bytes not decoded]\n", length, PROTOBUF_MAX_BUFFERED, len(data)-offset)
+			result.WriteString(hexDump(data[offset:], hexWidth(), hexBaseOffset(dataOffset+offset)))
+			break
+		}
+		if !ok || len(data)-offset < prefixLength+length {
+			fmt.Fprintf(&result, "[protobufwire: %d bytes of an incomplete message, logged when it is complete]\n", len(data)-offset)
+			session.putProtobufPending(direction, teeId, nextOffset, data[offset:])
+			break
+		}
+		body := data[offset+prefixLength : offset+prefixLength+length]
+		fmt.Fprintf(&result, "[protobufwire message: %d bytes]\n", length)
+		if described, ok := describeProtobuf(body, "", 0); ok {
+			result.WriteString(described)
+		} else {
+			result.WriteString("[not protobuf wire format]\n")
+			result.WriteString(hexDump(body, hexWidth(), hexBaseOffset(dataOffset+offset+prefixLength)))
+		}
+		offset += prefixLength + length
+	}
+	return result.String()
+}
+
+// Describe the fields of a message, one per line, each line beginning with 'indent'.
+// Returns false unless all of 'data' is well-formed fields.
+func describeProtobuf(data []byte, indent string, depth int) (string, bool) {
+	if depth > PROTOBUF_MAX_DEPTH {
+		return "", false
+	}
+	var result strings.Builder
+	groups := []uint64{} // Field numbers of the groups begun and not yet ended.
+	offset := 0
+	for offset < len(data) {
+		tag, length := binary.Uvarint(data[offset:])
+		if length <= 0 || tag>>3 == 0 {
+			return "", false
+		}
+		offset += length
+		field := tag >> 3
+		groupIndent := indent + strings.Repeat(PROTOBUF_INDENT, len(groups))
+		switch tag & 7 {
+		case PROTOBUF_WIRE_VARINT:
+			value, length := binary.Uvarint(data[offset:])
+			if length <= 0 {
+				return "", false
+			}
+			offset += length
+			fmt.Fprintf(&result, "%s%d varint: %d", groupIndent, field, value)
+			if signed := int64(value); signed < 0 {
+				fmt.Fprintf(&result, " (int64 %d)", signed)
+			}
+			result.WriteString("\n")
+		case PROTOBUF_WIRE_FIXED64:
+			if len(data)-offset < 8 {
+				return "", false
+			}
+			value := binary.LittleEndian.Uint64(data[offset : offset+8])
+			offset += 8
+			fmt.Fprintf(&result, "%s%d fixed64: %d (double %g)\n", groupIndent, field, value, math.Float64frombits(value))
+		case PROTOBUF_WIRE_FIXED32:
+			if len(data)-offset < 4 {
+				return "", false
+			}
+			value := binary.LittleEndian.Uint32(data[offset : offset+4])
+			offset += 4
+			fmt.Fprintf(&result, "%s%d fixed32: %d (float %g)\n", groupIndent, field, value, math.Float32frombits(value))
+		case PROTOBUF_WIRE_BYTES:
+			length, prefixLength := binary.Uvarint(data[offset:])
+			if prefixLength <= 0 || length > uint64(len(data)-offset-prefixLength) {
+				return "", false
+			}
+			offset += prefixLength
+			value := data[offset : offset+int(length)]
+			offset += int(length)
+			result.WriteString(describeProtobufBytes(field, value, groupIndent, depth))
+		case PROTOBUF_WIRE_START:
+			fmt.Fprintf(&result, "%s%d group {\n", groupIndent, field)
+			groups = append(groups, field)
+		case PROTOBUF_WIRE_END:
+			if len(groups) == 0 || groups[len(groups)-1] != field {
+				return "", false
+			}
+			groups = groups[:len(groups)-1]
+			fmt.Fprintf(&result, "%s}\n", indent+strings.Repeat(PROTOBUF_INDENT, len(groups)))
+		default:
+			return "", false
+		}
+	}
+	return result.String(), len(groups) == 0
+}
+
+// Describe a length-delimited field: as text if printable, as a nested message if it decodes as one, otherwise in hex.
+func describeProtobufBytes(field uint64, value []byte, indent string, depth int) string {
+	if len(value) == 0 {
+		return fmt.Sprintf("%s%d bytes: (empty)\n", indent, field)
+	}
+	if isProtobufText(value) {
+		return fmt.Sprintf("%s%d string: %q\n", indent, field, value)
+	}
+	if nested, ok := describeProtobuf(value, indent+PROTOBUF_INDENT, depth+1); ok {
+		return fmt.Sprintf("%s%d message (%d bytes) {\n%s%s}\n", indent, field, len(value), nested, indent)
+	}
+	return fmt.Sprintf("%s%d bytes (%d): %s\n", indent, field, len(value), hex.EncodeToString(value))
+}
+
+// Whether a length-delimited value is likely text: valid UTF-8 and mostly printable.
+func isProtobufText(value []byte) bool {
+	if !utf8.Valid(value) {
+		return false
+	}
+	printable := 0
+	runes := 0
+	for _, character := range string(value) {
+		runes++
+		if unicode.IsPrint(character) || character == '\n' || character == '\t' {
+			printable++
+		}
+	}
+	return float64(printable) >= PROTOBUF_PRINTABLE_RATIO*float64(runes)
+}
+
+// Remove and return the bytes of an incomplete message expected to continue at 'offset' in 'direction' from 'teeId'.
+func (session *Session) takeProtobufPending(direction string, teeId string, offset int) []byte {
+	if session == nil {
+		return nil
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	key := streamKey{direction: direction, offset: offset, teeId: teeId}
+	pending := session.protobuf[key]
+	delete(session.protobuf, key)
+	return pending
+}
+
+// Record the bytes of an incomplete message, expected to continue at 'offset' in 'direction' from 'teeId'.
+func (session *Session) putProtobufPending(direction string, teeId string, offset int, pending []byte) {
+	if session == nil {
+		return
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.protobuf[streamKey{direction: direction, offset: offset, teeId: teeId}] = append([]byte{}, pending...)
+}
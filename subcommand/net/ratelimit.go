@@ -0,0 +1,97 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	RATE_LIMIT_POLICY_DELAY  = "delay"  // Wait for a token before proxying the connection.
+	RATE_LIMIT_POLICY_REJECT = "reject" // Close the connection.
+)
+
+// A token bucket limiting the rate connections are accepted, from "accept.ratelimit".
+// It holds up to 'burst' tokens and gains 'rate' tokens a second.  Each connection takes one.
+// Only the accept loop uses it, so it is not locked.
+type RateLimit struct {
+	burst    float64
+	isReject bool
+	last     time.Time // When 'tokens' was last brought up to date.
+	rate     float64
+	tokens   float64
+}
+
+// Rate limit read from "accept.ratelimit".  If nil, connections are not limited.
+var acceptRateLimit *RateLimit
+
+// Read "accept.ratelimit.rate", "accept.ratelimit.burst", and "accept.ratelimit.policy".
+// A rate of 0, the default, is no limit.  The burst defaults to the rate, rounded up.
+func loadRateLimit() (*RateLimit, error) {
+	rate := viper.GetFloat64("accept.ratelimit.rate")
+	if rate < 0 {
+		return nil, fmt.Errorf("accept.ratelimit.rate %g is negative", rate)
+	}
+	if rate == 0 {
+		return nil, nil
+	}
+	burst := viper.GetFloat64("accept.ratelimit.burst")
+	if burst == 0 {
+		burst = math.Ceil(rate)
+	}
+	if burst < 1 {
+		return nil, fmt.Errorf("accept.ratelimit.burst %g is less than 1", burst)
+	}
+	result := &RateLimit{
+		burst:  burst,
+		last:   time.Now(),
+		rate:   rate,
+		tokens: burst,
+	}
+	policy := strings.ToLower(viper.GetString("accept.ratelimit.policy"))
+	switch policy {
+	case "", RATE_LIMIT_POLICY_DELAY:
+	case RATE_LIMIT_POLICY_REJECT:
+		result.isReject = true
+	default:
+		return nil, fmt.Errorf("accept.ratelimit.policy '%s' is not '%s' or '%s'", policy, RATE_LIMIT_POLICY_DELAY, RATE_LIMIT_POLICY_REJECT)
+	}
+	return result, nil
+}
+
+// Take a token for a connection from 'address'.  Without one, the connection is delayed until there is one,
+// or with the "reject" policy, false is returned.  False is also returned if 'ctx' is done while waiting.
+func (limit *RateLimit) take(ctx context.Context, address net.Addr) bool {
+	if limit == nil {
+		return true
+	}
+	now := time.Now()
+	limit.tokens = math.Min(limit.burst, limit.tokens+now.Sub(limit.last).Seconds()*limit.rate)
+	limit.last = now
+	if limit.tokens >= 1 {
+		limit.tokens--
+		return true
+	}
+	if limit.isReject {
+		log.Printf("Rejected connection from %s: more than accept.ratelimit.rate %g per second.\n", address, limit.rate)
+		return false
+	}
+	wait := time.Duration((1 - limit.tokens) / limit.rate * float64(time.Second))
+	log.Printf("Delaying connection from %s by %s: more than accept.ratelimit.rate %g per second.\n", address, wait.Round(time.Millisecond), limit.rate)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+	}
+	limit.tokens = 0
+	limit.last = time.Now()
+	return true
+}
@@ -0,0 +1,79 @@
+package net
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"regexp"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	REDACT_PLACEHOLDER = "[REDACTED]"
+)
+
+// Replaces sensitive bytes before a message is written to output files.
+// Bytes written to the network are never redacted.
+type Redactor struct {
+	literals    [][]byte
+	patterns    []*regexp.Regexp
+	placeholder []byte
+}
+
+// Redactor built from the "redact" configuration.  If nil, nothing is redacted.
+var redactor *Redactor
+
+// Build a Redactor from the "redact" configuration stanza:
+//
+//	"redact": {
+//	    "placeholder": "[REDACTED]",
+//	    "patterns": ["password=[^&]*"],
+//	    "hex": ["deadbeef"]
+//	}
+//
+// "patterns" are regular expressions. "hex" are literal byte sequences written in hex.
+func loadRedactor() *Redactor {
+	patterns := viper.GetStringSlice("redact.patterns")
+	hexLiterals := viper.GetStringSlice("redact.hex")
+	if len(patterns) == 0 && len(hexLiterals) == 0 {
+		return nil
+	}
+
+	result := &Redactor{
+		placeholder: []byte(REDACT_PLACEHOLDER),
+	}
+	if viper.IsSet("redact.placeholder") {
+		result.placeholder = []byte(viper.GetString("redact.placeholder"))
+	}
+	for _, pattern := range patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("Bad redact.patterns value '%s'. Err: %+v\n", pattern, err)
+		}
+		result.patterns = append(result.patterns, compiled)
+	}
+	for _, hexLiteral := range hexLiterals {
+		literal, err := hex.DecodeString(hexLiteral)
+		if err != nil || len(literal) == 0 {
+			log.Fatalf("Bad redact.hex value '%s'. Err: %+v\n", hexLiteral, err)
+		}
+		result.literals = append(result.literals, literal)
+	}
+	return result
+}
+
+// Return a copy of 'message' with sensitive bytes replaced by the placeholder.
+func (redactor *Redactor) redact(message []byte) []byte {
+	if redactor == nil {
+		return message
+	}
+	result := message
+	for _, literal := range redactor.literals {
+		result = bytes.Replace(result, literal, redactor.placeholder, -1)
+	}
+	for _, pattern := range redactor.patterns {
+		result = pattern.ReplaceAll(result, redactor.placeholder)
+	}
+	return result
+}
@@ -0,0 +1,62 @@
+package net
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// A primary server chosen by the server name (SNI) a TLS client asked for.
+type Route struct {
+	Address string
+	Network string
+	Output  string // If "", outbound.output is used.
+}
+
+// Read "routes": server names mapped to "host:port" / "network://address" or to objects with
+// "address", "network", and "output".  Server names are matched without regard to case.
+func loadRoutes() (map[string]Route, error) {
+	result := map[string]Route{}
+	stanzas, ok := viper.Get("routes").(map[string]interface{})
+	if !ok {
+		return result, nil
+	}
+	if viper.GetString("inbound.certfile") == "" {
+		return nil, fmt.Errorf("routes requires inbound.certfile, so clients send a server name")
+	}
+	for serverName, value := range stanzas {
+		route := Route{}
+		switch value := value.(type) {
+		case string:
+			route.Network, route.Address = parseNetworkAddress(value)
+		case map[string]interface{}:
+			route.Address, _ = value["address"].(string)
+			route.Network, _ = value["network"].(string)
+			route.Output, _ = value["output"].(string)
+			if route.Network == "" {
+				route.Network = "tcp"
+			}
+		default:
+			return nil, fmt.Errorf("routes.%s is not an address or an object", serverName)
+		}
+		if route.Address == "" {
+			return nil, fmt.Errorf("routes.%s has no address", serverName)
+		}
+		if !streamNetworks[route.Network] {
+			return nil, fmt.Errorf("routes.%s network '%s' is not supported. Values: tcp, tcp4, tcp6, unix, unixpacket", serverName, route.Network)
+		}
+		result[strings.ToLower(serverName)] = route
+	}
+	return result, nil
+}
+
+// The route for the server name of a TLS connection.  False if the connection is not TLS or no route matches.
+func findRoute(routes map[string]Route, state *tls.ConnectionState) (Route, bool) {
+	if state == nil || state.ServerName == "" {
+		return Route{}, false
+	}
+	route, ok := routes[strings.ToLower(state.ServerName)]
+	return route, ok
+}
@@ -0,0 +1,177 @@
+package net
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Where the schema version is in the first decoded XML of a connection, from "schema.versionxpath".
+// A subset of XPath: element names separated by "/", from the root ("/Hello/Header") or from any element ("//Header").
+// "*" matches any element.  A last step of "@name" selects an attribute; otherwise the element's text is the version.
+type SchemaPath struct {
+	attribute  string   // If set, the attribute holding the version.
+	isAnywhere bool     // If true, 'elements' may match below the root.
+	elements   []string // Local names of the path's elements.
+	path       string
+}
+
+// Set from "schema.versionxpath".  If nil, the schema version is not looked for.
+var schemaPath *SchemaPath
+
+// Parse "schema.versionxpath".  Returns nil if it is not set.
+func loadSchemaPath() (*SchemaPath, error) {
+	path := viper.GetString("schema.versionxpath")
+	if path == "" {
+		return nil, nil
+	}
+	result := &SchemaPath{path: path}
+	steps := ""
+	switch {
+	case strings.HasPrefix(path, "//"):
+		result.isAnywhere = true
+		steps = path[2:]
+	case strings.HasPrefix(path, "/"):
+		steps = path[1:]
+	default:
+		return nil, fmt.Errorf("schema.versionxpath '%s' does not begin with '/' or '//'", path)
+	}
+	for index, step := range strings.Split(steps, "/") {
+		isLast := index == strings.Count(steps, "/")
+		switch {
+		case step == "":
+			return nil, fmt.Errorf("schema.versionxpath '%s' has an empty step", path)
+		case strings.HasPrefix(step, "@") && isLast && len(step) > 1:
+			result.attribute = step[1:]
+		case strings.ContainsAny(step, "@[]()="):
+			return nil, fmt.Errorf("schema.versionxpath '%s' step '%s' is not an element name, '*', or a final '@attribute'", path, step)
+		default:
+			result.elements = append(result.elements, step)
+		}
+	}
+	if len(result.elements) == 0 {
+		return nil, fmt.Errorf("schema.versionxpath '%s' names no element", path)
+	}
+	return result, nil
+}
+
+// Whether the open elements, 'stack', are selected by the path.
+func (schemaPath *SchemaPath) matches(stack []string) bool {
+	if len(stack) < len(schemaPath.elements) || (!schemaPath.isAnywhere && len(stack) != len(schemaPath.elements)) {
+		return false
+	}
+	tail := stack[len(stack)-len(schemaPath.elements):]
+	for index, element := range schemaPath.elements {
+		if element != "*" && element != tail[index] {
+			return false
+		}
+	}
+	return true
+}
+
+// The version in 'xmlString': the first selected attribute or element text.  Returns false if there is none.
+func (schemaPath *SchemaPath) find(xmlString string) (string, bool) {
+	decoder := xml.NewDecoder(strings.NewReader(xmlString))
+	stack := []string{}
+	depth := 0 // Of the selected element whose text is being read; 0 if none.
+	text := strings.Builder{}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", false
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, token.Name.Local)
+			if depth > 0 || !schemaPath.matches(stack) {
+				continue
+			}
+			if schemaPath.attribute == "" {
+				depth = len(stack)
+				continue
+			}
+			for _, attribute := range token.Attr {
+				if attribute.Name.Local == schemaPath.attribute {
+					return attribute.Value, true
+				}
+			}
+		case xml.CharData:
+			if depth > 0 {
+				text.Write(token)
+			}
+		case xml.EndElement:
+			if depth == len(stack) {
+				return strings.TrimSpace(text.String()), true
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+// Look for the schema version in the first binaryXML frame of the connection that decodes.
+// Returns the version if it is found in 'message', once per connection.
+func (schemaPath *SchemaPath) detect(ctx context.Context, message []byte) (string, bool) {
+	if schemaPath == nil || len(message) == 0 || message[0] != BINARY_XML_START {
+		return "", false
+	}
+	session := getSession(ctx)
+	if session.isSchemaChecked() {
+		return "", false
+	}
+	frames, _ := decodeFrames(ctx, message)
+	if len(frames) == 0 {
+		return "", false
+	}
+	version, ok := schemaPath.find(frames[0].Xml)
+	if !session.setSchemaVersion(version, ok) {
+		return "", false
+	}
+	if !ok {
+		if viper.GetBool("debug") {
+			log.Printf("schema.versionxpath '%s' is not in the first decoded XML.\n", schemaPath.path)
+		}
+		return "", false
+	}
+	return version, true
+}
+
+// Fields for the horizontal rule of a block: the connection's schema version, once found.
+func (session *Session) schemaFields() []string {
+	if session == nil {
+		return nil
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.schemaVersion == "" {
+		return nil
+	}
+	return []string{"schema=" + session.schemaVersion}
+}
+
+// Whether the first decoded XML of the connection has been looked at.
+func (session *Session) isSchemaChecked() bool {
+	if session == nil {
+		return true
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.isSchemaDone
+}
+
+// Record the version found, if 'ok', in the first decoded XML.  Returns false if another read was first.
+func (session *Session) setSchemaVersion(version string, ok bool) bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.isSchemaDone {
+		return false
+	}
+	session.isSchemaDone = true
+	if ok {
+		session.schemaVersion = version
+	}
+	return true
+}
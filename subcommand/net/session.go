@@ -0,0 +1,237 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Unanswered client requests remembered per connection, for "latency" and for correlation ids.
+// A server that does not answer, or one that is not read, would otherwise grow them for the life of the connection.
+// Beyond the limit, the oldest are forgotten.
+const SESSION_MAX_PENDING = 4096
+
+// State shared by the goroutines proxying one accepted connection.
+type Session struct {
+	binaryxml       map[streamKey][]byte // Incomplete frames of the "binaryxml" format.
+	connectionId    uint64               // Number of the accepted connection: 1, 2, ...
+	format          string               // Detected for "auto" format.  See autoFormat().
+	http            map[streamKey]httpStream
+	isSchemaDone    bool // The first decoded XML has been searched for the schema version.  See SchemaPath.
+	lastRequestId   uint64
+	lastResponseId  uint64
+	lock            sync.Mutex
+	pendingRequests []uint64
+	protobuf        map[streamKey][]byte // Incomplete messages of the "protobufwire" format.
+	requestBytes    uint64               // Read from the client.
+	requestTimes    []time.Time
+	responseBytes   map[string]uint64 // Read from each tee, by tee id.
+	schemaVersion   string
+	websocket       map[streamKey]websocketContinuation
+}
+
+// Position in one direction of a connection at which parsing continues, for formats that keep state between reads.
+// Each tee's responses are a stream of their own, so 'teeId' is the tee's id, or "inbound" for client requests.
+type streamKey struct {
+	direction string
+	offset    int
+	teeId     string
+}
+
+type sessionKey struct{}
+
+// Attach a new Session for accepted connection 'connectionId' to a "per-connection" context.
+func withSession(ctx context.Context, connectionId uint64) context.Context {
+	return context.WithValue(ctx, sessionKey{}, &Session{
+		binaryxml:     map[streamKey][]byte{},
+		connectionId:  connectionId,
+		http:          map[streamKey]httpStream{},
+		protobuf:      map[streamKey][]byte{},
+		responseBytes: map[string]uint64{},
+		websocket:     map[streamKey]websocketContinuation{},
+	})
+}
+
+// The Session of a "per-connection" context, or nil.
+func getSession(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
+
+// Record when a client request was read.  At most SESSION_MAX_PENDING unanswered requests are kept.
+func (session *Session) addRequest(when time.Time) {
+	if session == nil {
+		return
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if len(session.requestTimes) >= SESSION_MAX_PENDING {
+		session.requestTimes = session.requestTimes[1:]
+	}
+	session.requestTimes = append(session.requestTimes, when)
+}
+
+// Time since the oldest unanswered client request.
+// Requests are assumed to be answered in order. Returns false if no request is waiting.
+func (session *Session) latency(when time.Time) (time.Duration, bool) {
+	if session == nil {
+		return 0, false
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if len(session.requestTimes) == 0 {
+		return 0, false
+	}
+	requestTime := session.requestTimes[0]
+	session.requestTimes = session.requestTimes[1:]
+	return when.Sub(requestTime), true
+}
+
+// Assign the next correlation id to a client request.  At most SESSION_MAX_PENDING unanswered ids are kept.
+func (session *Session) nextRequestId() uint64 {
+	if session == nil {
+		return 0
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.lastRequestId++
+	if len(session.pendingRequests) >= SESSION_MAX_PENDING {
+		session.pendingRequests = session.pendingRequests[1:]
+	}
+	session.pendingRequests = append(session.pendingRequests, session.lastRequestId)
+	return session.lastRequestId
+}
+
+// Correlation id for a primary server response: the oldest unanswered request.
+// Requests are assumed to be answered in order.  If no request is waiting,
+// the response continues the previous one and gets its id.
+func (session *Session) responseId() uint64 {
+	if session == nil {
+		return 0
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if len(session.pendingRequests) > 0 {
+		session.lastResponseId = session.pendingRequests[0]
+		session.pendingRequests = session.pendingRequests[1:]
+	}
+	return session.lastResponseId
+}
+
+// Correlation id of the most recent client request.
+func (session *Session) requestId() uint64 {
+	if session == nil {
+		return 0
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.lastRequestId
+}
+
+// Count bytes read from the client, or, for DIRECTION_RESPONSE, from 'tee'.
+func (session *Session) addBytes(direction string, tee string, count int) {
+	if session == nil {
+		return
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if direction == DIRECTION_REQUEST {
+		session.requestBytes += uint64(count)
+	} else {
+		session.responseBytes[tee] += uint64(count)
+	}
+}
+
+// Bytes read so far from the client and from 'tee'.
+func (session *Session) byteTotals(tee string) (uint64, uint64) {
+	if session == nil {
+		return 0, 0
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.requestBytes, session.responseBytes[tee]
+}
+
+// Number of the connection, or 0 outside a "per-connection" context.
+func (session *Session) id() uint64 {
+	if session == nil {
+		return 0
+	}
+	return session.connectionId
+}
+
+// Read "session.maxduration".  0 means sessions are not limited.
+func loadSessionMaxDuration() (time.Duration, error) {
+	value := viper.GetString("session.maxduration")
+	if value == "" {
+		return 0, nil
+	}
+	maxDuration, err := time.ParseDuration(value)
+	if err != nil || maxDuration <= 0 {
+		return 0, fmt.Errorf("bad session.maxduration '%s'. Err: %+v", value, err)
+	}
+	return maxDuration, nil
+}
+
+// End a connection that is still open after 'maxDuration', even if it is active:
+// cancel its "per-connection" context and close the client's and the tees' connections.
+// Stops watching when 'done' is closed, as the connection ends by itself.
+func limitSession(ctx context.Context, cancel context.CancelFunc, done <-chan struct{}, maxDuration time.Duration, inbound net.Conn, tees []Tee) {
+	if maxDuration <= 0 {
+		return
+	}
+	go func() {
+		timer := time.NewTimer(maxDuration)
+		defer timer.Stop()
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		requestBytes, responseBytes := getSession(ctx).byteTotals(tees[0].Id)
+		log.Printf("Connection from %s reached session.maxduration %s. Closing it after %d bytes from the client and %d bytes from the server.\n", inbound.RemoteAddr(), maxDuration, requestBytes, responseBytes)
+		cancel()
+		closeConnections(inbound, tees)
+	}()
+}
+
+// Close the client's and the tees' connections.
+func closeConnections(inbound net.Conn, tees []Tee) {
+	inbound.Close()
+	for _, tee := range tees {
+		if tee.Connection != nil {
+			tee.Connection.Close()
+		}
+	}
+}
+
+// Deferred by each goroutine of a connection.  If the goroutine panics, for example on a bug in a decoder,
+// log the panic with the connection id and stack and close the connection, so the proxy keeps serving the others.
+// 'tee' is the tee id the goroutine reads or writes: "inbound" for the client.
+func recoverConnection(ctx context.Context, tee string, inbound net.Conn, tees []Tee) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	log.Printf("Connection %d panicked in '%s'. Closing it. Err: %v\n%s", getSession(ctx).id(), tee, value, debug.Stack())
+	errorLog.add(ctx, tee, fmt.Sprintf("panic: %v", value))
+	closeConnections(inbound, tees)
+}
+
+// Largest first read from a client, from "inbound.maxfirstmessage".  0, the default, is no limit.
+// A read returns at most BUFFER_LENGTH bytes, so the limit must be less.
+func loadMaxFirstMessage() (int, error) {
+	maximum := viper.GetInt("inbound.maxfirstmessage")
+	if maximum < 0 || maximum >= BUFFER_LENGTH {
+		return 0, fmt.Errorf("bad inbound.maxfirstmessage %d. It must be from 0 to %d bytes", maximum, BUFFER_LENGTH-1)
+	}
+	return maximum, nil
+}
@@ -0,0 +1,124 @@
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+
+	// Blocks waiting to be sent to the sink.  When full, new blocks are dropped.
+
+	SINK_QUEUE_LENGTH = 1024
+
+	// Reconnect backoff.
+
+	SINK_BACKOFF_MINIMUM = time.Second
+	SINK_BACKOFF_MAXIMUM = time.Second * 30
+)
+
+// One formatted block, sent to the sink as a line of JSON.
+type SinkRecord struct {
+	Data   string `json:"data"`
+	Format string `json:"format"`
+	Tee    string `json:"tee"`
+	Time   string `json:"time"`
+	Title  string `json:"title"`
+}
+
+// Remote collector that receives newline-delimited JSON records over TCP or UDP.
+type Sink struct {
+	address string
+	network string
+	records chan []byte
+}
+
+// Sink built from "output.sink".  If nil, no records are sent.
+var sink *Sink
+
+// Parse "output.sink" (e.g. "tcp://host:port" or "udp://host:port") and start sending records.
+func startSink(ctx context.Context) *Sink {
+	target := viper.GetString("output.sink")
+	if target == "" {
+		return nil
+	}
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "tcp" && parsed.Scheme != "udp") {
+		log.Fatalf("Bad output.sink '%s'. Expected 'tcp://host:port' or 'udp://host:port'\n", target)
+	}
+	result := &Sink{
+		address: parsed.Host,
+		network: parsed.Scheme,
+		records: make(chan []byte, SINK_QUEUE_LENGTH),
+	}
+	go result.run(ctx)
+	return result
+}
+
+// Queue a formatted block.  Never blocks the proxy; if the queue is full the block is dropped.
+func (sink *Sink) send(tee string, title string, data string) {
+	if sink == nil {
+		return
+	}
+	record, err := json.Marshal(SinkRecord{
+		Data:   data,
+		Format: viper.GetString(FORMAT),
+		Tee:    tee,
+		Time:   timestamp(time.Now()).Format(time.RFC3339Nano),
+		Title:  title,
+	})
+	if err != nil {
+		log.Printf("json.Marshal() failed. Err: %+v\n", err)
+		return
+	}
+	select {
+	case sink.records <- append(record, '\n'):
+	default:
+		log.Printf("output.sink queue is full. Dropped block for '%s'\n", tee)
+	}
+}
+
+// Connect, reconnecting with exponential backoff, and write queued records until 'ctx' is done.
+func (sink *Sink) run(ctx context.Context) {
+	var connection net.Conn
+	backoff := SINK_BACKOFF_MINIMUM
+	for {
+		select {
+		case <-ctx.Done():
+			if connection != nil {
+				connection.Close()
+			}
+			return
+		case record := <-sink.records:
+			for connection == nil {
+				var err error
+				connection, err = networkDialer.Dial(sink.network, sink.address)
+				if err == nil {
+					backoff = SINK_BACKOFF_MINIMUM
+					break
+				}
+				log.Printf("output.sink net.Dial() failed. Retrying in %s. Err: %+v\n", backoff, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+				if backoff > SINK_BACKOFF_MAXIMUM {
+					backoff = SINK_BACKOFF_MAXIMUM
+				}
+			}
+			if _, err := connection.Write(record); err != nil {
+				log.Printf("output.sink Write() failed. Err: %+v\n", err)
+				connection.Close()
+				connection = nil
+			}
+		}
+	}
+}
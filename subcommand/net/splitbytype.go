@@ -0,0 +1,115 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/docktermj/go-proxy-tee/common/decode"
+	"github.com/spf13/viper"
+)
+
+const (
+	SPLIT_BY_TYPE_ALSO = "also" // Blocks go to the per-type files and the tee's file.
+	SPLIT_BY_TYPE_ONLY = "only" // Blocks with a message type go only to the per-type files.
+)
+
+// A decoded binaryXML frame and the name of its root element.
+type TypedFrame struct {
+	Type string
+	Xml  string
+}
+
+// Return the "splitbytype" configuration value: "", SPLIT_BY_TYPE_ALSO, or SPLIT_BY_TYPE_ONLY.
+func splitByTypeMode() (string, error) {
+	value := strings.ToLower(viper.GetString("splitbytype"))
+	switch value {
+	case "", SPLIT_BY_TYPE_ALSO, SPLIT_BY_TYPE_ONLY:
+		return value, nil
+	}
+	return "", fmt.Errorf("splitbytype '%s' is not '%s' or '%s'", value, SPLIT_BY_TYPE_ALSO, SPLIT_BY_TYPE_ONLY)
+}
+
+// Decode the frames of a "binaryxml" message for "splitbytype".  Returns nil if it is not configured.
+// Frames that do not decode are left out; formatMessage() has already logged them.
+func typedFrames(ctx context.Context, format string, message []byte) []TypedFrame {
+	if format != FORMAT_BINARY_XML || viper.GetString("splitbytype") == "" {
+		return nil
+	}
+	result, _ := decodeFrames(ctx, message)
+	return result
+}
+
+// Decode the binaryXML frames at the start of 'message'.
+// Returns the frames with a root element, and false if any frame did not decode.
+func decodeFrames(ctx context.Context, message []byte) ([]TypedFrame, bool) {
+	result := []TypedFrame{}
+	isOk := true
+	timeout := decodeTimeout()
+	offset := 0
+	for offset < len(message) && message[offset] == BINARY_XML_START {
+		frame := hexParseSplit(message[offset:])
+		offset += len(frame)
+		var param uint8
+		xmlBuffer := make([]byte, BUFFER_LENGTH)
+		if err := decode.ReadMessage(ctx, timeout, bytes.NewReader(frame), &param, &xmlBuffer); err != nil {
+			isOk = false
+			continue
+		}
+		xmlString, err := decode.ToXML(ctx, timeout, xmlBuffer)
+		if err != nil {
+			isOk = false
+			continue
+		}
+		root := rootElement(xmlString)
+		if root == "" {
+			continue
+		}
+		formattedXML, err := decode.Format([]byte(xmlString), viper.GetBool("xml.compact"))
+		if err != nil {
+			formattedXML = []byte(xmlString)
+		}
+		result = append(result, TypedFrame{
+			Type: root,
+			Xml:  string(formattedXML),
+		})
+	}
+	return result, isOk
+}
+
+// Name of the first element of an XML document, with characters unsafe in file names replaced by "_".
+func rootElement(xmlString string) string {
+	decoder := xml.NewDecoder(strings.NewReader(xmlString))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if element, ok := token.(xml.StartElement); ok {
+			return strings.Map(func(r rune) rune {
+				if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == '_' {
+					return r
+				}
+				return '_'
+			}, element.Name.Local)
+		}
+	}
+}
+
+// Append each frame, under 'title', to the file for its type: 'file's name with "-<type>" before the extension.
+// Returns true if, with SPLIT_BY_TYPE_ONLY, the block is not also written to 'file'.
+func writeTypedFrames(ctx context.Context, file *OutputFile, title string, frames []TypedFrame) bool {
+	if len(frames) == 0 {
+		return false
+	}
+	extension := filepath.Ext(file.Name())
+	base := strings.TrimSuffix(file.Name(), extension)
+	for _, frame := range frames {
+		typeFile := openFile(ctx, base+"-"+frame.Type+extension)
+		_, _ = typeFile.WriteString(fmt.Sprintf("%s\n%s%s", title, frame.Xml, blockSeparator()))
+	}
+	return strings.ToLower(viper.GetString("splitbytype")) == SPLIT_BY_TYPE_ONLY
+}
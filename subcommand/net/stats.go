@@ -0,0 +1,164 @@
+package net
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Message and byte counts for one tee and direction.
+type StatsCounter struct {
+	bytes    uint64
+	messages uint64
+}
+
+type statsKey struct {
+	direction string
+	tee       string
+}
+
+// Throughput counters, logged every "stats.interval" and sent to "statsd.address", then reset.
+type Stats struct {
+	connections uint64
+	counters    map[statsKey]*StatsCounter
+	errors      map[string]uint64 // Failed writes, by tee.
+	isLogged    bool
+	lock        sync.Mutex
+	statsd      *Statsd
+}
+
+// Stats built from "stats.interval" and "statsd.address".  If nil, nothing is counted.
+var stats *Stats
+
+// Start logging throughput every "stats.interval" and sending it to "statsd.address" every "statsd.interval".
+// With both, counters are sent every "stats.interval".
+func startStats(ctx context.Context) *Stats {
+	statsd, err := newStatsd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	value := viper.GetString("stats.interval")
+	if value == "" && statsd == nil {
+		return nil
+	}
+	interval := STATSD_INTERVAL_DEFAULT
+	if value != "" {
+		interval, err = time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			log.Fatalf("Bad stats.interval '%s'. Err: %+v\n", value, err)
+		}
+	} else if statsd != nil {
+		interval = statsd.interval
+	}
+	result := &Stats{
+		counters: map[statsKey]*StatsCounter{},
+		errors:   map[string]uint64{},
+		isLogged: value != "",
+		statsd:   statsd,
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				result.flush(now.Sub(last))
+				last = now
+			}
+		}
+	}()
+	return result
+}
+
+// Count a message of 'length' bytes.
+// Client requests are counted once, as tee "inbound"; responses are counted per tee.
+func (stats *Stats) add(tee string, direction string, length int) {
+	if stats == nil {
+		return
+	}
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	key := statsKey{direction: direction, tee: tee}
+	counter, ok := stats.counters[key]
+	if !ok {
+		counter = &StatsCounter{}
+		stats.counters[key] = counter
+	}
+	counter.messages++
+	counter.bytes += uint64(length)
+}
+
+// Count an accepted client connection.
+func (stats *Stats) addConnection() {
+	if stats == nil {
+		return
+	}
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.connections++
+}
+
+// Count a failed write to a tee.
+func (stats *Stats) addError(tee string) {
+	if stats == nil {
+		return
+	}
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.errors[tee]++
+}
+
+// Log and send the counts since the last call, then reset the counters.
+func (stats *Stats) flush(elapsed time.Duration) {
+	stats.lock.Lock()
+	counters := stats.counters
+	connections := stats.connections
+	errors := stats.errors
+	stats.counters = map[statsKey]*StatsCounter{}
+	stats.connections = 0
+	stats.errors = map[string]uint64{}
+	stats.lock.Unlock()
+
+	if stats.isLogged {
+		stats.log(elapsed, counters)
+	}
+	stats.statsd.send(connections, counters, errors)
+}
+
+// Log rates per direction and per tee.
+func (stats *Stats) log(elapsed time.Duration, counters map[statsKey]*StatsCounter) {
+
+	seconds := elapsed.Seconds()
+	totals := map[string]*StatsCounter{
+		DIRECTION_REQUEST:  {},
+		DIRECTION_RESPONSE: {},
+	}
+	keys := []statsKey{}
+	for key, counter := range counters {
+		totals[key.direction].messages += counter.messages
+		totals[key.direction].bytes += counter.bytes
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].tee != keys[j].tee {
+			return keys[i].tee < keys[j].tee
+		}
+		return keys[i].direction < keys[j].direction
+	})
+
+	for _, direction := range []string{DIRECTION_REQUEST, DIRECTION_RESPONSE} {
+		total := totals[direction]
+		log.Printf("Stats: %s: %.1f messages/sec, %.1f bytes/sec\n", direction, float64(total.messages)/seconds, float64(total.bytes)/seconds)
+	}
+	for _, key := range keys {
+		counter := counters[key]
+		log.Printf("Stats: tee %s %s: %.1f messages/sec, %.1f bytes/sec\n", key.tee, key.direction, float64(counter.messages)/seconds, float64(counter.bytes)/seconds)
+	}
+}
@@ -0,0 +1,128 @@
+package net
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	STATSD_INTERVAL_DEFAULT = time.Second * 10
+	STATSD_PREFIX_DEFAULT   = "go_proxy_tee"
+
+	// Largest statsd packet.  Metrics are split across packets that fit a typical network MTU.
+
+	STATSD_MAX_PACKET_LENGTH = 1432
+)
+
+// Collector of the Stats counters, sent as statsd counters over UDP.
+type Statsd struct {
+	connection net.Conn
+	interval   time.Duration
+	prefix     string
+}
+
+// Read "statsd.address", "statsd.prefix", and "statsd.interval".  Returns nil without "statsd.address".
+func newStatsd() (*Statsd, error) {
+	address := viper.GetString("statsd.address")
+	if address == "" {
+		return nil, nil
+	}
+	interval := STATSD_INTERVAL_DEFAULT
+	if value := viper.GetString("statsd.interval"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("bad statsd.interval '%s'. Err: %+v", value, err)
+		}
+		interval = parsed
+	}
+	prefix := STATSD_PREFIX_DEFAULT
+	if viper.IsSet("statsd.prefix") {
+		prefix = viper.GetString("statsd.prefix")
+	}
+
+	// UDP is connectionless, so this fails only for a bad address.
+
+	connection, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("statsd.address '%s' failed. Err: %+v", address, err)
+	}
+	return &Statsd{
+		connection: connection,
+		interval:   interval,
+		prefix:     prefix,
+	}, nil
+}
+
+// Name a metric, e.g. "go_proxy_tee.tee.outbound.response.bytes".
+// Characters statsd uses as separators are replaced in tee names.
+func (statsd *Statsd) name(parts ...string) string {
+	replacer := strings.NewReplacer(":", "_", "|", "_", "@", "_", " ", "_")
+	for index, part := range parts {
+		parts[index] = replacer.Replace(part)
+	}
+	if statsd.prefix == "" {
+		return strings.Join(parts, ".")
+	}
+	return statsd.prefix + "." + strings.Join(parts, ".")
+}
+
+// Send counts as statsd counters.  Zero counts are sent too, so the collector sees every interval.
+// Sending is best effort: a lost or refused packet is logged with "debug" and otherwise ignored.
+func (statsd *Statsd) send(connections uint64, counters map[statsKey]*StatsCounter, errors map[string]uint64) {
+	if statsd == nil {
+		return
+	}
+	lines := []string{fmt.Sprintf("%s:%d|c", statsd.name("connections"), connections)}
+	keys := []statsKey{}
+	for key := range counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].tee != keys[j].tee {
+			return keys[i].tee < keys[j].tee
+		}
+		return keys[i].direction < keys[j].direction
+	})
+	for _, key := range keys {
+		counter := counters[key]
+		lines = append(lines,
+			fmt.Sprintf("%s:%d|c", statsd.name("tee", key.tee, key.direction, "bytes"), counter.bytes),
+			fmt.Sprintf("%s:%d|c", statsd.name("tee", key.tee, key.direction, "messages"), counter.messages),
+		)
+	}
+	tees := []string{}
+	for tee := range errors {
+		tees = append(tees, tee)
+	}
+	sort.Strings(tees)
+	for _, tee := range tees {
+		lines = append(lines, fmt.Sprintf("%s:%d|c", statsd.name("tee", tee, "errors"), errors[tee]))
+	}
+
+	// Several metrics, one per line, are sent in each packet.
+
+	packet := ""
+	for _, line := range lines {
+		if packet != "" && len(packet)+1+len(line) > STATSD_MAX_PACKET_LENGTH {
+			statsd.write(packet)
+			packet = ""
+		}
+		if packet != "" {
+			packet += "\n"
+		}
+		packet += line
+	}
+	statsd.write(packet)
+}
+
+func (statsd *Statsd) write(packet string) {
+	if _, err := statsd.connection.Write([]byte(packet)); err != nil && viper.GetBool("debug") {
+		log.Printf("Sending to statsd.address failed. Err: %+v\n", err)
+	}
+}
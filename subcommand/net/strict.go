@@ -0,0 +1,207 @@
+package net
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Configuration keys read by the "net" command.  New keys must be added here, or --strict rejects them.
+var knownKeys = map[string]bool{
+	"accept.ratelimit.burst":       true,
+	"accept.ratelimit.policy":      true,
+	"accept.ratelimit.rate":        true,
+	"banner":                       true,
+	"binaryxml.byteorder":          true,
+	"binaryxml.reportempty":        true,
+	"block.addresses":              true,
+	"block.separator":              true,
+	"capture.combined":             true,
+	"capture.stopafter":            true,
+	"capture.trigger.contains":     true,
+	"capture.trigger.regex":        true,
+	"compare.mode":                 true,
+	"compare.output":               true,
+	"compare.tee":                  true,
+	"config.watch":                 true,
+	"control.socket":               true,
+	"debug":                        true,
+	"decode.command":               true,
+	"decode.timeout":               true,
+	"disk.interval":                true,
+	"disk.maxtotalbytes":           true,
+	"disk.policy":                  true,
+	"errors.output":                true,
+	"file.mode":                    true,
+	"format":                       true,
+	"framing":                      true,
+	"framing.maxbuffer":            true,
+	"framing.mode":                 true,
+	"halfclose":                    true,
+	"health.interval":              true,
+	"health.skipdead":              true,
+	"hex.head":                     true,
+	"hex.streamoffsets":            true,
+	"hex.tail":                     true,
+	"hex.width":                    true,
+	"inbound.address":              true,
+	"inbound.allow":                true,
+	"inbound.backlog":              true,
+	"inbound.certfile":             true,
+	"inbound.clientca":             true,
+	"inbound.deny":                 true,
+	"inbound.format":               true,
+	"inbound.greeting":             true,
+	"inbound.identitybanner":       true,
+	"inbound.keyfile":              true,
+	"inbound.maxfirstmessage":      true,
+	"inbound.network":              true,
+	"inbound.output":               true,
+	"inbound.reuseaddr":            true,
+	"inbound.tlsbanner":            true,
+	"index.csv":                    true,
+	"latency":                      true,
+	"limit.duration":               true,
+	"limit.maxbytes":               true,
+	"log.maxperconnection":         true,
+	"outbound.address":             true,
+	"outbound.backpressure":        true,
+	"outbound.backpressuretimeout": true,
+	"outbound.failover":            true,
+	"outbound.format":              true,
+	"outbound.httpproxy.address":   true,
+	"outbound.network":             true,
+	"outbound.output":              true,
+	"outbound.passthru":            true,
+	"outbound.pool":                true,
+	"outbound.poolidletimeout":     true,
+	"outbound.poolmaxidle":         true,
+	"outbound.preamble":            true,
+	"outbound.tls":                 true,
+	"outbound.tls.cafile":          true,
+	"outbound.tls.certfile":        true,
+	"outbound.tls.keyfile":         true,
+	"outbound.tls.servername":      true,
+	"output.buffered":              true,
+	"output.buffersize":            true,
+	"output.dirmode":               true,
+	"output.fifobuffer":            true,
+	"output.fifopolicy":            true,
+	"output.flushinterval":         true,
+	"output.lineending":            true,
+	"output.maxopenfiles":          true,
+	"output.mkdir":                 true,
+	"output.raw":                   true,
+	"output.sink":                  true,
+	"output.sinkonly":              true,
+	"output.stdout.buffering":      true,
+	"output.timebucket":            true,
+	"performance.zerocopy":         true,
+	"protobufwire.prefix":          true,
+	"quiet":                        true,
+	"redact.hex":                   true,
+	"redact.patterns":              true,
+	"redact.placeholder":           true,
+	"routes":                       true,
+	"schema.versionxpath":          true,
+	"session.maxduration":          true,
+	"splitbytype":                  true,
+	"stats.interval":               true,
+	"statsd.address":               true,
+	"statsd.interval":              true,
+	"statsd.prefix":                true,
+	"tee":                          true,
+	"teequeue.length":              true,
+	"teequeue.overflow":            true,
+	"timestamp.timezone":           true,
+	"xml.compact":                  true,
+}
+
+// Keys of a "tee" stanza.  See newTeeDefinition().
+var knownTeeKeys = map[string]bool{
+	"address":           true,
+	"enabled":           true,
+	"httpproxy":         true,
+	"httpproxy.address": true,
+	"maxinflight":       true,
+	"name":              true,
+	"network":           true,
+	"output":            true,
+	"overflow":          true,
+	"sample":            true,
+	"tls":               true,
+	"tls.cafile":        true,
+	"tls.certfile":      true,
+	"tls.keyfile":       true,
+	"tls.servername":    true,
+}
+
+// Whether a key, or one of its parents, begins with "_comment".  Such keys explain the settings and are ignored.
+func isCommentKey(key string) bool {
+	for _, part := range strings.Split(key, ".") {
+		if strings.HasPrefix(part, "_comment") {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys of the configuration that the "net" command does not read, sorted.
+// Keys under "routes" are server names and are not checked.
+func unknownKeys() []string {
+	result := []string{}
+	for _, key := range viper.AllKeys() {
+		if knownKeys[key] || isCommentKey(key) || strings.HasPrefix(key, "routes.") {
+			continue
+		}
+
+		// As a map, each "tee" stanza is "tee.<name>.<key>".
+
+		if parts := strings.SplitN(key, ".", 3); len(parts) == 3 && parts[0] == "tee" && knownTeeKeys[parts[2]] {
+			continue
+		}
+		result = append(result, key)
+	}
+
+	// As a list, "tee" stanzas are not part of viper.AllKeys().
+
+	if stanzas, ok := viper.Get("tee").([]interface{}); ok {
+		for index, value := range stanzas {
+			stanza, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for _, key := range flattenKeys("", stanza) {
+				if !knownTeeKeys[key] && !isCommentKey(key) {
+					result = append(result, fmt.Sprintf("tee[%d].%s", index, key))
+				}
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// The keys of a map and of the maps within it, joined with ".".
+func flattenKeys(prefix string, values map[string]interface{}) []string {
+	result := []string{}
+	for key, value := range values {
+		key = prefix + strings.ToLower(key)
+		result = append(result, key)
+		if nested, ok := value.(map[string]interface{}); ok {
+			result = append(result, flattenKeys(key+".", nested)...)
+		}
+	}
+	return result
+}
+
+// With --strict, refuse to start if the configuration has keys that are not read, such as misspellings.
+func checkKeys() error {
+	unknown := unknownKeys()
+	if len(unknown) == 0 {
+		return nil
+	}
+	return fmt.Errorf("--strict: unknown configuration keys: %s", strings.Join(unknown, ", "))
+}
@@ -0,0 +1,180 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	TEE_QUEUE_OVERFLOW_BLOCK = "block" // Wait for room, slowing the client down to the tee's pace.
+	TEE_QUEUE_OVERFLOW_DROP  = "drop"  // Log and drop the message for that tee.
+)
+
+const (
+
+	// Client requests queued for a tee with a "maxinflight" budget, when "teequeue.length" is 0.
+
+	TEE_QUEUE_LENGTH_DEFAULT = 1024
+
+	// Longest time stop() waits for queued deliveries before closing the tee's connection.
+
+	TEE_QUEUE_STOP_TIMEOUT = time.Second * 5
+)
+
+// A client request for one tee: the block logged to the tee's file and the bytes sent to the tee.
+type TeeDelivery struct {
+	extras   map[string]string // Blocks of the extra formats.  See extraOutlines().
+	frames   []TypedFrame
+	isLogged bool
+	outline  string
+	payload  []byte
+	title    string
+}
+
+// Deliveries to a tee, made by a goroutine of its own so a slow tee does not delay the primary server.
+// With a 'maxInFlight' budget, no more than that many bytes of requests are queued but not yet written to the tee.
+type TeeQueue struct {
+	deliveries  chan TeeDelivery
+	done        chan struct{}
+	inFlight    int // Bytes queued.  Guarded by 'lock'.
+	isDrop      bool
+	lock        sync.Mutex
+	maxInFlight int
+	room        *sync.Cond // Signaled when queued bytes are written.
+	stopOnce    sync.Once
+	tee         Tee
+}
+
+// Read "teequeue.length" and "teequeue.overflow".  A length of 0 means tees are written in the client's read loop.
+func loadTeeQueue() (int, bool, error) {
+	length := viper.GetInt("teequeue.length")
+	if length < 0 {
+		return 0, false, fmt.Errorf("teequeue.length %d is negative", length)
+	}
+	overflow := strings.ToLower(viper.GetString("teequeue.overflow"))
+	switch overflow {
+	case "", TEE_QUEUE_OVERFLOW_BLOCK:
+		return length, false, nil
+	case TEE_QUEUE_OVERFLOW_DROP:
+		return length, true, nil
+	}
+	return 0, false, fmt.Errorf("teequeue.overflow '%s' is not '%s' or '%s'", overflow, TEE_QUEUE_OVERFLOW_BLOCK, TEE_QUEUE_OVERFLOW_DROP)
+}
+
+// Whether tees[1:] are written from queues: with "teequeue.length", or for a tee with a "maxinflight" budget.
+// Returns the queue's length and whether a full queue drops messages, by the tee's "overflow" or "teequeue.overflow".
+func teeQueueConfig(tee Tee, length int, isDrop bool) (int, bool, bool) {
+	if length == 0 && tee.MaxInFlight == 0 {
+		return 0, false, false
+	}
+	if length == 0 {
+		length = TEE_QUEUE_LENGTH_DEFAULT
+	}
+	if tee.Overflow != "" {
+		isDrop = tee.Overflow == TEE_QUEUE_OVERFLOW_DROP
+	}
+	return length, isDrop, true
+}
+
+// Start delivering to 'tee'.  If a delivery fails, the client is disconnected, as it is without a queue,
+// and later deliveries are discarded.
+func startTeeQueue(ctx context.Context, inbound Inbound, tee Tee, length int, isDrop bool) *TeeQueue {
+	result := &TeeQueue{
+		deliveries:  make(chan TeeDelivery, length),
+		done:        make(chan struct{}),
+		isDrop:      isDrop,
+		maxInFlight: tee.MaxInFlight,
+		tee:         tee,
+	}
+	result.room = sync.NewCond(&result.lock)
+	go func() {
+		defer close(result.done)
+		isFailed := false
+		for delivery := range result.deliveries {
+			if !isFailed && !deliverRecovered(ctx, inbound, tee, delivery) {
+				inbound.Connection.Close()
+				isFailed = true
+			}
+			result.release(len(delivery.payload))
+		}
+	}()
+	return result
+}
+
+// Deliver from a queue's goroutine.  A panic is recovered as in the connection's other goroutines,
+// and is a failed delivery, so the queue is still drained.
+func deliverRecovered(ctx context.Context, inbound Inbound, tee Tee, delivery TeeDelivery) (isDelivered bool) {
+	defer recoverConnection(ctx, tee.Id, inbound.Connection, []Tee{tee})
+	return deliver(ctx, inbound, tee, delivery)
+}
+
+// Queue a delivery.  With TEE_QUEUE_OVERFLOW_DROP, a full queue, or one with 'maxInFlight' bytes, drops it.
+// Otherwise, send waits for room.
+func (queue *TeeQueue) send(delivery TeeDelivery) {
+	if !queue.reserve(len(delivery.payload)) {
+		log.Printf("Queue for '%s' has maxinflight %d bytes. Message dropped.\n", queue.tee.Id, queue.maxInFlight)
+		return
+	}
+	if !queue.isDrop {
+		queue.deliveries <- delivery
+		return
+	}
+	select {
+	case queue.deliveries <- delivery:
+	default:
+		queue.release(len(delivery.payload))
+		log.Printf("Queue for '%s' is full. Message dropped.\n", queue.tee.Id)
+	}
+}
+
+// Count 'count' bytes as queued, within 'maxInFlight'.  Returns false if they would exceed it and the queue drops.
+// A request larger than 'maxInFlight' is queued once nothing else is.
+func (queue *TeeQueue) reserve(count int) bool {
+	if queue.maxInFlight <= 0 {
+		return true
+	}
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for queue.inFlight > 0 && queue.inFlight+count > queue.maxInFlight {
+		if queue.isDrop {
+			return false
+		}
+		queue.room.Wait()
+	}
+	queue.inFlight += count
+	return true
+}
+
+// Count 'count' queued bytes as written.
+func (queue *TeeQueue) release(count int) {
+	if queue.maxInFlight <= 0 {
+		return
+	}
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.inFlight -= count
+	queue.room.Broadcast()
+}
+
+// Wait for queued deliveries to be made.  No more may be sent.
+// A tee that does not take them within TEE_QUEUE_STOP_TIMEOUT has its connection closed,
+// so a write blocked on it fails and the rest of the queue is discarded.
+func (queue *TeeQueue) stop() {
+	queue.stopOnce.Do(func() {
+		close(queue.deliveries)
+	})
+	select {
+	case <-queue.done:
+		return
+	case <-time.After(TEE_QUEUE_STOP_TIMEOUT):
+	}
+	log.Printf("Queue for '%s' not written within %s. Connection closed.\n", queue.tee.Id, TEE_QUEUE_STOP_TIMEOUT)
+	queue.tee.Connection.Close()
+	<-queue.done
+}
@@ -0,0 +1,54 @@
+package net
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Zone of the timestamps in output files and log messages, from "timestamp.timezone".
+// If nil, output files use local time and log messages UTC.
+var timestampLocation *time.Location
+
+// Read "timestamp.timezone": "UTC", "Local", or an IANA name such as "America/New_York".
+// Log messages are then timestamped in the zone too.
+func loadTimezone() error {
+	value := viper.GetString("timestamp.timezone")
+	if value == "" {
+		return nil
+	}
+	location, err := time.LoadLocation(value)
+	if err != nil {
+		return fmt.Errorf("timestamp.timezone '%s' is not 'UTC', 'Local', or an IANA time zone name. Err: %+v", value, err)
+	}
+	timestampLocation = location
+	log.SetFlags(0)
+	log.SetOutput(&timestampWriter{location: location, writer: log.Writer()})
+	return nil
+}
+
+// A time in the zone of "timestamp.timezone".
+func timestamp(when time.Time) time.Time {
+	if timestampLocation == nil {
+		return when
+	}
+	return when.In(timestampLocation)
+}
+
+// Prefixes each log message with the time in 'location', in the layout of the standard logger.
+// The standard logger can only use UTC or local time.
+type timestampWriter struct {
+	location *time.Location
+	writer   io.Writer
+}
+
+func (timestampWriter *timestampWriter) Write(message []byte) (int, error) {
+	prefix := time.Now().In(timestampWriter.location).Format("2006/01/02 15:04:05 ")
+	if _, err := timestampWriter.writer.Write(append([]byte(prefix), message...)); err != nil {
+		return 0, err
+	}
+	return len(message), nil
+}
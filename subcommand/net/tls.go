@@ -0,0 +1,168 @@
+package net
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Longest time an accepted connection may take to complete the TLS handshake.
+const TLS_HANDSHAKE_TIMEOUT = time.Second * 10
+
+// TLS configuration for the inbound listener, from "inbound.certfile", "inbound.keyfile", and "inbound.clientca".
+// Returns nil if "inbound.certfile" is not set.
+// With "inbound.clientca", clients must present a certificate signed by one of its CAs (mutual TLS).
+func inboundTlsConfig() (*tls.Config, error) {
+	certFile := viper.GetString("inbound.certfile")
+	keyFile := viper.GetString("inbound.keyfile")
+	clientCa := viper.GetString("inbound.clientca")
+	if certFile == "" {
+		if clientCa != "" {
+			return nil, fmt.Errorf("inbound.clientca requires inbound.certfile and inbound.keyfile")
+		}
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	result := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+	}
+	if clientCa != "" {
+		pem, err := ioutil.ReadFile(clientCa)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("inbound.clientca '%s' has no PEM certificates", clientCa)
+		}
+		result.ClientCAs = pool
+		result.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return result, nil
+}
+
+// TLS configuration for connecting to the primary server, from the "outbound.tls" block.
+// Returns nil if there is no block.
+func outboundTlsConfig() (*tls.Config, error) {
+	if !viper.IsSet("outbound.tls") {
+		return nil, nil
+	}
+	return clientTlsConfig(viper.GetStringMap("outbound.tls"))
+}
+
+// TLS configuration for connecting to a server, from a "tls" block of "certfile", "keyfile", "cafile", and "servername".
+// With "certfile" and "keyfile", the certificate is presented to the server (mutual TLS).
+// With "cafile", the server must have a certificate signed by one of its CAs; otherwise the system CAs are used.
+func clientTlsConfig(block map[string]interface{}) (*tls.Config, error) {
+	certFile, _ := block["certfile"].(string)
+	keyFile, _ := block["keyfile"].(string)
+	caFile, _ := block["cafile"].(string)
+	serverName, _ := block["servername"].(string)
+	result := &tls.Config{
+		ServerName: serverName,
+	}
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		result.Certificates = []tls.Certificate{certificate}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("cafile '%s' has no PEM certificates", caFile)
+		}
+		result.RootCAs = pool
+	}
+	return result, nil
+}
+
+// Start TLS on a connection to 'address' and complete the handshake.
+// Without a configured "servername", the host of 'address' is expected in the server's certificate.
+func tlsClient(connection net.Conn, config *tls.Config, address string) (net.Conn, error) {
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConnection := tls.Client(connection, config)
+	tlsConnection.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+	defer tlsConnection.SetDeadline(time.Time{})
+	if err := tlsConnection.Handshake(); err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return tlsConnection, nil
+}
+
+// Complete the TLS handshake of an accepted connection.
+// Returns nil for connections that are not TLS.
+func handshake(connection net.Conn) (*tls.ConnectionState, error) {
+	tlsConnection, ok := connection.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	tlsConnection.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+	defer tlsConnection.SetDeadline(time.Time{})
+	if err := tlsConnection.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tlsConnection.ConnectionState()
+	return &state, nil
+}
+
+// Describe the verified client certificate of a connection, or "" if there is none.
+func clientIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return certificateIdentity(state.PeerCertificates[0])
+}
+
+// Describe the negotiated TLS parameters of a connection, or "" if it is not TLS.
+func tlsDetails(state *tls.ConnectionState) string {
+	if state == nil {
+		return ""
+	}
+	return fmt.Sprintf("version=%s cipher=%s sni=%s", tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.ServerName)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// Describe a certificate by its common name and subject alternative names.
+func certificateIdentity(certificate *x509.Certificate) string {
+	names := append([]string{}, certificate.DNSNames...)
+	names = append(names, certificate.EmailAddresses...)
+	for _, address := range certificate.IPAddresses {
+		names = append(names, address.String())
+	}
+	for _, uri := range certificate.URIs {
+		names = append(names, uri.String())
+	}
+	return fmt.Sprintf("CN=%s SANs=[%s]", certificate.Subject.CommonName, strings.Join(names, ", "))
+}
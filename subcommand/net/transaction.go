@@ -0,0 +1,98 @@
+package net
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	FRAMING_READ        = "read"        // Each read is logged as its own block.
+	FRAMING_TRANSACTION = "transaction" // Client requests and the server's responses are logged together.
+)
+
+// Return the "framing" configuration value, defaulting to "read".
+// "framing" may instead be an object, so it can also hold "framing.maxbuffer"; its "mode" is then the value.
+// "transaction" is not available for the "binaryfile" and "json" formats, whose files have a fixed layout.
+func framing() (string, error) {
+	key := "framing"
+	if _, isObject := viper.Get(key).(map[string]interface{}); isObject {
+		key = "framing.mode"
+	}
+	value := strings.ToLower(viper.GetString(key))
+	switch value {
+	case "":
+		return FRAMING_READ, nil
+	case FRAMING_READ:
+		return value, nil
+	case FRAMING_TRANSACTION:
+		format := viper.GetString(FORMAT)
+		if format == FORMAT_BINARY_FILE || format == FORMAT_JSON {
+			return "", fmt.Errorf("framing '%s' is not available for format '%s'", value, format)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("framing '%s' is not '%s' or '%s'", value, FRAMING_READ, FRAMING_TRANSACTION)
+}
+
+// Blocks of one tee's file, held until a transaction is complete.
+// A transaction is the client requests up to the first response, and the responses up to the next request.
+type Transaction struct {
+	file      *OutputFile
+	id        uint64
+	lock      sync.Mutex
+	requests  []string
+	responses []string
+}
+
+// Add a client request block.  A request after responses completes the previous transaction.
+func (transaction *Transaction) request(outline string) {
+	transaction.lock.Lock()
+	defer transaction.lock.Unlock()
+	if len(transaction.responses) > 0 {
+		transaction.write()
+	}
+	transaction.requests = append(transaction.requests, outline)
+}
+
+// Add a server response block.
+func (transaction *Transaction) response(outline string) {
+	transaction.lock.Lock()
+	defer transaction.lock.Unlock()
+	transaction.responses = append(transaction.responses, outline)
+}
+
+// Write the transaction in progress, e.g. when the connection ends.
+func (transaction *Transaction) flush() {
+	if transaction == nil {
+		return
+	}
+	transaction.lock.Lock()
+	defer transaction.lock.Unlock()
+	if len(transaction.requests) > 0 || len(transaction.responses) > 0 {
+		transaction.write()
+	}
+}
+
+// Write the held blocks between transaction rules.  Caller holds the lock.
+func (transaction *Transaction) write() {
+	transaction.id++
+	title := fmt.Sprintf("Transaction %d", transaction.id)
+	blocks := append(transaction.requests, transaction.responses...)
+	_, _ = transaction.file.WriteString(transactionRule(title) + "\n" + strings.Join(blocks, "") + transactionRule("End of "+strings.ToLower(title)) + blockSeparator())
+	transaction.requests = nil
+	transaction.responses = nil
+}
+
+// Like horizontalRule(), with "=" so transactions stand out from the blocks they contain.
+func transactionRule(title string) string {
+	newTitle := timestamp(time.Now()).Round(0).String() + " " + title
+	padding := 68 - len(newTitle)
+	if padding < 8 {
+		padding = 8
+	}
+	return "======== " + newTitle + " " + strings.Repeat("=", padding)
+}
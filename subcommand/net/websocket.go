@@ -0,0 +1,222 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// WebSocket opcodes.  See RFC 6455, section 5.2.
+const (
+	WEBSOCKET_OPCODE_CONTINUATION = 0x0
+	WEBSOCKET_OPCODE_TEXT         = 0x1
+	WEBSOCKET_OPCODE_BINARY       = 0x2
+	WEBSOCKET_OPCODE_CLOSE        = 0x8
+	WEBSOCKET_OPCODE_PING         = 0x9
+	WEBSOCKET_OPCODE_PONG         = 0xA
+)
+
+var websocketOpcodeNames = map[byte]string{
+	WEBSOCKET_OPCODE_CONTINUATION: "continuation",
+	WEBSOCKET_OPCODE_TEXT:         "text",
+	WEBSOCKET_OPCODE_BINARY:       "binary",
+	WEBSOCKET_OPCODE_CLOSE:        "close",
+	WEBSOCKET_OPCODE_PING:         "ping",
+	WEBSOCKET_OPCODE_PONG:         "pong",
+}
+
+// The header of a WebSocket frame.
+type WebsocketHeader struct {
+	fin          bool
+	headerLength int
+	isMasked     bool
+	mask         [4]byte
+	opcode       byte
+	length       uint64 // Of the payload.
+	rsv          byte
+}
+
+// The part of a frame's payload that was not in the message read, expected at the start of the next one.
+// Or, if 'partialHeader' is set, the start of a frame header cut off by the end of the message.
+type websocketContinuation struct {
+	maskIndex     int // Position in the payload, for unmasking.
+	header        WebsocketHeader
+	partialHeader []byte // Parsed with the next message.
+	remaining     uint64
+}
+
+// Parse a frame header.  Returns false if 'data' is too short to hold it.
+func parseWebsocketHeader(data []byte) (WebsocketHeader, bool) {
+	header := WebsocketHeader{}
+	if len(data) < 2 {
+		return header, false
+	}
+	header.fin = data[0]&0x80 != 0
+	header.rsv = data[0] & 0x70
+	header.opcode = data[0] & 0x0f
+	header.isMasked = data[1]&0x80 != 0
+	header.length = uint64(data[1] & 0x7f)
+	header.headerLength = 2
+	switch header.length {
+	case 126:
+		if len(data) < 4 {
+			return header, false
+		}
+		header.length = uint64(binary.BigEndian.Uint16(data[2:4]))
+		header.headerLength = 4
+	case 127:
+		if len(data) < 10 {
+			return header, false
+		}
+		header.length = binary.BigEndian.Uint64(data[2:10])
+		header.headerLength = 10
+	}
+	if header.isMasked {
+		if len(data) < header.headerLength+4 {
+			return header, false
+		}
+		copy(header.mask[:], data[header.headerLength:header.headerLength+4])
+		header.headerLength += 4
+	}
+	return header, true
+}
+
+// Whether the header could begin a frame: no extension bits, and a defined opcode.
+func (header WebsocketHeader) isValid() bool {
+	_, ok := websocketOpcodeNames[header.opcode]
+	return ok && header.rsv == 0
+}
+
+func (header WebsocketHeader) describe() string {
+	return fmt.Sprintf("opcode=%s fin=%t masked=%t length=%d", websocketOpcodeNames[header.opcode], header.fin, header.isMasked, header.length)
+}
+
+// Unmask a payload that begins at 'maskIndex' of its frame's payload.
+func unmaskWebsocket(payload []byte, header WebsocketHeader, maskIndex int) []byte {
+	if !header.isMasked {
+		return payload
+	}
+	result := make([]byte, len(payload))
+	for index, value := range payload {
+		result[index] = value ^ header.mask[(maskIndex+index)%4]
+	}
+	return result
+}
+
+// A payload for logging: text as text, a close frame's status code and reason, and other payloads
+// as text if printable, otherwise in hex.
+func describeWebsocketPayload(header WebsocketHeader, payload []byte, streamOffset int) string {
+	switch {
+	case len(payload) == 0:
+		return ""
+	case header.opcode == WEBSOCKET_OPCODE_TEXT:
+		return string(payload) + "\n"
+	case header.opcode == WEBSOCKET_OPCODE_CLOSE && len(payload) >= 2:
+		return fmt.Sprintf("code=%d reason='%s'\n", binary.BigEndian.Uint16(payload[0:2]), payload[2:])
+	case detectFormat(payload) == FORMAT_STRING:
+		return string(payload) + "\n"
+	}
+	return hexDump(payload, hexWidth(), hexBaseOffset(streamOffset))
+}
+
+// 'streamOffset' is the position of 'message' in the connection stream.
+// Each frame is logged with a header describing it, then its unmasked payload.
+// A frame cut off by the end of the message is continued in the next message of its stream.
+// A frame header cut off is buffered, and the frame is logged with the message that completes the header.
+// A message that does not begin with a frame, such as the HTTP upgrade handshake, is logged as text.
+func websocketParse(ctx context.Context, direction string, teeId string, message []byte, streamOffset int) string {
+	var result strings.Builder
+	session := getSession(ctx)
+	offset := 0
+	nextOffset := streamOffset + len(message)
+	continuation, isContinued := session.takeWebsocketContinuation(direction, teeId, streamOffset)
+
+	// The start of a frame header cut off by the end of the previous message.  Offsets are then positions
+	// in 'message', which begins with it.
+
+	if isContinued && continuation.partialHeader != nil {
+		message = append(continuation.partialHeader, message...)
+		streamOffset -= len(continuation.partialHeader)
+		isContinued = false
+	}
+
+	// The rest of a frame begun in the previous message.
+
+	if isContinued {
+		length := continuation.remaining
+		if length > uint64(len(message)) {
+			length = uint64(len(message))
+		}
+		payload := unmaskWebsocket(message[:length], continuation.header, continuation.maskIndex)
+		fmt.Fprintf(&result, "[websocket %s, continued: %d bytes]\n", continuation.header.describe(), length)
+		result.WriteString(describeWebsocketPayload(continuation.header, payload, streamOffset))
+		if length < continuation.remaining {
+			continuation.maskIndex += int(length)
+			continuation.remaining -= length
+			session.putWebsocketContinuation(direction, teeId, nextOffset, continuation)
+		}
+		offset = int(length)
+	}
+
+	for offset < len(message) {
+		header, ok := parseWebsocketHeader(message[offset:])
+		if ok && !header.isValid() {
+			if offset == 0 {
+				return string(message)
+			}
+			fmt.Fprintf(&result, "[not a websocket frame: %d bytes]\n", len(message)-offset)
+			result.WriteString(hexDump(message[offset:], hexWidth(), hexBaseOffset(streamOffset+offset)))
+			break
+		}
+		if !ok {
+			fmt.Fprintf(&result, "[websocket: %d bytes of a frame header, logged when it is complete]\n", len(message)-offset)
+			session.putWebsocketContinuation(direction, teeId, nextOffset, websocketContinuation{
+				partialHeader: append([]byte{}, message[offset:]...),
+			})
+			break
+		}
+		payloadOffset := offset + header.headerLength
+		length := header.length
+		if available := uint64(len(message) - payloadOffset); length > available {
+			length = available
+		}
+		payload := unmaskWebsocket(message[payloadOffset:payloadOffset+int(length)], header, 0)
+		if length < header.length {
+			fmt.Fprintf(&result, "[websocket %s, %d bytes here]\n", header.describe(), length)
+			session.putWebsocketContinuation(direction, teeId, nextOffset, websocketContinuation{
+				header:    header,
+				maskIndex: int(length),
+				remaining: header.length - length,
+			})
+		} else {
+			fmt.Fprintf(&result, "[websocket %s]\n", header.describe())
+		}
+		result.WriteString(describeWebsocketPayload(header, payload, streamOffset+payloadOffset))
+		offset = payloadOffset + int(length)
+	}
+	return result.String()
+}
+
+// Remove and return the continuation of a frame expected at 'offset' in 'direction' from 'teeId'.
+func (session *Session) takeWebsocketContinuation(direction string, teeId string, offset int) (websocketContinuation, bool) {
+	if session == nil {
+		return websocketContinuation{}, false
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	key := streamKey{direction: direction, offset: offset, teeId: teeId}
+	continuation, ok := session.websocket[key]
+	delete(session.websocket, key)
+	return continuation, ok
+}
+
+// Record that the rest of a frame is expected at 'offset' in 'direction' from 'teeId'.
+func (session *Session) putWebsocketContinuation(direction string, teeId string, offset int, continuation websocketContinuation) {
+	if session == nil {
+		return
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.websocket[streamKey{direction: direction, offset: offset, teeId: teeId}] = continuation
+}
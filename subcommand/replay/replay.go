@@ -0,0 +1,325 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/docktermj/go-proxy-tee/common/framing"
+	"github.com/docktermj/go-proxy-tee/common/script"
+	"github.com/docopt/docopt-go"
+)
+
+const (
+	BUFFER_LENGTH = 1024 * 64
+
+	// Longest time to wait for the server to finish responding after the capture is sent.
+
+	REPLAY_DRAIN_TIMEOUT = time.Second * 5
+)
+
+// A run of bytes from the capture: a binaryXML frame, or bytes between frames.
+type Piece struct {
+	Bytes   []byte
+	IsFrame bool
+}
+
+// How frames are mutated before they are sent.
+type Faults struct {
+	CorruptRate  float64 // Chance of flipping one bit of a frame.
+	IsReorder    bool    // Swap adjacent frames at random.
+	TruncateRate float64 // Chance of sending only part of a frame.
+}
+
+// Counts of mutated frames.
+type Mutations struct {
+	Corrupted int
+	Frames    int
+	Reordered int
+	Truncated int
+}
+
+// Outcome of replaying a script.
+type Playback struct {
+	Matched    int // Responses that were as expected.
+	Mismatched int // Responses that differed.
+	Missing    int // Responses not received within REPLAY_DRAIN_TIMEOUT.
+	Requests   int
+}
+
+// Function for the "command pattern".
+func Command(argv []string) {
+
+	usage := `
+Usage:
+    go-proxy-tee replay [options] <file> <address>
+
+Options:
+   -h, --help
+   --network=<network>        Network of <address>. [default: tcp]
+   --corrupt-rate=<rate>      Chance, from 0.0 to 1.0, of flipping one bit of each frame. [default: 0]
+   --truncate-rate=<rate>     Chance, from 0.0 to 1.0, of sending only part of each frame. [default: 0]
+   --reorder                  Swap adjacent frames at random.
+   --seed=<seed>              Seed for the mutations, to repeat a run. Default: the current time.
+   --script                   <file> is a script written by 'go-proxy-tee export-script'.
+   --quiet                    Suppress informational output; errors are still logged
+
+Where:
+   file      A 'go-proxy-tee net --format=binaryfile' capture of a client's requests, or with --script, a script.
+   address   Address of the server, or of a go-proxy-tee in front of it.
+
+Sends the bytes of <file> over one connection, mutating binaryXML frames to test how the server
+handles malformed input.  Frames are found as 'split' finds them; bytes between frames are sent unchanged.
+Each mutation is logged.  Server responses are read and discarded.
+
+With --script, the requests of the script are sent with its delays before them, and each response of the
+script is read and compared with the bytes the server sends.  Differences are logged.  Frames are not mutated.
+`
+
+	// DocOpt processing.
+
+	args, _ := docopt.Parse(usage, nil, true, "", false)
+	inputFileName := args["<file>"].(string)
+	address := args["<address>"].(string)
+	isQuiet := args["--quiet"].(bool)
+
+	faults := Faults{
+		CorruptRate:  parseRate(args, "--corrupt-rate"),
+		IsReorder:    args["--reorder"].(bool),
+		TruncateRate: parseRate(args, "--truncate-rate"),
+	}
+	seed := time.Now().UnixNano()
+	if value, ok := args["--seed"].(string); ok {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Fatalf("Bad --seed '%s'. Err: %+v\n", value, err)
+		}
+		seed = parsed
+	}
+	if args["--script"].(bool) {
+		if faults.CorruptRate > 0 || faults.TruncateRate > 0 || faults.IsReorder {
+			log.Fatalf("--script cannot be used with --corrupt-rate, --truncate-rate, or --reorder.\n")
+		}
+		lines, err := readScript(inputFileName)
+		if err != nil {
+			log.Fatalf("Reading %s failed. Err: %+v\n", inputFileName, err)
+		}
+		connection, err := net.Dial(args["--network"].(string), address)
+		if err != nil {
+			log.Fatalf("Connecting to '%s' failed. Err: %+v\n", address, err)
+		}
+		playback, err := play(connection, lines)
+		if err != nil {
+			log.Fatalf("Sending to '%s' failed. Err: %+v\n", address, err)
+		}
+		if !isQuiet {
+			log.Printf("Sent %d requests. Responses: %d matched, %d differed, %d missing.\n", playback.Requests, playback.Matched, playback.Mismatched, playback.Missing)
+		}
+		return
+	}
+
+	if !isQuiet {
+		log.Printf("Mutation seed: %d\n", seed)
+	}
+	pieces, err := readPieces(inputFileName)
+	if err != nil {
+		log.Fatalf("Reading %s failed. Err: %+v\n", inputFileName, err)
+	}
+	pieces, mutations := mutate(pieces, faults, rand.New(rand.NewSource(seed)), isQuiet)
+
+	connection, err := net.Dial(args["--network"].(string), address)
+	if err != nil {
+		log.Fatalf("Connecting to '%s' failed. Err: %+v\n", address, err)
+	}
+	if err := send(connection, pieces); err != nil {
+		log.Fatalf("Sending to '%s' failed. Err: %+v\n", address, err)
+	}
+	if !isQuiet {
+		log.Printf("Sent %d frames: %d corrupted, %d truncated, %d reordered.\n", mutations.Frames, mutations.Corrupted, mutations.Truncated, mutations.Reordered)
+	}
+}
+
+// Parse a rate option, which must be from 0.0 to 1.0.
+func parseRate(args map[string]interface{}, option string) float64 {
+	value := args[option].(string)
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		log.Fatalf("Bad %s '%s'. It must be from 0.0 to 1.0. Err: %+v\n", option, value, err)
+	}
+	return rate
+}
+
+// Split 'inputFileName' into frames and the bytes between them.
+func readPieces(inputFileName string) ([]Piece, error) {
+	inputFile, err := os.Open(inputFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer inputFile.Close()
+	reader := bufio.NewReaderSize(inputFile, BUFFER_LENGTH)
+
+	pieces := []Piece{}
+	unframed := []byte{}
+	for {
+		token, err := reader.Peek(1)
+		if err != nil {
+			break
+		}
+		var frame []byte
+		isPeeked := false
+		if token[0] == framing.BINARY_XML_START {
+			frame, isPeeked = framing.Peek(reader)
+		}
+		if frame == nil {
+			unframed = append(unframed, token[0])
+			reader.Discard(1)
+			continue
+		}
+		if isPeeked {
+			reader.Discard(len(frame))
+		}
+		if len(unframed) > 0 {
+			pieces = append(pieces, Piece{Bytes: unframed})
+			unframed = []byte{}
+		}
+		pieces = append(pieces, Piece{Bytes: frame, IsFrame: true})
+	}
+	if len(unframed) > 0 {
+		pieces = append(pieces, Piece{Bytes: unframed})
+	}
+	return pieces, nil
+}
+
+// Apply 'faults' to the frames of 'pieces'.  Frames are numbered from 1, in capture order, in the log.
+func mutate(pieces []Piece, faults Faults, random *rand.Rand, isQuiet bool) ([]Piece, Mutations) {
+	mutations := Mutations{}
+	logf := func(format string, values ...interface{}) {
+		if !isQuiet {
+			log.Printf(format, values...)
+		}
+	}
+
+	// Number the frames before they are reordered.
+
+	numbers := make([]int, len(pieces))
+	for index, piece := range pieces {
+		if piece.IsFrame {
+			mutations.Frames++
+			numbers[index] = mutations.Frames
+		}
+	}
+
+	if faults.IsReorder {
+		previous := -1 // Index of the frame before, if it has not been swapped.
+		for index, piece := range pieces {
+			if !piece.IsFrame {
+				continue
+			}
+			if previous >= 0 && random.Intn(2) == 0 {
+				pieces[previous], pieces[index] = pieces[index], pieces[previous]
+				numbers[previous], numbers[index] = numbers[index], numbers[previous]
+				logf("Frame %d: swapped with frame %d\n", numbers[previous], numbers[index])
+				mutations.Reordered += 2
+				previous = -1
+				continue
+			}
+			previous = index
+		}
+	}
+
+	for index, piece := range pieces {
+		if !piece.IsFrame {
+			continue
+		}
+		frame := append([]byte{}, piece.Bytes...)
+		if random.Float64() < faults.CorruptRate {
+			offset := random.Intn(len(frame))
+			bit := uint(random.Intn(8))
+			frame[offset] ^= 1 << bit
+			logf("Frame %d: flipped bit %d of byte %d\n", numbers[index], bit, offset)
+			mutations.Corrupted++
+		}
+		if len(frame) > 1 && random.Float64() < faults.TruncateRate {
+			length := 1 + random.Intn(len(frame)-1)
+			logf("Frame %d: truncated from %d to %d bytes\n", numbers[index], len(frame), length)
+			frame = frame[:length]
+			mutations.Truncated++
+		}
+		pieces[index].Bytes = frame
+	}
+	return pieces, mutations
+}
+
+// Write 'pieces' in order, then wait for the server to finish responding.
+func send(connection net.Conn, pieces []Piece) error {
+	defer connection.Close()
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, connection)
+		close(drained)
+	}()
+	for _, piece := range pieces {
+		if _, err := connection.Write(piece.Bytes); err != nil {
+			return err
+		}
+	}
+	if closer, ok := connection.(interface{ CloseWrite() error }); ok {
+		if err := closer.CloseWrite(); err != nil {
+			return fmt.Errorf("CloseWrite() failed: %v", err)
+		}
+	}
+	select {
+	case <-drained:
+	case <-time.After(REPLAY_DRAIN_TIMEOUT):
+	}
+	return nil
+}
+
+// Read the lines of a script.
+func readScript(inputFileName string) ([]script.Line, error) {
+	inputFile, err := os.Open(inputFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer inputFile.Close()
+	return script.Read(inputFile)
+}
+
+// Send the requests of 'lines', each after its delay, and compare the server's bytes with the responses of 'lines'.
+// Lines are numbered from 1, in script order, in the log.
+func play(connection net.Conn, lines []script.Line) (Playback, error) {
+	defer connection.Close()
+	playback := Playback{}
+	for index, line := range lines {
+		time.Sleep(line.Delay)
+		if line.Direction == script.DIRECTION_REQUEST {
+			if _, err := connection.Write(line.Payload); err != nil {
+				return playback, err
+			}
+			playback.Requests++
+			continue
+		}
+		received := make([]byte, len(line.Payload))
+		connection.SetReadDeadline(time.Now().Add(REPLAY_DRAIN_TIMEOUT))
+		length, err := io.ReadFull(connection, received)
+		switch {
+		case err != nil:
+			log.Printf("Line %d: expected a %d byte response, received %d bytes. Err: %+v\n", index+1, len(line.Payload), length, err)
+			playback.Missing++
+		case !bytes.Equal(received, line.Payload):
+			log.Printf("Line %d: response differs.\nExpected: %x\nReceived: %x\n", index+1, line.Payload, received)
+			playback.Mismatched++
+		default:
+			playback.Matched++
+		}
+	}
+	return playback, nil
+}
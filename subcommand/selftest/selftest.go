@@ -0,0 +1,237 @@
+package selftest
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	proxy "github.com/docktermj/go-proxy-tee/subcommand/net"
+	"github.com/docopt/docopt-go"
+)
+
+// Longest time to wait for the proxy to start and for output to reach the files.
+const SELFTEST_TIMEOUT = time.Second * 5
+
+// Text and binary bytes sent through the proxy.
+var payload = []byte("go-proxy-tee selftest\x00\x01\x02\xfe\xff")
+
+// Function for the "command pattern".
+func Command(argv []string) {
+
+	usage := `
+Usage:
+    go-proxy-tee selftest [options]
+
+Options:
+   -h, --help
+   --keep      Keep the temporary directory of configuration and output files.
+
+Runs the proxy in-process against loopback echo servers, sends a known payload through it,
+and verifies the payload returns intact and the tee files contain it in "hex" format.
+Exits 0 on success; prints the differences and exits 1 on failure.
+`
+
+	// DocOpt processing.
+
+	args, _ := docopt.Parse(usage, nil, true, "", false)
+
+	directory, err := ioutil.TempDir("", "go-proxy-tee-selftest")
+	if err != nil {
+		log.Fatalf("ioutil.TempDir() failed. Err: %+v\n", err)
+	}
+	if args["--keep"].(bool) {
+		fmt.Printf("Files in %s\n", directory)
+	} else {
+		defer os.RemoveAll(directory)
+	}
+
+	failures := run(directory)
+	if len(failures) > 0 {
+		for _, failure := range failures {
+			fmt.Println(failure)
+		}
+		fmt.Println("selftest FAILED")
+		if !args["--keep"].(bool) {
+			os.RemoveAll(directory)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("selftest passed")
+}
+
+// Run the proxy and return descriptions of what went wrong.
+func run(directory string) []string {
+
+	// Servers the proxy connects to.
+
+	outbound := echoServer()
+	defer outbound.Close()
+	tee := echoServer()
+	defer tee.Close()
+	inboundAddress := freeAddress()
+
+	outboundOutput := filepath.Join(directory, "server-1.txt")
+	teeOutput := filepath.Join(directory, "server-2.txt")
+	config := fmt.Sprintf(`{
+	"format": "hex",
+	"inbound": {"network": "tcp", "address": %q, "output": %q},
+	"outbound": {"network": "tcp", "address": %q, "output": %q},
+	"tee": [{"name": "server-2", "network": "tcp", "address": %q, "output": %q}]
+}
+`, inboundAddress, filepath.Join(directory, "client.txt"), outbound.Addr().String(), outboundOutput, tee.Addr().String(), teeOutput)
+	if err := ioutil.WriteFile(filepath.Join(directory, "go-proxy-tee.json"), []byte(config), 0644); err != nil {
+		return []string{fmt.Sprintf("Writing configuration failed. Err: %+v", err)}
+	}
+
+	// Run the real proxy loop in-process.
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		proxy.Run(ctx, []string{"net", "--configPath=" + directory, "--quiet"})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Send the payload and read it back.
+
+	client, err := dial(inboundAddress)
+	if err != nil {
+		return []string{fmt.Sprintf("Connecting to the proxy at %s failed. Err: %+v", inboundAddress, err)}
+	}
+	defer client.Close()
+	if _, err := client.Write(payload); err != nil {
+		return []string{fmt.Sprintf("Writing to the proxy failed. Err: %+v", err)}
+	}
+	client.SetReadDeadline(time.Now().Add(SELFTEST_TIMEOUT))
+	received := make([]byte, len(payload))
+	if _, err := io.ReadFull(client, received); err != nil {
+		return []string{fmt.Sprintf("Reading from the proxy failed. Err: %+v", err)}
+	}
+
+	failures := []string{}
+	if string(received) != string(payload) {
+		failures = append(failures, fmt.Sprintf("Payload changed by the proxy:\n%s", diff(hex.Dump(payload), hex.Dump(received))))
+	}
+
+	// Each tee file has the request and that server's response, formatted as "hex".
+
+	for _, fileName := range []string{outboundOutput, teeOutput} {
+		if failure := verifyFile(fileName); failure != "" {
+			failures = append(failures, failure)
+		}
+	}
+	return failures
+}
+
+// Wait for a tee file to contain the expected blocks.  Returns "" if it does.
+func verifyFile(fileName string) string {
+	expected := []string{
+		"Client request",
+		hex.Dump(payload),
+		"Server response",
+		hex.Dump(payload),
+	}
+	deadline := time.Now().Add(SELFTEST_TIMEOUT)
+	for {
+		contents, _ := ioutil.ReadFile(fileName)
+		if containsInOrder(string(contents), expected) {
+			return ""
+		}
+		if time.Now().After(deadline) {
+			return fmt.Sprintf("%s does not contain the expected output:\n%s", fileName, diff(strings.Join(expected, "\n"), string(contents)))
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func containsInOrder(contents string, expected []string) bool {
+	for _, part := range expected {
+		index := strings.Index(contents, part)
+		if index < 0 {
+			return false
+		}
+		contents = contents[index+len(part):]
+	}
+	return true
+}
+
+// Line-by-line differences: "-" for expected lines that are missing, "+" for unexpected lines.
+func diff(expected string, actual string) string {
+	contains := func(lines []string, line string) bool {
+		for _, candidate := range lines {
+			if strings.Contains(candidate, line) {
+				return true
+			}
+		}
+		return false
+	}
+	expectedLines := strings.Split(strings.TrimRight(expected, "\n"), "\n")
+	actualLines := strings.Split(strings.TrimRight(actual, "\n"), "\n")
+	result := []string{}
+	for _, line := range expectedLines {
+		if !contains(actualLines, line) {
+			result = append(result, "- "+line)
+		}
+	}
+	for _, line := range actualLines {
+		if line != "" && !contains(expectedLines, line) {
+			result = append(result, "+ "+line)
+		}
+	}
+	return strings.Join(result, "\n")
+}
+
+// A loopback server that returns what it receives.
+func echoServer() net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Echo server net.Listen() failed. Err: %+v\n", err)
+	}
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer connection.Close()
+				io.Copy(connection, connection)
+			}()
+		}
+	}()
+	return listener
+}
+
+// A loopback address that is not in use.
+func freeAddress() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("net.Listen() failed. Err: %+v\n", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// Connect to the proxy, waiting for it to start listening.
+func dial(address string) (net.Conn, error) {
+	deadline := time.Now().Add(SELFTEST_TIMEOUT)
+	for {
+		connection, err := net.Dial("tcp", address)
+		if err == nil || time.Now().After(deadline) {
+			return connection, err
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
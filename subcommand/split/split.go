@@ -0,0 +1,125 @@
+package split
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/docktermj/go-proxy-tee/common/decode"
+	"github.com/docktermj/go-proxy-tee/common/framing"
+	"github.com/docopt/docopt-go"
+)
+
+const (
+	BUFFER_LENGTH = 1024 * 64
+)
+
+// Function for the "command pattern".
+func Command(argv []string) {
+
+	usage := `
+Usage:
+    go-proxy-tee split [options] <file>
+
+Options:
+   -h, --help
+   --out=<directory>   Directory for the message files. [default: .]
+   --xml               Also write each message's decoded XML
+   --quiet             Suppress informational output; errors are still logged
+
+Where:
+   file   A 'go-proxy-tee net --format=binaryfile' capture.
+
+Writes each binaryXML frame in <file> to message-0001.bin, message-0002.bin, ...
+With --xml, the decoded XML is written to message-0001.xml, ... alongside.
+Bytes between frames are skipped.
+`
+
+	// DocOpt processing.
+
+	args, _ := docopt.Parse(usage, nil, true, "", false)
+	inputFileName := args["<file>"].(string)
+	directory := args["--out"].(string)
+	isXml := args["--xml"].(bool)
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		log.Fatalf("os.MkdirAll(%s) failed. Err: %+v\n", directory, err)
+	}
+	messages, skipped, err := split(inputFileName, directory, isXml)
+	if err != nil {
+		log.Fatalf("Splitting %s failed. Err: %+v\n", inputFileName, err)
+	}
+	if !args["--quiet"].(bool) {
+		log.Printf("Wrote %d messages to %s. Skipped %d bytes between frames.\n", messages, directory, skipped)
+	}
+}
+
+// Write each frame of 'inputFileName' to its own file.  Returns the number of frames and of skipped bytes.
+func split(inputFileName string, directory string, isXml bool) (int, int, error) {
+	inputFile, err := os.Open(inputFileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer inputFile.Close()
+	reader := bufio.NewReaderSize(inputFile, BUFFER_LENGTH)
+
+	messages := 0
+	skipped := 0
+	for {
+		token, err := reader.Peek(1)
+		if err != nil {
+			break
+		}
+		var frame []byte
+		isPeeked := false
+		if token[0] == framing.BINARY_XML_START {
+			frame, isPeeked = framing.Peek(reader)
+		}
+		if frame == nil {
+			reader.Discard(1)
+			skipped++
+			continue
+		}
+		if isPeeked {
+			reader.Discard(len(frame))
+		}
+
+		messages++
+		name := filepath.Join(directory, fmt.Sprintf("message-%04d", messages))
+		if err := ioutil.WriteFile(name+".bin", frame, 0644); err != nil {
+			return messages, skipped, err
+		}
+		if isXml {
+			if err := writeXml(name+".xml", frame); err != nil {
+				return messages, skipped, err
+			}
+		}
+	}
+	return messages, skipped, nil
+}
+
+// Decode a frame and write its XML.  A frame that does not decode is logged, and no file is written.
+func writeXml(fileName string, frame []byte) error {
+	ctx := context.Background()
+	var param uint8
+	xmlBuffer := make([]byte, 4096)
+	if err := decode.ReadMessage(ctx, decode.DEFAULT_TIMEOUT, bytes.NewReader(frame), &param, &xmlBuffer); err != nil {
+		log.Printf("binaryxml.ReadMessage() failed for %s. Err: %+v\n", fileName, err)
+		return nil
+	}
+	xmlString, err := decode.ToXML(ctx, decode.DEFAULT_TIMEOUT, xmlBuffer)
+	if err != nil {
+		log.Printf("binaryxml.ToXML() failed for %s. Err: %+v\n", fileName, err)
+		return nil
+	}
+	formattedXml, err := decode.Indent([]byte(xmlString))
+	if err != nil {
+		formattedXml = []byte(xmlString)
+	}
+	return ioutil.WriteFile(fileName, append(formattedXml, '\n'), 0644)
+}
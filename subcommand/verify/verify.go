@@ -0,0 +1,133 @@
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/docktermj/go-proxy-tee/common/decode"
+	"github.com/docktermj/go-proxy-tee/common/framing"
+	"github.com/docopt/docopt-go"
+)
+
+const (
+	BUFFER_LENGTH = 1024 * 64
+)
+
+// A frame, or run of bytes between frames, that did not verify.
+type Problem struct {
+	Description string
+	Offset      int
+}
+
+// Function for the "command pattern".
+func Command(argv []string) {
+
+	usage := `
+Usage:
+    go-proxy-tee verify [options] <file>
+
+Options:
+   -h, --help
+   --quiet     Suppress informational output; errors are still logged
+
+Where:
+   file   A 'go-proxy-tee net --format=binaryfile' capture.
+
+Walks <file> frame by frame, decoding each binaryXML message as 'binaryfile' does.
+Prints the byte offset of each frame that does not decode and of bytes that are not in a frame,
+such as a truncated last frame.  Exits 0 if every frame verifies and 1 otherwise.
+`
+
+	// DocOpt processing.
+
+	args, _ := docopt.Parse(usage, nil, true, "", false)
+	inputFileName := args["<file>"].(string)
+
+	frames, problems, err := verify(inputFileName)
+	if err != nil {
+		log.Fatalf("Verifying %s failed. Err: %+v\n", inputFileName, err)
+	}
+	for _, problem := range problems {
+		fmt.Printf("%s: offset %d: %s\n", inputFileName, problem.Offset, problem.Description)
+	}
+	if !args["--quiet"].(bool) {
+		fmt.Printf("%s: %d frames, %d problems\n", inputFileName, frames, len(problems))
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// Walk the frames of 'inputFileName'.  Returns the number of frames that verified and the problems found.
+func verify(inputFileName string) (int, []Problem, error) {
+	inputFile, err := os.Open(inputFileName)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer inputFile.Close()
+	reader := bufio.NewReaderSize(inputFile, BUFFER_LENGTH)
+
+	frames := 0
+	problems := []Problem{}
+	offset := 0
+	unframedOffset := -1 // Start of the current run of bytes outside frames.
+	endUnframed := func() {
+		if unframedOffset >= 0 {
+			problems = append(problems, Problem{
+				Description: fmt.Sprintf("%d bytes outside frames", offset-unframedOffset),
+				Offset:      unframedOffset,
+			})
+			unframedOffset = -1
+		}
+	}
+	for {
+		token, err := reader.Peek(1)
+		if err != nil {
+			break
+		}
+		var frame []byte
+		isPeeked := false
+		if token[0] == framing.BINARY_XML_START {
+			frame, isPeeked = framing.Peek(reader)
+		}
+		if frame == nil {
+			if unframedOffset < 0 {
+				unframedOffset = offset
+			}
+			reader.Discard(1)
+			offset++
+			continue
+		}
+		if isPeeked {
+			reader.Discard(len(frame))
+		}
+		endUnframed()
+		if err := verifyFrame(frame); err != nil {
+			problems = append(problems, Problem{
+				Description: fmt.Sprintf("%d byte frame does not decode: %s", len(frame), err),
+				Offset:      offset,
+			})
+		} else {
+			frames++
+		}
+		offset += len(frame)
+	}
+	endUnframed()
+	return frames, problems, nil
+}
+
+// Decode a frame as "binaryfile" does: its framing by messages.ReadMessage(), then its binaryXML.
+func verifyFrame(frame []byte) error {
+	ctx := context.Background()
+	var param uint8
+	xmlBuffer := make([]byte, 4096)
+	if err := decode.ReadMessage(ctx, decode.DEFAULT_TIMEOUT, bytes.NewReader(frame), &param, &xmlBuffer); err != nil {
+		return err
+	}
+	_, err := decode.ToXML(ctx, decode.DEFAULT_TIMEOUT, xmlBuffer)
+	return err
+}
@@ -0,0 +1,298 @@
+package view
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docktermj/go-proxy-tee/common/decode"
+	"github.com/docktermj/go-proxy-tee/common/framing"
+	"github.com/docopt/docopt-go"
+)
+
+const (
+	BUFFER_LENGTH = 1024 * 64
+
+	// Largest text block.  Longer blocks are an error.
+
+	MAX_BLOCK_LENGTH = 1024 * 1024 * 64
+)
+
+// Source of the blocks of a capture, in order.  Returns io.EOF after the last block.
+type Blocks interface {
+	Next() (string, error)
+}
+
+// Function for the "command pattern".
+func Command(argv []string) {
+
+	usage := `
+Usage:
+    go-proxy-tee view [options] <file>
+
+Options:
+   -h, --help
+   --binaryfile               <file> is a 'binaryfile' capture: show each binaryXML frame decoded as XML.
+   --separator=<separator>    Text between blocks, with Go escapes such as \n and \u001e. [default: \n\n]
+   --height=<lines>           Lines per page. Default: $LINES, or 24.
+
+Where:
+   file   A 'go-proxy-tee net' capture.
+
+Shows <file> a page of whole blocks at a time.  At the ':' prompt:
+   Enter       Next page.
+   /pattern    Next block matching the regular expression, searching the decoded content.
+   n           Repeat the last search.
+   q           Quit.
+`
+
+	// DocOpt processing.
+
+	args, _ := docopt.Parse(usage, nil, true, "", false)
+	inputFileName := args["<file>"].(string)
+
+	height := pageHeight(args["--height"])
+	inputFile, err := os.Open(inputFileName)
+	if err != nil {
+		log.Fatalf("os.Open(%s) failed. Err: %+v\n", inputFileName, err)
+	}
+	defer inputFile.Close()
+
+	var blocks Blocks
+	if args["--binaryfile"].(bool) {
+		blocks = newFrameBlocks(inputFile)
+	} else {
+		separator, err := strconv.Unquote(`"` + args["--separator"].(string) + `"`)
+		if err != nil || separator == "" {
+			log.Fatalf("Bad --separator '%s'. Err: %+v\n", args["--separator"], err)
+		}
+		blocks = newTextBlocks(inputFile, separator)
+	}
+	if err := page(blocks, height, os.Stdin, os.Stdout); err != nil {
+		log.Fatalf("Viewing %s failed. Err: %+v\n", inputFileName, err)
+	}
+}
+
+// Lines per page, from --height, then $LINES, then 24.
+func pageHeight(option interface{}) int {
+	value, _ := option.(string)
+	if value == "" {
+		value = os.Getenv("LINES")
+	}
+	height, err := strconv.Atoi(value)
+	if err != nil || height <= 1 {
+		return 24
+	}
+	return height
+}
+
+// Show pages of blocks and follow the commands read from 'in'.
+func page(blocks Blocks, height int, in io.Reader, out io.Writer) error {
+	commands := bufio.NewReader(in)
+	var pattern *regexp.Regexp
+	var pending []string // Blocks read by a search, shown at the top of the next page.
+	for {
+
+		// Show whole blocks until the page is full.  A block longer than a page is shown alone.
+
+		lines := 0
+		for lines < height-1 {
+			var block string
+			if len(pending) > 0 {
+				block, pending = pending[0], pending[1:]
+			} else {
+				next, err := blocks.Next()
+				if err == io.EOF {
+					fmt.Fprintln(out, "(END)")
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				block = next
+			}
+			blockLines := strings.Count(block, "\n") + 2
+			if lines > 0 && lines+blockLines > height-1 {
+				pending = append([]string{block}, pending...)
+				break
+			}
+			fmt.Fprintf(out, "%s\n\n", block)
+			lines += blockLines
+		}
+
+		// Follow a command.
+
+		fmt.Fprint(out, ":")
+		command, err := commands.ReadString('\n')
+		if err != nil && command == "" {
+			return nil
+		}
+		command = strings.TrimRight(command, "\r\n")
+		switch {
+		case command == "q":
+			return nil
+		case strings.HasPrefix(command, "/"):
+			compiled, err := regexp.Compile(command[1:])
+			if err != nil {
+				fmt.Fprintf(out, "Bad pattern: %s\n", err)
+				continue
+			}
+			pattern = compiled
+			fallthrough
+		case command == "n":
+			if pattern == nil {
+				fmt.Fprintln(out, "No previous search.")
+				continue
+			}
+			found, err := search(blocks, pending, pattern)
+			if err == io.EOF {
+				fmt.Fprintf(out, "Pattern not found: %s\n(END)\n", pattern)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			pending = found
+		}
+	}
+}
+
+// Skip to the next block that matches 'pattern'.  Returns it, first, with the blocks not yet shown.
+func search(blocks Blocks, pending []string, pattern *regexp.Regexp) ([]string, error) {
+	for index, block := range pending {
+		if pattern.MatchString(block) {
+			return pending[index:], nil
+		}
+	}
+	for {
+		block, err := blocks.Next()
+		if err != nil {
+			return nil, err
+		}
+		if pattern.MatchString(block) {
+			return []string{block}, nil
+		}
+	}
+}
+
+// Blocks of a text capture, between separators.  Empty blocks are skipped.
+type textBlocks struct {
+	scanner *bufio.Scanner
+}
+
+func newTextBlocks(reader io.Reader, separator string) *textBlocks {
+	delimiter := []byte(separator)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, BUFFER_LENGTH), MAX_BLOCK_LENGTH)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if index := bytes.Index(data, delimiter); index >= 0 {
+			return index + len(delimiter), data[:index], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	return &textBlocks{scanner: scanner}
+}
+
+func (blocks *textBlocks) Next() (string, error) {
+	for blocks.scanner.Scan() {
+		if block := strings.TrimRight(blocks.scanner.Text(), "\n"); strings.TrimSpace(block) != "" {
+			return block, nil
+		}
+	}
+	if err := blocks.scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", io.EOF
+}
+
+// Blocks of a "binaryfile" capture: each binaryXML frame, decoded, and each run of bytes between frames.
+type frameBlocks struct {
+	frames int
+	next   []byte // A frame too large to peek, read while ending a run of bytes between frames.
+	offset int
+	reader *bufio.Reader
+}
+
+func newFrameBlocks(reader io.Reader) *frameBlocks {
+	return &frameBlocks{reader: bufio.NewReaderSize(reader, BUFFER_LENGTH)}
+}
+
+func (blocks *frameBlocks) Next() (string, error) {
+	if frame := blocks.next; frame != nil {
+		blocks.next = nil
+		return blocks.frameBlock(frame), nil
+	}
+	unframed := []byte{}
+	for {
+		token, err := blocks.reader.Peek(1)
+		if err != nil {
+			if len(unframed) > 0 {
+				return blocks.unframedBlock(unframed), nil
+			}
+			return "", io.EOF
+		}
+		var frame []byte
+		isPeeked := false
+		if token[0] == framing.BINARY_XML_START {
+			frame, isPeeked = framing.Peek(blocks.reader)
+		}
+		if frame == nil {
+			unframed = append(unframed, token[0])
+			blocks.reader.Discard(1)
+			continue
+		}
+		if len(unframed) > 0 {
+			if !isPeeked {
+				blocks.next = frame
+			}
+			return blocks.unframedBlock(unframed), nil // A peeked frame is read again next time.
+		}
+		if isPeeked {
+			blocks.reader.Discard(len(frame))
+		}
+		return blocks.frameBlock(frame), nil
+	}
+}
+
+func (blocks *frameBlocks) frameBlock(frame []byte) string {
+	blocks.frames++
+	header := fmt.Sprintf("-------- Frame %d at offset %d, %d bytes --------", blocks.frames, blocks.offset, len(frame))
+	blocks.offset += len(frame)
+	return header + "\n" + frameXml(frame)
+}
+
+func (blocks *frameBlocks) unframedBlock(unframed []byte) string {
+	header := fmt.Sprintf("-------- %d bytes outside frames at offset %d --------", len(unframed), blocks.offset)
+	blocks.offset += len(unframed)
+	return header + "\n" + strings.TrimRight(hex.Dump(unframed), "\n")
+}
+
+// Indented XML of a frame, as "binaryfile" decodes it, or its hex dump if it does not decode.
+func frameXml(frame []byte) string {
+	ctx := context.Background()
+	var param uint8
+	xmlBuffer := make([]byte, 4096)
+	if err := decode.ReadMessage(ctx, decode.DEFAULT_TIMEOUT, bytes.NewReader(frame), &param, &xmlBuffer); err != nil {
+		return fmt.Sprintf("[does not decode: %s]\n%s", err, strings.TrimRight(hex.Dump(frame), "\n"))
+	}
+	xmlString, err := decode.ToXML(ctx, decode.DEFAULT_TIMEOUT, xmlBuffer)
+	if err != nil {
+		return fmt.Sprintf("[does not decode: %s]\n%s", err, strings.TrimRight(hex.Dump(frame), "\n"))
+	}
+	formattedXml, err := decode.Indent([]byte(xmlString))
+	if err != nil {
+		return xmlString
+	}
+	return strings.TrimRight(string(formattedXml), "\n")
+}